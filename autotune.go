@@ -0,0 +1,169 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/leonm1/flightsense-go/throttle"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+const (
+	// How often the autotuner measures the run and adjusts its concurrency
+	tuneInterval = 2 * time.Second
+
+	// Provider requests in flight at the start of a run when -requests is 0
+	startRequests = 8
+
+	// CPU use above which a run is CPU-bound, and below which more parsers may help
+	cpuBound = 0.9
+	cpuSpare = 0.75
+
+	// Slowdown of provider requests over the fastest seen at which fewer are sent, if
+	// they are still slowing down
+	latencyBackoff = 2.0
+)
+
+// parsers bounds the rows parsed at once across the inputs of a run
+var parsers = throttle.New(runtime.GOMAXPROCS(0))
+
+// setupConcurrency sets the number of parsers and provider requests in flight from
+// -c and -requests, and autotunes those left at 0 until the returned function is
+// called
+func setupConcurrency() func() {
+	if *parserCount > 0 {
+		parsers.SetLimit(*parserCount)
+	}
+	requests := weather.Requests()
+	requests.SetLimit(startRequests)
+	if *maxRequests > 0 {
+		requests.SetLimit(*maxRequests)
+	}
+	if *parserCount > 0 && *maxRequests > 0 {
+		return func() {}
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		t := newTuner(*parserCount == 0, *maxRequests == 0)
+
+		tick := time.NewTicker(tuneInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				t.tune()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		infof("Concurrency: %d parsers, %d provider requests in flight", parsers.Limit(), requests.Limit())
+	}
+}
+
+// tuner adjusts the parsers when the run has spare CPU and rows wait to be parsed,
+// and the provider requests in flight when lookups wait on them, backing off when
+// the provider slows down under the load
+type tuner struct {
+	parse   bool
+	fetch   bool
+	cpu     time.Duration
+	cpuAt   time.Time
+	parsed  limiterStats
+	fetched limiterStats
+	fastest time.Duration
+	last    time.Duration
+}
+
+// limiterStats are the Stats of a throttle.Limiter at the previous tune
+type limiterStats struct {
+	calls  int64
+	waited int64
+	busy   time.Duration
+}
+
+func newTuner(parse bool, fetch bool) *tuner {
+	t := &tuner{parse: parse, fetch: fetch}
+	t.cpuUse()
+	t.parsed.delta(parsers)
+	t.fetched.delta(weather.Requests())
+
+	return t
+}
+
+// tune measures the run since the last tune and adjusts its concurrency
+func (t *tuner) tune() {
+	cpu := t.cpuUse()
+	parseCalls, parseWaited, _ := t.parsed.delta(parsers)
+	fetchCalls, fetchWaited, fetchBusy := t.fetched.delta(weather.Requests())
+
+	if t.parse {
+		n := parsers.Limit()
+		switch {
+		case cpu > cpuBound && n > runtime.GOMAXPROCS(0):
+			n--
+		case cpu < cpuSpare && parseWaited > parseCalls/10 && n < concurrencyLimit:
+			n += n/4 + 1
+			if n > concurrencyLimit {
+				n = concurrencyLimit
+			}
+		}
+		if n != parsers.Limit() {
+			debugf("Autotune: %.0f%% CPU, %d of %d rows waited to be parsed, now %d parsers", 100*cpu, parseWaited, parseCalls, n)
+			parsers.SetLimit(n)
+		}
+	}
+
+	if t.fetch && fetchCalls > 0 {
+		requests := weather.Requests()
+		latency := fetchBusy / time.Duration(fetchCalls)
+		if t.fastest == 0 || latency < t.fastest {
+			t.fastest = latency
+		}
+
+		n := requests.Limit()
+		switch {
+		case float64(latency) > latencyBackoff*float64(t.fastest) && latency > t.last && n > 1:
+			n = n * 3 / 4
+		case fetchWaited > 0 && n < concurrencyLimit:
+			n += 2
+			if n > concurrencyLimit {
+				n = concurrencyLimit
+			}
+		}
+		t.last = latency
+		if n != requests.Limit() {
+			debugf("Autotune: provider requests take %s (fastest %s), %d of %d waited, now %d in flight",
+				latency.Round(time.Millisecond), t.fastest.Round(time.Millisecond), fetchWaited, fetchCalls, n)
+			requests.SetLimit(n)
+		}
+	}
+}
+
+// cpuUse returns the fraction of the CPU time of GOMAXPROCS cores the process used
+// since it was last called
+func (t *tuner) cpuUse() float64 {
+	cpu, now := processCPU(), time.Now()
+	used, elapsed := cpu-t.cpu, now.Sub(t.cpuAt)
+	t.cpu, t.cpuAt = cpu, now
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(used) / (float64(elapsed) * float64(runtime.GOMAXPROCS(0)))
+}
+
+// delta returns the Stats of l since delta was last called
+func (s *limiterStats) delta(l *throttle.Limiter) (int64, int64, time.Duration) {
+	calls, waited, busy := l.Stats()
+	d := limiterStats{calls - s.calls, waited - s.waited, busy - s.busy}
+	*s = limiterStats{calls, waited, busy}
+
+	return d.calls, d.waited, d.busy
+}
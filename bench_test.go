@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leonm1/flightsense-go/cache"
+)
+
+// Rows of the synthetic input of BenchmarkEndToEnd
+const endToEndRows = 1000000
+
+// runMainEnv makes the test binary run main with its arguments instead of the tests,
+// so benchmarks can process inputs in a child process as a run would
+const runMainEnv = "FLIGHTSENSE_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(exitOK)
+	}
+
+	os.Exit(m.Run())
+}
+
+// demoRows returns the rows of the demo sample, and its header mapped to the names
+// the parser reads
+func demoRows(tb testing.TB) ([]*inputRow, []string) {
+	r := newReader(bytes.NewReader(demoSample), "sample.csv")
+	header, err := r.Read()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	header, err = mapHeader(append([]string(nil), header...))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var rows []*inputRow
+	for {
+		row, err := r.Read()
+		if err != nil {
+			break
+		}
+		rows = append(rows, &inputRow{seq: len(rows), fields: append([]string(nil), row...)})
+	}
+
+	return rows, header
+}
+
+// demoCache opens a copy of the demo weather, returning it with its keys and their
+// values
+func demoCache(tb testing.TB) (*cachemap.Map, []string, []interface{}) {
+	filename := filepath.Join(tb.TempDir(), "cache.txt")
+	if err := os.WriteFile(filename, demoWeather, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	m, err := cachemap.Open(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { m.Close() })
+
+	var keys []string
+	var values []interface{}
+	m.Range(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		values = append(values, v)
+		return true
+	})
+	if len(keys) == 0 {
+		tb.Fatal("The demo weather has no entries")
+	}
+
+	return m, keys, values
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	m, keys, _ := demoCache(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Entries are appended to the cache's file, each under a new key
+func BenchmarkCacheSet(b *testing.B) {
+	m, _, values := demoCache(b)
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("BENCH@%d", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := m.Set(keys[i], values[i%len(values)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWeatherEncode(b *testing.B) {
+	_, _, values := demoCache(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := cachemap.Encode(values[i%len(values)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWeatherDecode(b *testing.B) {
+	_, _, values := demoCache(b)
+	encoded := make([]string, len(values))
+	for i, v := range values {
+		s, err := cachemap.Encode(v)
+		if err != nil {
+			b.Fatal(err)
+		}
+		encoded[i] = s
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := cachemap.Decode(encoded[i%len(encoded)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEndToEnd processes a synthetic input of endToEndRows rows, repeating the
+// demo sample, with the demo weather in a child process, as a run would
+func BenchmarkEndToEnd(b *testing.B) {
+	if testing.Short() {
+		b.Skip("Processes a million rows")
+	}
+
+	dir := b.TempDir()
+	input, weather, key := writeDemoInputs(filepath.Join(dir, "demo-input"))
+
+	lines := strings.SplitAfter(strings.TrimSpace(string(demoSample)), "\n")
+	f, err := os.Create(input)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(lines[0])
+	for i := 0; i < endToEndRows; i++ {
+		w.WriteString(strings.TrimSuffix(lines[1+i%(len(lines)-1)], "\n") + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		outdir := filepath.Join(dir, fmt.Sprintf("out-%d", i))
+		cmd := exec.Command(os.Args[0], append(demoArgs(input, weather, key, outdir), "-quiet", "-progress", "0")...)
+		cmd.Env = append(os.Environ(), runMainEnv+"=1")
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			b.Fatalf("Processing the synthetic input failed: %s", err)
+		}
+	}
+	b.ReportMetric(float64(b.N*endToEndRows)/time.Since(start).Seconds(), "rows/s")
+}
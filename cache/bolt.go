@@ -0,0 +1,204 @@
+package cachemap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds the entries of a Bolt store
+var boltBucket = []byte("cache")
+
+// errStopRange ends a Range early when its callback returns false
+var errStopRange = errors.New("Range stopped")
+
+// Bolt is a Store kept in a BoltDB file. Entries are updated in place, so the file
+// doesn't grow with refetches and invalidations the way an append-only cache does.
+type Bolt struct {
+	db       *bolt.DB
+	readOnly bool
+	refresh  bool
+
+	// Keys set since refresh was enabled
+	fresh sync.Map
+
+	// Values set while read-only, which are only kept in memory
+	overlay *Map
+}
+
+// OpenBolt opens or creates the BoltDB file at filename. Writes are only synced to
+// disk when the store is flushed. A read-only store shares the file with other
+// readers, and is empty when the file doesn't exist.
+func OpenBolt(filename string, readOnly bool) (*Bolt, error) {
+	if readOnly {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return &Bolt{readOnly: true, overlay: NewMemory()}, nil
+		}
+	}
+
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout && readOnly {
+		return nil, fmt.Errorf("Cannot open bolt cache '%s' while another run writes to it", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open bolt cache '%s': %s", filename, err)
+	}
+	if readOnly {
+		return &Bolt{db: db, readOnly: true, overlay: NewMemory()}, nil
+	}
+	db.NoSync = true
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{db: db, overlay: NewMemory()}, nil
+}
+
+// Get returns a value set while read-only or from the database
+func (b *Bolt) Get(key string) (interface{}, error) {
+	if v, err := b.overlay.Get(key); err == nil {
+		return v, nil
+	}
+	if b.overlay.masked(key) {
+		return nil, fmt.Errorf("Key not found")
+	}
+
+	if b.refresh {
+		if _, ok := b.fresh.Load(key); !ok {
+			return nil, fmt.Errorf("Key not found")
+		}
+	}
+
+	var s string
+	found := false
+	b.view(func(bucket *bolt.Bucket) error {
+		if v := bucket.Get([]byte(key)); v != nil {
+			s, found = string(v), true
+		}
+		return nil
+	})
+	if !found {
+		return nil, fmt.Errorf("Key not found")
+	}
+
+	return codec.Decode(s)
+}
+
+// Set stores a value in the database unless one is already stored, or in memory
+// while read-only
+func (b *Bolt) Set(key string, value interface{}) error {
+	if b.readOnly {
+		return b.overlay.Set(key, value)
+	}
+
+	s, err := codec.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite entries which predate the refresh
+	overwrite := false
+	if b.refresh {
+		_, loaded := b.fresh.LoadOrStore(key, true)
+		overwrite = !loaded
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if !overwrite && bucket.Get([]byte(key)) != nil {
+			return nil
+		}
+		return bucket.Put([]byte(key), []byte(s))
+	})
+}
+
+// Invalidate deletes a value from the database, or only from memory while read-only
+func (b *Bolt) Invalidate(key string) error {
+	if b.readOnly {
+		b.overlay.mask(key)
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// Range calls f for each entry in the database until f returns false
+func (b *Bolt) Range(f func(key string, value interface{}) bool) error {
+	err := b.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(k []byte, s []byte) error {
+			v, err := codec.Decode(string(s))
+			if err != nil {
+				return fmt.Errorf("Cannot decode cache entry '%s': %s", k, err)
+			}
+			if !f(string(k), v) {
+				return errStopRange
+			}
+			return nil
+		})
+	})
+	if err == errStopRange {
+		return nil
+	}
+
+	return err
+}
+
+// view calls fn with the bucket of entries in a read transaction. A read-only store
+// of a file which doesn't exist, or predates the bucket, has no entries.
+func (b *Bolt) view(fn func(bucket *bolt.Bucket) error) error {
+	if b.db == nil {
+		return nil
+	}
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return nil
+		}
+		return fn(bucket)
+	})
+}
+
+// Flush syncs the database file to disk
+func (b *Bolt) Flush() error {
+	if b.db == nil || b.db.IsReadOnly() {
+		return nil
+	}
+
+	return b.db.Sync()
+}
+
+// Close syncs and closes the database file
+func (b *Bolt) Close() error {
+	if b.db == nil {
+		return nil
+	}
+	if err := b.Flush(); err != nil {
+		b.db.Close()
+		return err
+	}
+
+	return b.db.Close()
+}
+
+// SetReadOnly stops values being written to the database
+func (b *Bolt) SetReadOnly(readOnly bool) {
+	b.readOnly = readOnly
+}
+
+// SetRefresh makes Get ignore values stored before the refresh and Set overwrite them
+func (b *Bolt) SetRefresh(refresh bool) {
+	b.refresh = refresh
+}
@@ -4,112 +4,779 @@ package cachemap
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"io"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
 
-const defaultCache = "cache.txt"
+const (
+	defaultCache = "cache.txt"
+
+	// version of the disk cache format, recorded in the first line of each file.
+	// Version 1 files predate the header and version 2 records lack checksums.
+	version = 3
+
+	// versionPrefix starts the header line of a versioned cache file
+	versionPrefix = "#flightsense-cache v"
+
+	// tombstone is stored in place of a value to mark an entry as invalid
+	tombstone = "-"
+)
 
 var (
-	cache       sync.Map
-	cachename   string
+	cache       = &Map{}
 	initialized = false
+	backend     Store
+	codec       Codec = stringCodec{}
 )
 
+// Store is implemented by storage backends that can stand in for the default disk cache.
+// Programs importing flightsense-go can inject their own with Use.
+type Store interface {
+	Get(key string) (interface{}, error)
+	Set(key string, value interface{}) error
+
+	// Range calls f for each valid entry until f returns false
+	Range(f func(key string, value interface{}) bool) error
+
+	// Flush persists any buffered writes
+	Flush() error
+
+	// Close flushes the store and releases its resources
+	Close() error
+}
+
+// Codec converts cached values to and from the strings written to disk
+type Codec interface {
+	Encode(v interface{}) (string, error)
+	Decode(s string) (interface{}, error)
+}
+
+// Map is an in-memory cache of decoded values which appends new entries to a file on disk
+type Map struct {
+	m        sync.Map
+	name     string
+	readOnly bool
+	refresh  bool
+
+	// Keys set since refresh was enabled
+	fresh sync.Map
+
+	// Only keys accepted by filter are loaded from disk
+	filter func(key string) bool
+
+	// When lazy, entries loaded from disk are held as the location of their record in
+	// file and decoded on each Get, instead of being decoded once
+	lazy bool
+	file *os.File
+
+	// Held while appending to the file, so Close waits for in-flight writes
+	mu     sync.Mutex
+	closed bool
+}
+
+// dead marks an invalidated entry in memory
+type dead struct{}
+
+// record is the location of an entry's record in the file of a lazy map
+type record struct {
+	off int64
+	n   int
+}
+
+// stringCodec stores string values as they are
+type stringCodec struct{}
+
+func (stringCodec) Encode(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("Cannot encode %T without a codec", v)
+	}
+
+	return s, nil
+}
+
+func (stringCodec) Decode(s string) (interface{}, error) {
+	return s, nil
+}
+
+// invalidator is implemented by backends which can invalidate entries
+type invalidator interface {
+	Invalidate(key string) error
+}
+
+// readOnlySetter is implemented by backends which can stop persisting new entries
+type readOnlySetter interface {
+	SetReadOnly(readOnly bool)
+}
+
+// filterSetter is implemented by backends which can restrict the entries they load
+type filterSetter interface {
+	SetFilter(filter func(key string) bool)
+}
+
+// refreshSetter is implemented by backends which can ignore their existing entries
+type refreshSetter interface {
+	SetRefresh(refresh bool)
+}
+
+// Use directs all subsequent Get and Set calls to c instead of the disk cache
+func Use(c Store) {
+	backend = c
+
+	if b, ok := c.(readOnlySetter); ok {
+		b.SetReadOnly(cache.readOnly)
+	}
+	if b, ok := c.(refreshSetter); ok {
+		b.SetRefresh(cache.refresh)
+	}
+	if b, ok := c.(filterSetter); ok {
+		b.SetFilter(cache.filter)
+	}
+}
+
+// SetCodec sets how values are encoded on disk and in remote backends. Values are
+// stored as plain strings until a codec is set.
+func SetCodec(c Codec) {
+	codec = c
+}
+
 // Set caches a value in the map and writes it to disk
-func Set(key string, value string) error {
+func Set(key string, value interface{}) error {
+	if backend != nil {
+		return backend.Set(key, value)
+	}
+
 	if !initialized {
 		err := Load(defaultCache)
 		if err != nil {
-			log.Fatalf("Error loading cache: %s", err)
+			slog.Error("Error loading cache", "err", err)
+			os.Exit(1)
 		}
 	}
 
-	if _, loaded := cache.LoadOrStore(key, value); !loaded {
-		append(key, value)
+	return cache.Set(key, value)
+}
+
+// Get returns a value from the map
+func Get(key string) (interface{}, error) {
+	if backend != nil {
+		return backend.Get(key)
 	}
 
-	return nil
+	if !initialized {
+		err := Load(defaultCache)
+		if err != nil {
+			slog.Info("Looks like the default cache doesn't exist", "err", err)
+		}
+	}
+
+	return cache.Get(key)
 }
 
-// Get returns a value from the map
-func Get(key string) (string, error) {
+// Invalidate marks a cached value as invalid so the next Get misses
+func Invalidate(key string) error {
+	if backend != nil {
+		b, ok := backend.(invalidator)
+		if !ok {
+			return fmt.Errorf("Cache backend %T does not support invalidation", backend)
+		}
+		return b.Invalidate(key)
+	}
+
 	if !initialized {
 		err := Load(defaultCache)
 		if err != nil {
-			log.Printf("Looks like the default cache doesn't exist: %s", err)
+			slog.Error("Error loading cache", "err", err)
+			os.Exit(1)
 		}
 	}
 
-	if v, ok := cache.Load(key); ok {
-		return v.(string), nil
+	return cache.Invalidate(key)
+}
+
+// Range calls f for each valid entry of the cache until f returns false
+func Range(f func(key string, value interface{}) bool) error {
+	if backend != nil {
+		return backend.Range(f)
+	}
+
+	return cache.Range(f)
+}
+
+// Flush persists any writes the cache has buffered
+func Flush() error {
+	if backend != nil {
+		return backend.Flush()
 	}
 
-	return "", fmt.Errorf("Key not found")
+	return cache.Flush()
+}
+
+// Close flushes the cache and releases its resources
+func Close() error {
+	if backend != nil {
+		return backend.Close()
+	}
+
+	return cache.Close()
 }
 
 // Load initializes the in-memory map with the information from the disk cache
 func Load(filename string) error {
-	cachename = filename
 	initialized = true
 
-	f, err := os.OpenFile(cachename, os.O_CREATE|os.O_RDONLY, 0644)
-	defer f.Close()
+	return cache.Load(filename)
+}
+
+// Export writes a new disk cache file
+func Export(filename string) error {
+	return cache.Export(filename)
+}
+
+// SetReadOnly stops the disk cache from recording new entries; values set while
+// read-only are only kept in memory
+func SetReadOnly(readOnly bool) {
+	cache.SetReadOnly(readOnly)
+
+	if b, ok := backend.(readOnlySetter); ok {
+		b.SetReadOnly(readOnly)
+	}
+}
+
+// ReadOnly reports whether the cache stopped recording new entries
+func ReadOnly() bool {
+	return cache.readOnly
+}
+
+// SetRefresh makes the cache ignore the entries it already holds: they are
+// reported as missing and overwritten when set again
+func SetRefresh(refresh bool) {
+	cache.SetRefresh(refresh)
+
+	if b, ok := backend.(refreshSetter); ok {
+		b.SetRefresh(refresh)
+	}
+}
+
+// SetFilter restricts the entries loaded from disk to the keys accepted by filter,
+// saving memory when only part of the cache is needed. It must be called before Load.
+func SetFilter(filter func(key string) bool) {
+	cache.SetFilter(filter)
+
+	if b, ok := backend.(filterSetter); ok {
+		b.SetFilter(filter)
+	}
+}
+
+// SetLazy keeps only the location of each entry of the disk cache in memory, reading
+// and decoding entries as they are used. It trades a read per hit for memory, for
+// caches too large to hold decoded. It must be called before Load.
+func SetLazy(lazy bool) {
+	cache.lazy = lazy
+}
+
+// Encode returns the stored representation of a value using the current codec
+func Encode(v interface{}) (string, error) {
+	return codec.Encode(v)
+}
+
+// Decode returns the value of a stored representation using the current codec
+func Decode(s string) (interface{}, error) {
+	return codec.Decode(s)
+}
+
+// NewMemory creates a Map which only holds its entries in memory
+func NewMemory() *Map {
+	return &Map{}
+}
+
+// Open creates a Map loaded from the disk cache at filename
+func Open(filename string) (*Map, error) {
+	c := &Map{}
+	if err := c.Load(filename); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// OpenReadOnly creates a Map loaded from an existing disk cache at filename without
+// changing the file: older caches aren't migrated and the map's entries aren't
+// appended to it, so it can be read while a run holding the lock writes to it
+func OpenReadOnly(filename string) (*Map, error) {
+	c := &Map{}
+	c.SetReadOnly(true)
+
+	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	if err := c.load(f, filename); err != nil {
+		return nil, err
+	}
 
-	// Load each line into map
-	for scanner.Scan() {
-		line := scanner.Text()
+	return c, nil
+}
+
+// SetReadOnly stops new entries being appended to the map's file
+func (c *Map) SetReadOnly(readOnly bool) {
+	c.readOnly = readOnly
+}
+
+// SetRefresh makes the map ignore the entries it already holds
+func (c *Map) SetRefresh(refresh bool) {
+	c.refresh = refresh
+}
+
+// header returns the first line of a cache file in the current format
+func header() string {
+	return versionPrefix + strconv.Itoa(version)
+}
+
+// parseVersion returns the format version of a cache file from its first line
+func parseVersion(line string) (int, error) {
+	if !strings.HasPrefix(line, versionPrefix) {
+		return 0, nil
+	}
+
+	v, err := strconv.Atoi(strings.TrimPrefix(line, versionPrefix))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("Malformed cache header '%s'", line)
+	}
+	if v > version {
+		return 0, fmt.Errorf("Cache version %d is newer than supported version %d, upgrade flightsense to read it", v, version)
+	}
+
+	return v, nil
+}
+
+// formatLine returns a cache record: the key, encoded value and a CRC-32 of both,
+// delimited by underscores. Keys have no underscores, but values may.
+func formatLine(k string, s string) string {
+	line := k + "_" + s
+	return fmt.Sprintf("%s_%08x", line, crc32.ChecksumIEEE([]byte(line)))
+}
+
+// parseLine returns the key and encoded value of a record in a version v cache file,
+// verifying its checksum where the version has one. The key runs to the first
+// underscore and the checksum follows the last, so values may hold underscores.
+func parseLine(line string, v int) (string, string, error) {
+	if v < 3 {
 		val := strings.Split(line, "_")
+		if len(val) != 2 {
+			return "", "", fmt.Errorf("Expected 2 fields, found %d", len(val))
+		}
+		return val[0], val[1], nil
+	}
 
-		// Load into map
-		if len(val) == 2 {
-			if _, loaded := cache.LoadOrStore(val[0], val[1]); loaded {
-				log.Printf("Duplicate value in cache for key '%s'", val[0])
+	i, j := strings.IndexByte(line, '_'), strings.LastIndexByte(line, '_')
+	if i < 0 || i == j {
+		return "", "", fmt.Errorf("Expected 3 fields, found %d", strings.Count(line, "_")+1)
+	}
+	key, value := line[:i], line[i+1:j]
+	sum, err := strconv.ParseUint(line[j+1:], 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE([]byte(line[:j])) {
+		return "", "", fmt.Errorf("Checksum mismatch for key '%s'", key)
+	}
+
+	return key, value, nil
+}
+
+// SetFilter restricts the entries subsequently loaded into the map to the keys accepted by filter
+func (c *Map) SetFilter(filter func(key string) bool) {
+	c.filter = filter
+}
+
+// Set caches a value in the map and appends it to the map's file
+func (c *Map) Set(key string, value interface{}) error {
+	// Overwrite entries which predate the refresh
+	if c.refresh {
+		if _, ok := c.fresh.LoadOrStore(key, true); !ok {
+			c.m.Store(key, value)
+			return c.append(key, value)
+		}
+	}
+
+	v, loaded := c.m.LoadOrStore(key, value)
+	if !loaded {
+		return c.append(key, value)
+	}
+
+	// Replace invalidated entries
+	if _, ok := v.(dead); ok {
+		c.m.Store(key, value)
+		return c.append(key, value)
+	}
+
+	return nil
+}
+
+// Get returns a value from the map
+func (c *Map) Get(key string) (interface{}, error) {
+	if c.refresh {
+		if _, ok := c.fresh.Load(key); !ok {
+			return nil, fmt.Errorf("Key not found")
+		}
+	}
+
+	if v, ok := c.m.Load(key); ok {
+		if r, ok := v.(record); ok {
+			return c.readRecord(key, r)
+		}
+		if _, ok := v.(dead); !ok {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Key not found")
+}
+
+// readRecord reads and decodes the entry of a lazy map at r
+func (c *Map) readRecord(key string, r record) (interface{}, error) {
+	b := make([]byte, r.n)
+	if _, err := c.file.ReadAt(b, r.off); err != nil {
+		return nil, err
+	}
+
+	k, enc, err := parseLine(string(b), version)
+	if err != nil {
+		return nil, err
+	}
+	if k != key {
+		return nil, fmt.Errorf("Record of '%s' holds '%s'", key, k)
+	}
+
+	return codec.Decode(enc)
+}
+
+// Invalidate replaces a value in the map with a tombstone and records it on disk
+func (c *Map) Invalidate(key string) error {
+	v, ok := c.m.Load(key)
+	if !ok {
+		return nil
+	}
+	if _, ok := v.(dead); ok {
+		return nil
+	}
+
+	c.m.Store(key, dead{})
+	return c.appendLine(key, tombstone)
+}
+
+// mask invalidates key in memory whether or not the map holds it, so a map overlaying
+// another store hides the store's entry
+func (c *Map) mask(key string) {
+	c.m.Store(key, dead{})
+}
+
+// masked reports whether key is invalidated in the map
+func (c *Map) masked(key string) bool {
+	v, ok := c.m.Load(key)
+	if !ok {
+		return false
+	}
+	_, ok = v.(dead)
+
+	return ok
+}
+
+// Range calls f for each valid entry in the map until f returns false
+func (c *Map) Range(f func(key string, value interface{}) bool) error {
+	c.m.Range(func(k interface{}, v interface{}) bool {
+		if _, ok := v.(dead); ok {
+			return true
+		}
+		if r, ok := v.(record); ok {
+			var err error
+			if v, err = c.readRecord(k.(string), r); err != nil {
+				return true
 			}
 		}
+
+		return f(k.(string), v)
+	})
+
+	return nil
+}
+
+// Flush does nothing, as the map appends each entry to its file as it is set
+func (c *Map) Flush() error {
+	return nil
+}
+
+// Close waits for in-flight appends to finish and stops further entries being
+// written to the map's file
+func (c *Map) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.file != nil {
+		return c.file.Close()
 	}
 
 	return nil
 }
 
-// Export writes a new disk cache file
-func Export(filename string) error {
-	cachename = filename
+// Merge copies every entry of other which is not already present into the map
+// and returns the number of entries added. Merged entries are only held in memory
+// until the map is exported.
+func (c *Map) Merge(other *Map) int {
+	added := 0
+
+	other.Range(func(k string, v interface{}) bool {
+		if _, loaded := c.m.LoadOrStore(k, v); !loaded {
+			added++
+		}
 
-	f, err := os.OpenFile(cachename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+		return true
+	})
+
+	return added
+}
+
+// Load reads the disk cache at filename into the map, decoding each value once.
+// Caches written before the format was versioned are migrated to the current version.
+// The file is created unless the map is read-only, when a missing file is an empty
+// cache.
+func (c *Map) Load(filename string) error {
+	flag := os.O_CREATE | os.O_RDONLY
+	if c.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filename, flag, 0644)
+	if os.IsNotExist(err) && c.readOnly {
+		c.name = filename
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	defer f.Close()
+
+	return c.load(f, filename)
+}
+
+// load reads the disk cache f opened at filename into the map
+func (c *Map) load(f *os.File, filename string) error {
+	c.name = filename
+
+	v, lines, err := c.read(f, filename)
 	if err != nil {
 		return err
 	}
 
-	cache.Range(func(k interface{}, v interface{}) bool {
-		_, err = fmt.Fprintf(f, "%s_%s\n", k.(string), v.(string))
+	// Lazy entries are read from the file as they are used
+	if c.lazy {
+		if c.file, err = os.Open(c.name); err != nil {
+			return err
+		}
+	}
+
+	// Terminate a truncated final record so new records start on their own line
+	if !c.readOnly && v == version && !endsWithNewline(f) {
+		if err := c.appendRaw(""); err != nil {
+			return err
+		}
+	}
+
+	// Rewrite older caches in the current format, which also gives new files a header.
+	// A filtered map doesn't hold every entry, so migration waits for an unfiltered load.
+	if v < version && !c.readOnly && (c.filter == nil || lines == 0) {
+		if lines > 0 {
+			from := v
+			if from == 0 {
+				from = 1
+			}
+			slog.Info("Migrating cache", "file", filename, "from", from, "to", version)
+		}
+		return c.Export(filename)
+	}
+
+	return nil
+}
+
+// read loads the records of a cache file into the map, returning the file's format
+// version and number of lines
+func (c *Map) read(r io.Reader, filename string) (int, int, error) {
+	scanner := bufio.NewScanner(r)
+	v, lines, bad := 0, 0, 0
+
+	// Offset of each line in the file, for lazy entries
+	var start, pos int64
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			start = pos
+		}
+		pos += int64(advance)
+		return advance, token, err
+	})
+
+	var err error
+
+	// Load each line into map
+	for ; scanner.Scan(); lines++ {
+		line := scanner.Text()
+
+		if lines == 0 {
+			v, err = parseVersion(line)
+			if err != nil {
+				return 0, 0, fmt.Errorf("%s: %s", filename, err)
+			}
+			if v > 0 {
+				continue
+			}
+		}
+
+		if line == "" {
+			continue
+		}
+
+		k, enc, err := parseLine(line, v)
+		if err != nil {
+			bad++
+			slog.Warn("Skipping corrupt cache record", "file", filename, "line", lines+1, "err", err)
+			continue
+		}
+
+		if c.filter != nil && !c.filter(k) {
+			continue
+		}
+
+		var value interface{} = dead{}
+		if c.lazy && v == version && enc != tombstone {
+			value = record{off: start, n: len(line)}
+		} else if enc != tombstone {
+			value, err = codec.Decode(enc)
+			if err != nil {
+				bad++
+				slog.Warn("Skipping undecodable cache entry", "file", filename, "line", lines+1, "key", k, "err", err)
+				continue
+			}
+		}
+
+		// Load into map. Later lines (tombstones, refetches and refreshes)
+		// supersede earlier ones.
+		c.m.Store(k, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if bad > 0 {
+		slog.Warn("Skipped corrupt records in cache", "file", filename, "records", bad)
+	}
+
+	return v, lines, nil
+}
+
+// Export writes the valid entries of the map to a new disk cache file, replacing
+// any existing file only once it has been completely written
+func (c *Map) Export(filename string) error {
+	c.name = filename
+
+	return replaceFile(filename, c.write)
+}
+
+// write writes a header and the valid entries of the map to w
+func (c *Map) write(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, header())
+
+	var err error
+	c.Range(func(k string, v interface{}) bool {
+		var s string
+		s, err = codec.Encode(v)
 		if err != nil {
-			log.Fatalf("Error writing cache file: '%s'", err)
+			return false
 		}
 
-		return true
+		_, err = fmt.Fprintln(w, formatLine(k, s))
+		return err == nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return w.Flush()
 }
 
-func append(k string, v string) error {
-	f, err := os.OpenFile(cachename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// replaceFile writes a temporary file with write and renames it over filename once
+// it has been completely written
+func replaceFile(filename string, write func(w io.Writer) error) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp)
 	defer f.Close()
 
-	// Print key and value delimited by an underscore '_'
-	fmt.Fprintf(f, "%s_%s\n", k, v)
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+func (c *Map) append(k string, v interface{}) error {
+	s, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return c.appendLine(k, s)
+}
+
+func (c *Map) appendLine(k string, s string) error {
+	return c.appendRaw(formatLine(k, s))
+}
+
+func (c *Map) appendRaw(line string) error {
+	// Maps without a file only live in memory
+	if c.readOnly || c.name == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return fmt.Errorf("Cache '%s' is closed", c.name)
+	}
+
+	f, err := os.OpenFile(c.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, line)
 
 	return err
 }
+
+// endsWithNewline reports whether f is empty or its last byte is a newline
+func endsWithNewline(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return true
+	}
+
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, info.Size()-1); err != nil {
+		return true
+	}
+
+	return b[0] == '\n'
+}
@@ -0,0 +1,98 @@
+package cachemap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		v         int
+		wantKey   string
+		wantValue string
+		wantErr   bool
+	}{
+		{"record", formatLine("JFK@1484438400", "Zm9v|api.darksky.net"), version, "JFK@1484438400", "Zm9v|api.darksky.net", false},
+		{"underscores in the value", formatLine("JFK@1484438400", "Zm9v|weather_proxy:8080"), version, "JFK@1484438400", "Zm9v|weather_proxy:8080", false},
+		{"tombstone", formatLine("JFK@1484438400", tombstone), version, "JFK@1484438400", tombstone, false},
+		{"no checksum", "JFK@1484438400_Zm9v", version, "", "", true},
+		{"bad checksum", "JFK@1484438400_Zm9v_00000000", version, "", "", true},
+		{"no fields", "JFK@1484438400", version, "", "", true},
+		{"version 2", "JFK@1484438400_Zm9v", 2, "JFK@1484438400", "Zm9v", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, v, err := parseLine(tt.line, tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLine(%q) error = %v, want error %v", tt.line, err, tt.wantErr)
+			}
+			if k != tt.wantKey || v != tt.wantValue {
+				t.Errorf("parseLine(%q) = %q, %q, want %q, %q", tt.line, k, v, tt.wantKey, tt.wantValue)
+			}
+		})
+	}
+}
+
+// Values of observations from endpoint hosts with underscores are loaded back
+func TestMapRoundTripUnderscores(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.txt")
+	entries := map[string]string{
+		"JFK@1484438400":      "Zm9v|weather_proxy:8080",
+		"ORD+KMDW@1484438400": "YmFy|api.darksky.net",
+		"ATL@1484438400":      "YmF6|_leading_and_trailing_",
+	}
+
+	c, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range entries {
+		if err := c.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for k, want := range entries {
+		got, err := c.Get(k)
+		if err != nil {
+			t.Errorf("Get(%q) after reloading: %s", k, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+}
+
+// A read-only map of a file which doesn't exist is empty, and doesn't create it
+func TestLoadReadOnlyMissing(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.txt")
+
+	c := &Map{}
+	c.SetReadOnly(true)
+	if err := c.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("JFK@1484438400", "Zm9v|api.darksky.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Read-only map created '%s': %v", filename, err)
+	}
+}
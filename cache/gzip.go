@@ -0,0 +1,116 @@
+package cachemap
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"sync"
+)
+
+// Gzip is a Store held in memory and saved to a gzip-compressed cache file when
+// flushed, trading durability between flushes for a much smaller file
+type Gzip struct {
+	m        *Map
+	filename string
+	readOnly bool
+
+	mu    sync.Mutex
+	dirty bool
+}
+
+// OpenGzip creates a Gzip store loaded from the compressed cache file at filename,
+// which need not exist yet
+func OpenGzip(filename string) (*Gzip, error) {
+	g := &Gzip{m: NewMemory(), filename: filename}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if _, _, err := g.m.read(r, filename); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Get returns a value from memory
+func (g *Gzip) Get(key string) (interface{}, error) {
+	return g.m.Get(key)
+}
+
+// Set caches a value in memory until the next flush
+func (g *Gzip) Set(key string, value interface{}) error {
+	g.touch()
+	return g.m.Set(key, value)
+}
+
+// Invalidate removes a value from the cache at the next flush
+func (g *Gzip) Invalidate(key string) error {
+	g.touch()
+	return g.m.Invalidate(key)
+}
+
+// Range calls f for each valid entry until f returns false
+func (g *Gzip) Range(f func(key string, value interface{}) bool) error {
+	return g.m.Range(f)
+}
+
+// Flush rewrites the compressed file if any entry changed since the last flush
+func (g *Gzip) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.dirty || g.readOnly {
+		return nil
+	}
+
+	err := replaceFile(g.filename, func(w io.Writer) error {
+		z := gzip.NewWriter(w)
+		if err := g.m.write(z); err != nil {
+			return err
+		}
+		return z.Close()
+	})
+	if err != nil {
+		return err
+	}
+	g.dirty = false
+
+	return nil
+}
+
+// Close flushes the store
+func (g *Gzip) Close() error {
+	return g.Flush()
+}
+
+// SetReadOnly stops flushes from writing the compressed file
+func (g *Gzip) SetReadOnly(readOnly bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.readOnly = readOnly
+}
+
+// SetRefresh makes the store ignore the entries it already holds
+func (g *Gzip) SetRefresh(refresh bool) {
+	g.m.SetRefresh(refresh)
+}
+
+func (g *Gzip) touch() {
+	g.mu.Lock()
+	g.dirty = true
+	g.mu.Unlock()
+}
@@ -0,0 +1,139 @@
+package cachemap
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis is a Cache stored on a redis server so several machines can share weather data
+type Redis struct {
+	client   *redis.Client
+	readOnly bool
+	refresh  bool
+
+	// Keys set since refresh was enabled
+	fresh sync.Map
+
+	// Values set while read-only, which are only kept in memory
+	overlay *Map
+}
+
+// NewRedis connects to the redis server at addr and verifies that it is reachable
+func NewRedis(addr string) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Cannot reach redis at '%s': %s", addr, err)
+	}
+
+	return &Redis{client: client, overlay: NewMemory()}, nil
+}
+
+// Get returns a value set while read-only or from redis
+func (r *Redis) Get(key string) (interface{}, error) {
+	if v, err := r.overlay.Get(key); err == nil {
+		return v, nil
+	}
+	if r.overlay.masked(key) {
+		return nil, fmt.Errorf("Key not found")
+	}
+
+	if r.refresh {
+		if _, ok := r.fresh.Load(key); !ok {
+			return nil, fmt.Errorf("Key not found")
+		}
+	}
+
+	v, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("Key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Decode(v)
+}
+
+// Set stores a value in redis unless another machine already stored one, or in
+// memory while read-only
+func (r *Redis) Set(key string, value interface{}) error {
+	if r.readOnly {
+		return r.overlay.Set(key, value)
+	}
+
+	s, err := codec.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite entries which predate the refresh
+	if r.refresh {
+		if _, ok := r.fresh.LoadOrStore(key, true); !ok {
+			return r.client.Set(key, s, 0).Err()
+		}
+	}
+
+	return r.client.SetNX(key, s, 0).Err()
+}
+
+// Invalidate deletes a value from redis, or only from memory while read-only
+func (r *Redis) Invalidate(key string) error {
+	if r.readOnly {
+		r.overlay.mask(key)
+		return nil
+	}
+
+	return r.client.Del(key).Err()
+}
+
+// Range calls f for each value in redis until f returns false. The redis database
+// is assumed to hold only cache entries.
+func (r *Redis) Range(f func(key string, value interface{}) bool) error {
+	iter := r.client.Scan(0, "", 1000).Iterator()
+
+	for iter.Next() {
+		k := iter.Val()
+
+		v, err := r.client.Get(k).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		value, err := codec.Decode(v)
+		if err != nil {
+			return fmt.Errorf("Cannot decode cache entry '%s': %s", k, err)
+		}
+		if !f(k, value) {
+			return nil
+		}
+	}
+
+	return iter.Err()
+}
+
+// Flush does nothing, as every value is sent to redis as it is set
+func (r *Redis) Flush() error {
+	return nil
+}
+
+// SetReadOnly stops values being written to redis
+func (r *Redis) SetReadOnly(readOnly bool) {
+	r.readOnly = readOnly
+}
+
+// SetRefresh makes Get ignore values stored before the refresh and Set overwrite them
+func (r *Redis) SetRefresh(refresh bool) {
+	r.refresh = refresh
+}
+
+// Close closes the connection to the redis server
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
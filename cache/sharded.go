@@ -0,0 +1,172 @@
+package cachemap
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Sharded is a Cache split across several files in a directory. Each shard is only
+// loaded when one of its keys is first used, so runs touching few airports or
+// months load a fraction of the cache.
+type Sharded struct {
+	dir      string
+	shard    func(key string) string
+	readOnly bool
+	refresh  bool
+	filter   func(key string) bool
+
+	mu     sync.Mutex
+	shards map[string]*Map
+
+	// Shards without a file, held in memory until a key is first set in them
+	empty map[string]bool
+}
+
+// NewSharded creates a Sharded cache in dir which stores each key in the file
+// named by shard(key)
+func NewSharded(dir string, shard func(key string) string) (*Sharded, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Sharded{dir: dir, shard: shard, shards: make(map[string]*Map), empty: make(map[string]bool)}, nil
+}
+
+// Get returns a value from the key's shard
+func (s *Sharded) Get(key string) (interface{}, error) {
+	m, err := s.get(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Get(key)
+}
+
+// Set caches a value in the key's shard
+func (s *Sharded) Set(key string, value interface{}) error {
+	m, err := s.get(key, true)
+	if err != nil {
+		return err
+	}
+
+	return m.Set(key, value)
+}
+
+// Invalidate marks a value in the key's shard as invalid
+func (s *Sharded) Invalidate(key string) error {
+	m, err := s.get(key, false)
+	if err != nil {
+		return err
+	}
+
+	return m.Invalidate(key)
+}
+
+// Range calls f for each valid entry of every shard in the directory until f returns false
+func (s *Sharded) Range(f func(key string, value interface{}) bool) error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.txt"))
+	if err != nil {
+		return err
+	}
+
+	stopped := false
+	for _, file := range files {
+		m, err := s.open(filepath.Base(file), false)
+		if err != nil {
+			return err
+		}
+
+		m.Range(func(k string, v interface{}) bool {
+			stopped = !f(k, v)
+			return !stopped
+		})
+		if stopped {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Flush does nothing, as each shard appends entries to its file as they are set
+func (s *Sharded) Flush() error {
+	return nil
+}
+
+// Close waits for in-flight appends to the loaded shards and stops further writes
+func (s *Sharded) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.shards {
+		m.Close()
+	}
+
+	return nil
+}
+
+// SetReadOnly stops new entries being appended to the shard files
+func (s *Sharded) SetReadOnly(readOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readOnly = readOnly
+	for _, m := range s.shards {
+		m.SetReadOnly(readOnly)
+	}
+}
+
+// SetRefresh makes every shard ignore the entries it already holds
+func (s *Sharded) SetRefresh(refresh bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refresh = refresh
+	for _, m := range s.shards {
+		m.SetRefresh(refresh)
+	}
+}
+
+// SetFilter restricts the entries loaded from shards opened after the call to the keys accepted by filter
+func (s *Sharded) SetFilter(filter func(key string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.filter = filter
+}
+
+// get returns the shard holding key, loading it from disk on first use. The shard's
+// file is only created when set is true and the cache isn't read-only.
+func (s *Sharded) get(key string, set bool) (*Map, error) {
+	return s.open(s.shard(key)+".txt", set)
+}
+
+// open returns the shard stored in the file name, loading it from disk on first use.
+// A shard without a file is empty, and its file is created once create is true.
+func (s *Sharded) open(name string, create bool) (*Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	create = create && !s.readOnly
+	if m, ok := s.shards[name]; ok && !(create && s.empty[name]) {
+		return m, nil
+	}
+
+	m := &Map{readOnly: s.readOnly, refresh: s.refresh, filter: s.filter}
+	path := filepath.Join(s.dir, name)
+	if !create {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			s.shards[name], s.empty[name] = m, true
+			return m, nil
+		}
+	}
+
+	if err := m.Load(path); err != nil {
+		return nil, err
+	}
+	s.shards[name] = m
+	delete(s.empty, name)
+
+	return m, nil
+}
@@ -0,0 +1,202 @@
+package cachemap
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+
+	// Registers the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite is a Store kept in a SQLite database, so the cache can be inspected and
+// queried with ordinary SQL tools
+type SQLite struct {
+	db       *sql.DB
+	readOnly bool
+	refresh  bool
+
+	// Keys set since refresh was enabled
+	fresh sync.Map
+
+	// Values set while read-only, which are only kept in memory
+	overlay *Map
+}
+
+// OpenSQLite opens or creates the SQLite database at filename. A read-only store
+// opens the database read-only without creating its table, and is empty when the
+// file or table doesn't exist.
+func OpenSQLite(filename string, readOnly bool) (*SQLite, error) {
+	dsn := filename
+	if readOnly {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return &SQLite{readOnly: true, overlay: NewMemory()}, nil
+		}
+		dsn = "file:" + filename + "?mode=ro"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, so share one connection between goroutines
+	db.SetMaxOpenConns(1)
+
+	// A database which predates the table has no entries
+	if readOnly {
+		var tables int
+		err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'cache'").Scan(&tables)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Cannot open sqlite cache '%s': %s", filename, err)
+		}
+		if tables == 0 {
+			db.Close()
+			return &SQLite{readOnly: true, overlay: NewMemory()}, nil
+		}
+		return &SQLite{db: db, readOnly: true, overlay: NewMemory()}, nil
+	}
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS cache (key TEXT PRIMARY KEY, value TEXT NOT NULL)")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Cannot open sqlite cache '%s': %s", filename, err)
+	}
+
+	return &SQLite{db: db, overlay: NewMemory()}, nil
+}
+
+// Get returns a value set while read-only or from the database
+func (s *SQLite) Get(key string) (interface{}, error) {
+	if v, err := s.overlay.Get(key); err == nil {
+		return v, nil
+	}
+	if s.overlay.masked(key) {
+		return nil, fmt.Errorf("Key not found")
+	}
+
+	if s.refresh {
+		if _, ok := s.fresh.Load(key); !ok {
+			return nil, fmt.Errorf("Key not found")
+		}
+	}
+
+	// A read-only store of a file which doesn't exist has no entries
+	if s.db == nil {
+		return nil, fmt.Errorf("Key not found")
+	}
+
+	var v string
+	err := s.db.QueryRow("SELECT value FROM cache WHERE key = ?", key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Decode(v)
+}
+
+// Set stores a value in the database unless one is already stored, or in memory
+// while read-only
+func (s *SQLite) Set(key string, value interface{}) error {
+	if s.readOnly {
+		return s.overlay.Set(key, value)
+	}
+
+	v, err := codec.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite entries which predate the refresh
+	if s.refresh {
+		if _, ok := s.fresh.LoadOrStore(key, true); !ok {
+			_, err = s.db.Exec("INSERT OR REPLACE INTO cache (key, value) VALUES (?, ?)", key, v)
+			return err
+		}
+	}
+
+	_, err = s.db.Exec("INSERT OR IGNORE INTO cache (key, value) VALUES (?, ?)", key, v)
+
+	return err
+}
+
+// Invalidate deletes a value from the database, or only from memory while read-only
+func (s *SQLite) Invalidate(key string) error {
+	if s.readOnly {
+		s.overlay.mask(key)
+		return nil
+	}
+
+	_, err := s.db.Exec("DELETE FROM cache WHERE key = ?", key)
+
+	return err
+}
+
+// Range calls f for each entry in the database until f returns false
+func (s *SQLite) Range(f func(key string, value interface{}) bool) error {
+	if s.db == nil {
+		return nil
+	}
+
+	rows, err := s.db.Query("SELECT key, value FROM cache")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Decode every row before calling f, as f may use the store's only connection
+	entries := make(map[string]interface{})
+	for rows.Next() {
+		var k, enc string
+		if err := rows.Scan(&k, &enc); err != nil {
+			return err
+		}
+
+		v, err := codec.Decode(enc)
+		if err != nil {
+			return fmt.Errorf("Cannot decode cache entry '%s': %s", k, err)
+		}
+		entries[k] = v
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for k, v := range entries {
+		if !f(k, v) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Flush does nothing, as every write is committed as it is made
+func (s *SQLite) Flush() error {
+	return nil
+}
+
+// Close closes the database
+func (s *SQLite) Close() error {
+	if s.db == nil {
+		return nil
+	}
+
+	return s.db.Close()
+}
+
+// SetReadOnly stops values being written to the database
+func (s *SQLite) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// SetRefresh makes Get ignore values stored before the refresh and Set overwrite them
+func (s *SQLite) SetRefresh(refresh bool) {
+	s.refresh = refresh
+}
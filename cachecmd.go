@@ -0,0 +1,343 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leonm1/airports-go"
+	"github.com/leonm1/flightsense-go/cache"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// cacheCommands are the subcommands of 'cache'
+var cacheCommands = []string{"merge", "compact", "invalidate", "stats", "get", "dump"}
+
+// cacheCommand returns the function of 'cache' given no subcommand, or one which
+// isn't among cacheCommands, whose subcommands have flags of their own
+func cacheCommand(*flag.FlagSet) func(args []string) {
+	return func(args []string) {
+		if len(args) > 0 {
+			fatalf("Unknown cache command '%s'", args[0])
+		}
+
+		fmt.Fprintf(os.Stderr, "Usage: flightsense cache %s [arguments]\n", strings.Join(cacheCommands, "|"))
+		os.Exit(2)
+	}
+}
+
+// cacheMerge defines the flags of 'cache merge' on fs and returns its function,
+// which combines several disk caches into a single new cache file
+func cacheMerge(fs *flag.FlagSet) func(args []string) {
+	out := fs.String("o", "", "Destination cache file")
+
+	return func(args []string) {
+		if *out == "" || len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "Usage: flightsense cache merge a.cache b.cache... -o merged.cache")
+			os.Exit(2)
+		}
+
+		merged := &cachemap.Map{}
+		for _, in := range args {
+			c, err := cachemap.OpenReadOnly(in)
+			if err != nil {
+				fatalf("%s", err)
+			}
+
+			infof("Merged %d new entries from '%s'", merged.Merge(c), in)
+		}
+
+		check(merged.Export(*out))
+		infof("Wrote merged cache to '%s'", *out)
+	}
+}
+
+// cacheCompact defines the flags of 'cache compact' on fs and returns its function,
+// which rewrites a disk cache with only its live entries, dropping the records
+// superseded by later refetches and the tombstones of invalidated entries
+func cacheCompact(fs *flag.FlagSet) func(args []string) {
+	filename := fs.String("cache", "cache.txt", "Cache file")
+
+	return func(args []string) {
+		before, err := os.Stat(*filename)
+		check(err)
+
+		// A run appending to the cache meanwhile would lose its entries
+		release := acquireLocks("fail", *filename, "")
+		defer release()
+
+		check(openCacheFile(*filename).Export(*filename))
+
+		after, err := os.Stat(*filename)
+		check(err)
+		infof("Compacted '%s' from %d to %d bytes", *filename, before.Size(), after.Size())
+	}
+}
+
+// cacheInvalidate defines the flags of 'cache invalidate' on fs and returns its
+// function, which tombstones the cached weather of an airport over a date range
+func cacheInvalidate(fs *flag.FlagSet) func(args []string) {
+	iata := fs.String("airport", "", "IATA code of the airport to invalidate")
+	from := fs.String("from", "", "First date (YYYY-MM-DD, airport local time) or RFC3339 time to invalidate")
+	to := fs.String("to", "", "Last date (YYYY-MM-DD, airport local time) or RFC3339 time to invalidate")
+	fs.StringVar(stations, "stations", "", "Optional: CSV of airport,station,latitude,longitude mapping airports to preferred weather stations, as for processing")
+	fs.StringVar(lockPolicy, "lock", "fail", "When another run holds the cache: 'wait' or 'fail'")
+	opts := cacheFlags(fs)
+
+	return func(args []string) {
+		if *lockPolicy == "readonly" {
+			fatalf("Invalidating needs to write to the cache, use -lock=wait or -lock=fail")
+		}
+		if *iata == "" || *from == "" || *to == "" {
+			fmt.Fprintln(os.Stderr, "Usage: flightsense cache invalidate -airport ORD -from 2017-01-01 -to 2017-01-31")
+			fs.PrintDefaults()
+			os.Exit(2)
+		}
+
+		a, err := airports.LookupIATA(*iata)
+		check(err)
+		location, err := time.LoadLocation(a.Tz)
+		check(err)
+
+		start, err := parseBound(*from, location, false)
+		check(err)
+		end, err := parseBound(*to, location, true)
+		check(err)
+
+		// A mapped airport's entries are keyed by its station
+		if *stations != "" {
+			err = weather.LoadStations(*stations)
+			check(err)
+		}
+
+		// A run appending to the cache meanwhile would interleave its entries with the
+		// tombstones
+		release := acquireLocks(*lockPolicy, opts.path(), "")
+		defer release()
+
+		closeCache := opts.load()
+		defer closeCache()
+
+		n, err := weather.Invalidate(a.IATA, start, end)
+		check(err)
+		infof("Invalidated %d hours of weather for %s between %s and %s", n, a.IATA, start, end)
+	}
+}
+
+type airportCoverage struct {
+	entries int
+	first   time.Time
+	last    time.Time
+	days    map[string]bool
+}
+
+// cacheStats defines the flags of 'cache stats' on fs and returns its function,
+// which reports the size and coverage of a disk cache
+func cacheStats(fs *flag.FlagSet) func(args []string) {
+	filename := fs.String("cache", "cache.txt", "Cache file")
+
+	return func(args []string) {
+		c := openCacheFile(*filename)
+		info, err := os.Stat(*filename)
+		check(err)
+
+		var (
+			entries, legacy int
+			live            int64
+			coverage        = make(map[string]*airportCoverage)
+		)
+
+		c.Range(func(k string, v interface{}) bool {
+			entries++
+			if s, err := cachemap.Encode(v); err == nil {
+				live += int64(len(k) + len(s) + 2)
+			}
+
+			iata, t, ok := weather.ParseKey(k)
+			if !ok {
+				legacy++
+				return true
+			}
+
+			a, ok := coverage[iata]
+			if !ok {
+				a = &airportCoverage{first: t, last: t, days: make(map[string]bool)}
+				coverage[iata] = a
+			}
+			a.entries++
+			if t.Before(a.first) {
+				a.first = t
+			}
+			if t.After(a.last) {
+				a.last = t
+			}
+			a.days[t.In(airportLocation(iata)).Format("2006-01-02")] = true
+
+			return true
+		})
+
+		compressed, err := gzipSize(*filename)
+		check(err)
+
+		fmt.Printf("Entries:            %d\n", entries)
+		fmt.Printf("Legacy hashed keys: %d\n", legacy)
+		fmt.Printf("Distinct airports:  %d\n", len(coverage))
+		fmt.Printf("On-disk size:       %d bytes (%d bytes live)\n", info.Size(), live)
+		if compressed > 0 {
+			fmt.Printf("Compression ratio:  %.2f (gzip)\n", float64(info.Size())/float64(compressed))
+		}
+
+		if len(coverage) == 0 {
+			return
+		}
+
+		iatas := make([]string, 0, len(coverage))
+		for iata := range coverage {
+			iatas = append(iatas, iata)
+		}
+		sort.Strings(iatas)
+
+		fmt.Printf("\n%-8s %8s %6s %-12s %-12s\n", "airport", "hours", "days", "first", "last")
+		for _, iata := range iatas {
+			a := coverage[iata]
+			loc := airportLocation(iata)
+			fmt.Printf("%-8s %8d %6d %-12s %-12s\n", iata, a.entries, len(a.days),
+				a.first.In(loc).Format("2006-01-02"), a.last.In(loc).Format("2006-01-02"))
+		}
+	}
+}
+
+// cacheGet defines the flags of 'cache get' on fs and returns its function, which
+// prints the cached value stored under a key
+func cacheGet(fs *flag.FlagSet) func(args []string) {
+	filename := fs.String("cache", "cache.txt", "Cache file")
+
+	return func(args []string) {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: flightsense cache get KEY")
+			os.Exit(2)
+		}
+
+		v, err := openCacheFile(*filename).Get(args[0])
+		check(err)
+
+		b, err := json.Marshal(v)
+		check(err)
+		fmt.Println(string(b))
+	}
+}
+
+// cacheDump defines the flags of 'cache dump' on fs and returns its function, which
+// prints every cached hour of an airport's weather on a given local date
+func cacheDump(fs *flag.FlagSet) func(args []string) {
+	iata := fs.String("airport", "", "IATA code of the airport to dump")
+	date := fs.String("date", "", "Date to dump (YYYY-MM-DD, airport local time)")
+	filename := fs.String("cache", "cache.txt", "Cache file")
+	fs.StringVar(stations, "stations", "", "Optional: CSV of airport,station,latitude,longitude mapping airports to preferred weather stations, as for processing")
+
+	return func(args []string) {
+		if *iata == "" || *date == "" {
+			fmt.Fprintln(os.Stderr, "Usage: flightsense cache dump -airport JFK -date 2017-01-01")
+			fs.PrintDefaults()
+			os.Exit(2)
+		}
+
+		day, err := time.ParseInLocation("2006-01-02", *date, airportLocation(*iata))
+		check(err)
+
+		// A mapped airport's entries are keyed by its station
+		if *stations != "" {
+			err = weather.LoadStations(*stations)
+			check(err)
+		}
+
+		c := openCacheFile(*filename)
+		for t := day; t.Before(day.AddDate(0, 0, 1)); t = t.Add(time.Hour) {
+			k := weather.Key(*iata, t)
+			out := "(not cached)"
+			if v, err := c.Get(k); err == nil {
+				b, err := json.Marshal(v)
+				check(err)
+				out = string(b)
+			}
+			fmt.Printf("%s %s %s\n", t.Format(time.RFC3339), k, out)
+		}
+	}
+}
+
+// openCacheFile loads an existing disk cache without changing it, failing if it does
+// not exist. Runs writing to the cache may hold its lock meanwhile.
+func openCacheFile(filename string) *cachemap.Map {
+	c, err := cachemap.OpenReadOnly(filename)
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	return c
+}
+
+// airportLocation returns the time zone of an airport, or UTC if it is unknown
+func airportLocation(iata string) *time.Location {
+	a, err := airports.LookupIATA(iata)
+	if err != nil {
+		return time.UTC
+	}
+
+	location, err := loadLocation(a.Tz)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+// gzipSize returns the size of a file after gzip compression
+func gzipSize(filename string) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n countingWriter
+	w := gzip.NewWriter(&n)
+	if _, err := io.Copy(w, f); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	return int64(n), nil
+}
+
+// countingWriter discards its input, counting the bytes written
+type countingWriter int64
+
+func (n *countingWriter) Write(p []byte) (int, error) {
+	*n += countingWriter(len(p))
+	return len(p), nil
+}
+
+// parseBound parses a date or RFC3339 time; whole dates cover the entire day when end is set
+func parseBound(s string, location *time.Location, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, location)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leonm1/flightsense-go/cache"
+	"github.com/leonm1/flightsense-go/remote"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// cacheOptions selects and configures the weather cache backend
+type cacheOptions struct {
+	backend string
+	addr    string
+	file    string
+	dir     string
+	shard   string
+	mode    string
+	flush   time.Duration
+}
+
+// cacheFlags registers the weather cache flags on fs
+func cacheFlags(fs *flag.FlagSet) *cacheOptions {
+	o := &cacheOptions{}
+
+	fs.StringVar(&o.backend, "cache-backend", "file", "Weather cache backend: 'file', 'gzip', 'bolt', 'sqlite', 'sharded' or 'redis'")
+	fs.StringVar(&o.addr, "cache-addr", "localhost:6379", "Address of the redis server when -cache-backend=redis")
+	fs.StringVar(&o.file, "cache", "cache.txt", "Cache file when -cache-backend is file, gzip, bolt or sqlite; s3:// and gs:// URLs are downloaded at startup and uploaded when the run ends")
+	fs.StringVar(&o.dir, "cache-dir", "cache", "Directory of cache shards when -cache-backend=sharded")
+	fs.StringVar(&o.shard, "cache-shard", "airport", "Split a sharded cache into one file per 'airport' or 'month'")
+	fs.StringVar(&o.mode, "cache-mode", "normal", "Cache policy: 'normal' (read-through), 'read-only' (never write) or 'refresh' (ignore and overwrite existing entries)")
+
+	fs.DurationVar(&o.flush, "cache-flush-interval", time.Minute, "How often caches which buffer writes (gzip, bolt) are flushed to disk; 0 flushes only when the run ends")
+
+	return o
+}
+
+// path returns the file or directory holding the cache on this machine, if any
+func (o *cacheOptions) path() string {
+	switch o.backend {
+	case "file":
+		if remote.IsURL(o.file) {
+			return ""
+		}
+		return o.file
+	case "gzip", "bolt", "sqlite":
+		return o.file
+	case "sharded":
+		return o.dir
+	}
+
+	return ""
+}
+
+// load sets up the weather cache backend and returns a function releasing it
+func (o *cacheOptions) load() func() {
+	release := o.open()
+
+	if o.flush > 0 {
+		go flushEvery(o.flush)
+	}
+
+	return release
+}
+
+// flushEvery periodically flushes buffered cache writes, limiting what an abrupt
+// exit can lose
+func flushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := cachemap.Flush(); err != nil {
+			warnf("Error flushing cache: %s", err)
+		}
+	}
+}
+
+// open sets up the weather cache backend and returns a function releasing it
+func (o *cacheOptions) open() func() {
+	switch o.mode {
+	case "normal":
+	case "read-only":
+		cachemap.SetReadOnly(true)
+	case "refresh":
+		cachemap.SetRefresh(true)
+	default:
+		fatalf("Unknown cache mode '%s'", o.mode)
+	}
+
+	switch o.backend {
+	case "file":
+		if remote.IsURL(o.file) {
+			return o.loadRemote()
+		}
+
+		err := cachemap.Load(o.file)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return func() { cachemap.Close() }
+	case "gzip":
+		g, err := cachemap.OpenGzip(o.file)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return use(g)
+	case "bolt":
+		// Read-only runs share the database with the run holding the cache
+		b, err := cachemap.OpenBolt(o.file, cachemap.ReadOnly())
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return use(b)
+	case "sqlite":
+		// Read-only runs neither create the database nor its table
+		s, err := cachemap.OpenSQLite(o.file, cachemap.ReadOnly())
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return use(s)
+	case "sharded":
+		shard := weather.ShardByAirport
+		switch o.shard {
+		case "airport":
+		case "month":
+			shard = weather.ShardByMonth
+		default:
+			fatalf("Unknown cache shard '%s'", o.shard)
+		}
+
+		s, err := cachemap.NewSharded(o.dir, shard)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return use(s)
+	case "redis":
+		r, err := cachemap.NewRedis(o.addr)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return use(r)
+	default:
+		fatalf("Unknown cache backend '%s'", o.backend)
+	}
+
+	return nil
+}
+
+// use directs the weather cache to s and returns a function closing it
+func use(s cachemap.Store) func() {
+	cachemap.Use(s)
+
+	return func() {
+		if err := s.Close(); err != nil {
+			warnf("Error closing cache: %s", err)
+		}
+	}
+}
+
+// loadRemote downloads a cache from object storage into a local working copy and
+// returns a function closing the cache and uploading the updated copy, unless the
+// cache is read-only
+func (o *cacheOptions) loadRemote() func() {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("flightsense-cache-%d.txt", os.Getpid()))
+
+	infof("Downloading cache from '%s'", o.file)
+	err := remote.Download(o.file, local)
+	if err == remote.ErrNotExist {
+		infof("Remote cache '%s' does not exist yet, starting with an empty cache", o.file)
+	} else if err != nil {
+		fatalf("Cannot download cache '%s': %s", o.file, err)
+	}
+
+	err = cachemap.Load(local)
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	return func() {
+		// The working copy is complete once the cache has flushed and closed it
+		if err := cachemap.Close(); err != nil {
+			warnf("Error closing cache: %s", err)
+			return
+		}
+
+		// A read-only run leaves the remote cache as it was
+		if o.mode == "read-only" {
+			os.Remove(local)
+			return
+		}
+
+		infof("Uploading cache to '%s'", o.file)
+		if err := remote.Upload(local, o.file); err != nil {
+			warnf("Cannot upload cache '%s': %s", o.file, err)
+			return
+		}
+		os.Remove(local)
+	}
+}
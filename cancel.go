@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// runCtx is canceled by a fatal error in one of the goroutines processing the inputs,
+// or by an interrupt, with the error as its cause. The stages then stop taking rows
+// and the output written so far is closed cleanly, and resumable with -resume.
+var runCtx, cancelRun = context.WithCancelCause(context.Background())
+
+// fail logs an error the run cannot continue past and cancels it. Errors after the
+// first are usually caused by it, so are only logged at debug.
+func fail(format string, v ...interface{}) {
+	err := fmt.Errorf(format, v...)
+	if runCtx.Err() == nil {
+		logf(slog.LevelError, "%s", err)
+	} else {
+		debugf("%s", err)
+	}
+	cancelRun(err)
+}
+
+// canceled reports whether the run was canceled
+func canceled() bool {
+	return runCtx.Err() != nil
+}
+
+// signalError cancels a run which was interrupted or terminated
+type signalError struct {
+	sig os.Signal
+}
+
+func (e signalError) Error() string {
+	return fmt.Sprintf("Received %s", e.sig)
+}
+
+// interrupted reports whether the run was canceled by a signal rather than an error
+func interrupted() bool {
+	var sig signalError
+	return errors.As(context.Cause(runCtx), &sig)
+}
+
+// stopped exits a canceled run through its cleanup, noting how to continue it
+func stopped(shutdown func()) {
+	if run != nil {
+		infof("Stopped before finishing, run again with -resume to continue")
+	}
+	shutdown()
+	os.Exit(exitFatal)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// utf8BOM is the byte order mark some exports start with
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// inputEncoding is the character encoding of the inputs, or nil for UTF-8
+var inputEncoding encoding.Encoding
+
+// setEncoding sets the character encoding of the inputs from its name, e.g.
+// 'latin1' or 'windows-1252'
+func setEncoding(name string) error {
+	e, err := htmlindex.Get(strings.ToLower(name))
+	if err != nil {
+		return fmt.Errorf("Unknown encoding '%s'", name)
+	}
+
+	if e == unicode.UTF8 {
+		inputEncoding = nil
+	} else {
+		inputEncoding = e
+	}
+
+	return nil
+}
+
+// decodeInput transcodes an input to UTF-8, dropping any byte order mark
+func decodeInput(r io.Reader) io.Reader {
+	if inputEncoding != nil {
+		r = inputEncoding.NewDecoder().Reader(r)
+	}
+
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+
+	return br
+}
+
+// byteLines reports whether lines of the inputs end in a '\n' byte, as in UTF-8 and
+// the single and multibyte encodings, rather than a pair of bytes as in UTF-16
+func byteLines() bool {
+	if inputEncoding == nil {
+		return true
+	}
+	name, _ := htmlindex.Name(inputEncoding)
+
+	return !strings.HasPrefix(name, "utf-16")
+}
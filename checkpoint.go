@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Rows written between checkpoints
+const checkpointRows = 1000
+
+// checkpointName is the name of the checkpoint file in the output directory
+const checkpointName = ".flightsense-checkpoint.json"
+
+// checkpoint records how far a run got through each of its inputs, so an
+// interrupted run can be resumed with -resume
+type checkpoint struct {
+	Inputs map[string]*inputCheckpoint `json:"inputs"`
+
+	mu       sync.Mutex
+	filename string
+}
+
+// inputCheckpoint is the progress through an input file
+type inputCheckpoint struct {
+	// Input rows, after -offset and -sample, whose output is fully written or which
+	// produced none
+	Rows int `json:"rows"`
+
+	// Whether every row of the input has been processed
+	Done bool `json:"done"`
+
+	// Sizes of the output files once those rows were written. Anything after is
+	// discarded on resuming, as it may hold later rows which were only partly written.
+	Outputs map[string]int64 `json:"outputs"`
+}
+
+// checkpointFile returns the name of the checkpoint file in the output directory dir
+func checkpointFile(dir string) string {
+	return paths.join(dir, checkpointName)
+}
+
+// run is the checkpoint of the run, or nil when it isn't resumable
+var run *checkpoint
+
+// loadCheckpoint reads the checkpoint file of an earlier run from dir, starting
+// a new one if there is none
+func loadCheckpoint(dir string) error {
+	run = &checkpoint{Inputs: make(map[string]*inputCheckpoint), filename: checkpointFile(dir)}
+
+	b, err := os.ReadFile(run.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, run); err != nil {
+		return fmt.Errorf("Cannot parse checkpoint '%s': %s", run.filename, err)
+	}
+
+	return nil
+}
+
+// input returns the progress through an input file, discarding any output written
+// after the last checkpoint
+func (c *checkpoint) input(in string) (*inputCheckpoint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp, ok := c.Inputs[in]
+	if !ok {
+		cp = &inputCheckpoint{Outputs: make(map[string]int64)}
+		c.Inputs[in] = cp
+		return cp, nil
+	}
+
+	if cp.Done {
+		return cp, nil
+	}
+
+	for name, size := range cp.Outputs {
+		if err := os.Truncate(name, size); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	infof("Resuming %s after %d rows", in, cp.Rows)
+
+	return cp, nil
+}
+
+// save writes the checkpoint file, replacing the previous one in a single step
+func (c *checkpoint) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.filename)
+}
+
+// opened records the size of an output file before an input's rows are written to it
+func (c *checkpoint) opened(cp *inputCheckpoint, name string) {
+	c.mu.Lock()
+	if _, ok := cp.Outputs[name]; !ok {
+		var size int64
+		if st, err := os.Stat(name); err == nil {
+			size = st.Size()
+		}
+		cp.Outputs[name] = size
+	}
+	c.mu.Unlock()
+
+	if err := c.save(); err != nil {
+		warnf("Cannot save checkpoint '%s': %s", c.filename, err)
+	}
+}
+
+// update records the progress through an input and saves the checkpoint file
+func (c *checkpoint) update(cp *inputCheckpoint, rows int, done bool, files map[string]*outputFile) {
+	c.mu.Lock()
+	cp.Rows, cp.Done = rows, done
+	for _, o := range files {
+		if st, err := os.Stat(o.name); err == nil {
+			cp.Outputs[o.name] = st.Size()
+		}
+	}
+	c.mu.Unlock()
+
+	if err := c.save(); err != nil {
+		warnf("Cannot save checkpoint '%s': %s", c.filename, err)
+	}
+}
+
+// remove deletes the checkpoint file once the run is complete
+func (c *checkpoint) remove() {
+	if err := os.Remove(c.filename); err != nil && !os.IsNotExist(err) {
+		warnf("Cannot remove checkpoint '%s': %s", c.filename, err)
+	}
+}
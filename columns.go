@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// column is an output column and how its value is taken from a Flight
+type column struct {
+	output.Column
+	value func(f *Flight) interface{}
+
+	// Output schema version the column was added in
+	since int
+}
+
+// Output schema versions. Version 1 is the legacy 19 column CSV; version 2, the
+// FlightV2 schema, adds every column since.
+const (
+	legacySchema = 1
+	latestSchema = 2
+)
+
+// schemaVersion is the output schema version of the run
+var schemaVersion = legacySchema
+
+// columns lists every available output column in the default order, as defined
+// by the out tags of Flight
+var columns = schemaColumns(legacySchema)
+
+var (
+	// Columns written to the output, in order
+	selected = columns
+
+	// header describes the selected columns
+	header = outputColumns(columns)
+)
+
+// selectColumns chooses the output columns from a comma separated list of names.
+// An empty list selects every column.
+func selectColumns(list string) error {
+	if strings.TrimSpace(list) == "" {
+		selected, header = columns, outputColumns(columns)
+		return nil
+	}
+
+	var sel []column
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return fmt.Errorf("Column '%s' is selected twice", name)
+		}
+
+		c, ok := findColumn(name)
+		if !ok && newerColumn(name) {
+			return fmt.Errorf("Column '%s' needs -schema-version %d", name, latestSchema)
+		}
+		if !ok {
+			return fmt.Errorf("Unknown column '%s' (available: %s)", name, strings.Join(columnNames(columns), ", "))
+		}
+		sel = append(sel, c)
+		seen[name] = true
+	}
+
+	selected, header = sel, outputColumns(sel)
+
+	return nil
+}
+
+// setSchemaVersion makes the columns of an output schema version available
+func setSchemaVersion(v int) error {
+	if v < legacySchema || v > latestSchema {
+		return fmt.Errorf("Unknown schema version %d, expected %d to %d", v, legacySchema, latestSchema)
+	}
+
+	schemaVersion = v
+	columns = schemaColumns(v)
+	selected, header = columns, outputColumns(columns)
+
+	return nil
+}
+
+// schemaName is the record name of the output schema version in generated schemas
+func schemaName() string {
+	if schemaVersion == legacySchema {
+		return "Flight"
+	}
+
+	return fmt.Sprintf("FlightV%d", schemaVersion)
+}
+
+// schemaColumns returns the columns of an output schema version
+func schemaColumns(v int) []column {
+	var cols []column
+	for _, c := range flightColumns() {
+		if c.since <= v {
+			cols = append(cols, c)
+		}
+	}
+
+	return cols
+}
+
+// newerColumn reports whether a column is only in a later schema version than the run's
+func newerColumn(name string) bool {
+	for _, c := range flightColumns() {
+		if c.Name == name {
+			return c.since > schemaVersion
+		}
+	}
+
+	return false
+}
+
+// removeColumn makes a column unavailable, removing it from the default selection
+func removeColumn(name string) {
+	for i, c := range columns {
+		if c.Name == name {
+			columns = append(columns[:i:i], columns[i+1:]...)
+			break
+		}
+	}
+
+	selected, header = columns, outputColumns(columns)
+}
+
+func findColumn(name string) (column, bool) {
+	for _, c := range columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return column{}, false
+}
+
+func outputColumns(cols []column) []output.Column {
+	out := make([]output.Column, len(cols))
+	for i, c := range cols {
+		out[i] = c.Column
+	}
+
+	return out
+}
+
+func columnNames(cols []column) []string {
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name
+	}
+
+	return names
+}
+
+// conversion derives a column value from a Flight field
+type conversion struct {
+	typ   output.Type
+	value func(v reflect.Value) interface{}
+}
+
+// conversions available in out tags
+var conversions = map[string]conversion{
+	"date":        {output.String, func(v reflect.Value) interface{} { return v.Interface().(time.Time).Format("2006-01-02") }},
+	"year":        {output.Int, func(v reflect.Value) interface{} { return v.Interface().(time.Time).Year() }},
+	"month":       {output.String, func(v reflect.Value) interface{} { return v.Interface().(time.Time).Month().String() }},
+	"day":         {output.Int, func(v reflect.Value) interface{} { return v.Interface().(time.Time).Day() }},
+	"hhmm":        {output.String, func(v reflect.Value) interface{} { return hhmm(v.Interface().(time.Time)) }},
+	"lst":         {output.String, func(v reflect.Value) interface{} { return hhmm(standardTime(v.Interface().(time.Time))) }},
+	"utc":         {output.Time, func(v reflect.Value) interface{} { return utc(v.Interface().(time.Time)) }},
+	"weekday":     {output.String, func(v reflect.Value) interface{} { return v.Interface().(time.Time).Weekday().String() }},
+	"weekend":     {output.Bool, func(v reflect.Value) interface{} { return isWeekend(v.Interface().(time.Time)) }},
+	"holiday":     {output.Bool, func(v reflect.Value) interface{} { return daysToHoliday(v.Interface().(time.Time)) == 0 }},
+	"holidaydays": {output.Int, func(v reflect.Value) interface{} { return daysToHoliday(v.Interface().(time.Time)) }},
+	"hourbucket":  {output.String, func(v reflect.Value) interface{} { return hourBucket(v.Interface().(time.Time)) }},
+	"name":        {output.String, func(v reflect.Value) interface{} { return v.FieldByName("Name").String() }},
+	"iata":        {output.String, func(v reflect.Value) interface{} { return v.FieldByName("IATA").String() }},
+}
+
+// flightColumns builds the output columns from the out tags of Flight. It panics
+// on malformed tags, which are a programming error.
+func flightColumns() []column {
+	var cols []column
+	t := reflect.TypeOf(Flight{})
+
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("out")
+		if !ok {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		c := column{Column: output.Column{Name: opts[0]}, since: legacySchema}
+		src := t.Field(i)
+		var conv *conversion
+
+		for _, opt := range opts[1:] {
+			switch {
+			case opt == "key":
+				c.Key = true
+			case strings.HasPrefix(opt, "unit="):
+				c.Unit = strings.TrimPrefix(opt, "unit=")
+			case strings.HasPrefix(opt, "since="):
+				v, err := strconv.Atoi(strings.TrimPrefix(opt, "since="))
+				if err != nil || v < legacySchema || v > latestSchema {
+					panic("flightsense: out tag of column " + c.Name + " has an unknown schema version " + opt)
+				}
+				c.since = v
+			case strings.HasPrefix(opt, "from="):
+				f, ok := t.FieldByName(strings.TrimPrefix(opt, "from="))
+				if !ok {
+					panic("flightsense: out tag of column " + c.Name + " refers to unknown field " + opt)
+				}
+				src = f
+			default:
+				cv, ok := conversions[opt]
+				if !ok {
+					panic("flightsense: unknown conversion " + opt + " in out tag of column " + c.Name)
+				}
+				conv = &cv
+			}
+		}
+
+		index := src.Index
+		if conv != nil {
+			c.Type = conv.typ
+			value := conv.value
+			c.value = func(f *Flight) interface{} { return value(reflect.ValueOf(f).Elem().FieldByIndex(index)) }
+		} else {
+			typ, ok := fieldType(src.Type)
+			if !ok {
+				panic("flightsense: column " + c.Name + " needs a conversion from " + src.Type.String())
+			}
+			c.Type = typ
+			c.value = func(f *Flight) interface{} { return reflect.ValueOf(f).Elem().FieldByIndex(index).Interface() }
+		}
+
+		cols = append(cols, c)
+	}
+
+	return cols
+}
+
+// fieldType returns the output type of fields written without a conversion
+func fieldType(t reflect.Type) (output.Type, bool) {
+	switch t.Kind() {
+	case reflect.String:
+		return output.String, true
+	case reflect.Int:
+		return output.Int, true
+	case reflect.Float64:
+		return output.Float, true
+	case reflect.Bool:
+		return output.Bool, true
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return output.Time, true
+	}
+
+	return 0, false
+}
+
+// utc returns t in UTC, or nil for the zero time of a departure which never
+// happened, so typed outputs hold null rather than the year 1
+func utc(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t.UTC()
+}
+
+// hhmm formats the time of day of t as HHMM
+func hhmm(t time.Time) string {
+	return fmt.Sprintf("%02d%02d", t.Hour(), t.Minute())
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// command is a flightsense subcommand, listed in the usage
+type command struct {
+	name    string
+	summary string
+}
+
+// commands lists the subcommands in the order they are shown
+var commands = []command{
+	{"process", "Enrich flight records with weather and write them out (the default)"},
+	{"prefetch", "Fetch the weather input files need into the cache without writing output"},
+	{"validate", "Check input files can be processed and estimate their weather provider calls"},
+	{"fetch", "Download BTS on-time performance data by month"},
+	{"demo", "Process a bundled sample with canned weather, offline and without an API key"},
+	{"cache", "Maintain the weather cache: merge, compact, invalidate, stats, get, dump"},
+	{"serve", "Serve the weather at airports and enriched flights over HTTP"},
+	{"schema", "Print the schema of the enriched records"},
+	{"diff", "Compare two output files"},
+	{"verify", "Check output files against their manifest"},
+	{"completion", "Print a bash, zsh or fish completion script"},
+	{"help", "Show this help"},
+}
+
+// example is a command line shown in the usage, with what it does
+type example struct {
+	summary string
+	command string
+}
+
+// examples are shown in the usage after the commands, starting with a quickstart
+var examples = []example{
+	{"Quickstart: enrich the bundled sample into demo-out/ to check the installation", "flightsense demo"},
+	{"Download January 2017 from the BTS and enrich it into out/", "flightsense fetch -from 2017-01 -process -- -outdir out"},
+	{"Enrich every input file in data/ into out/, reading the API key from a file", "flightsense -indir data -outdir out -api-key-file key.txt"},
+	{"Enrich one file to standard output as JSON lines with the FlightV2 columns", "flightsense -in data/2017_01.csv -o - -format jsonl -schema-version 2"},
+	{"Estimate the weather provider calls of a file before processing it", "flightsense validate data/2017_01.csv"},
+	{"Fill the cache ahead of a run, e.g. overnight", "flightsense prefetch data/*.csv"},
+	{"Check a run's outputs against its manifest", "flightsense verify out/manifest.json"},
+	{"Enrich flights posted to http://localhost:8080/flights", "flightsense serve -addr :8080 -api-key-file key.txt"},
+	{"Enable completion in bash", "source <(flightsense completion bash)"},
+}
+
+// setup defines the flags of a command on fs and returns the function running it
+// with the arguments left once they are parsed
+type setup func(fs *flag.FlagSet) func(args []string)
+
+// newRootCommand returns the command line: processing with the flags given without a
+// command, and the commands listed in commands, each parsing its own flags. The
+// flags are defined with the flag package and parsed by cobra, which reads them with
+// two dashes, so main passes them through longFlags first. -h prints the usage of
+// each command in the single dash style.
+func newRootCommand() *cobra.Command {
+	// Commands are listed in the order of commands
+	cobra.EnableCommandSorting = false
+
+	// Processing's flags are those of flag.CommandLine, shared by the root command and
+	// process
+	process := func(*flag.FlagSet) func([]string) {
+		return func([]string) { runProcess() }
+	}
+	root := newCommand("flightsense [command] [flags]", "Enrich flight records with the weather at their airports", flag.CommandLine, process)
+	root.Args = cobra.NoArgs
+	root.CompletionOptions.DisableDefaultCmd = true
+
+	// Fetch and demo go on to process the arguments they return, which are parsed as
+	// the flags of process
+	var proc *cobra.Command
+	processArgs := func(args []string) {
+		if err := proc.ParseFlags(longFlags(root, args)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		if proc.Flags().NArg() > 0 {
+			fmt.Fprintf(os.Stderr, "Unexpected arguments for processing: %s\n", strings.Join(proc.Flags().Args(), " "))
+			os.Exit(exitUsage)
+		}
+		given(proc, flag.CommandLine)
+		runProcess()
+	}
+
+	setups := map[string]setup{
+		"process":  process,
+		"prefetch": prefetchCommand,
+		"validate": validateCommand,
+		"fetch": func(fs *flag.FlagSet) func([]string) {
+			fetch := fetchCommand(fs)
+			return func(args []string) {
+				// Processing the fetched files continues with the arguments returned
+				if args := fetch(args); args != nil {
+					processArgs(args)
+				}
+			}
+		},
+		"demo": func(fs *flag.FlagSet) func([]string) {
+			demo := demoCommand(fs)
+			return func(args []string) {
+				// The sample is processed with the arguments returned
+				processArgs(demo(args))
+			}
+		},
+		"cache":      cacheCommand,
+		"serve":      serveCommand,
+		"schema":     schemaCommand,
+		"diff":       diffCommand,
+		"verify":     verifyCommand,
+		"completion": completionCommand,
+		"help": func(*flag.FlagSet) func([]string) {
+			return func(args []string) { runHelp(root, args) }
+		},
+	}
+	cacheSetups := map[string]setup{
+		"merge":      cacheMerge,
+		"compact":    cacheCompact,
+		"invalidate": cacheInvalidate,
+		"stats":      cacheStats,
+		"get":        cacheGet,
+		"dump":       cacheDump,
+	}
+
+	// Every command's flags are defined up front, so the variables of processing's
+	// flags other commands define flags of their own for must keep the same defaults
+	for _, c := range commands {
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		if c.name == "process" {
+			fs = flag.CommandLine
+		}
+		cmd := newCommand(c.name, c.summary, fs, setups[c.name])
+
+		switch c.name {
+		case "process":
+			cmd.Args = cobra.NoArgs
+			proc = cmd
+		case "cache":
+			for _, name := range cacheCommands {
+				cmd.AddCommand(newCommand(name, "", flag.NewFlagSet("cache "+name, flag.ContinueOnError), cacheSetups[name]))
+			}
+		case "help":
+			root.SetHelpCommand(cmd)
+			continue
+		}
+		root.AddCommand(cmd)
+	}
+
+	return root
+}
+
+// newCommand returns a command whose setup defines its flags on fs, for cobra to
+// parse, and which prints the usage of fs for -h or flags it can't parse
+func newCommand(use string, short string, fs *flag.FlagSet, s setup) *cobra.Command {
+	run := s(fs)
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			given(cmd, fs)
+			run(args)
+		},
+	}
+	cmd.Flags().AddGoFlagSet(fs)
+	cmd.SetHelpFunc(func(*cobra.Command, []string) { printUsage(fs) })
+	cmd.SetUsageFunc(func(*cobra.Command) error {
+		printUsage(fs)
+		return nil
+	})
+
+	return cmd
+}
+
+// given sets the flags cmd parsed on fs too, which only holds their values, so the
+// config files of the commands having one skip the settings of flags given
+func given(cmd *cobra.Command, fs *flag.FlagSet) {
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if fs.Lookup(f.Name) != nil {
+			fs.Set(f.Name, f.Value.String())
+		}
+	})
+}
+
+// longFlags returns args with the flags of root and its commands given with one
+// dash, as the flag package reads them, given with the two cobra reads them with.
+// Arguments after -- are left as they are. A flag's value is never taken for a
+// command, so '-indir cache' processes the directory cache.
+func longFlags(root *cobra.Command, args []string) []string {
+	names := map[string]bool{"help": true}
+	var visit func(c *cobra.Command)
+	visit = func(c *cobra.Command) {
+		c.Flags().VisitAll(func(f *pflag.Flag) {
+			if len(f.Name) > 1 {
+				names[f.Name] = true
+			}
+		})
+		for _, sub := range c.Commands() {
+			visit(sub)
+		}
+	}
+	visit(root)
+
+	long := make([]string, len(args))
+	for i, a := range args {
+		if a == "--" {
+			copy(long[i:], args[i:])
+			break
+		}
+
+		name := strings.TrimPrefix(a, "-")
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name = name[:j]
+		}
+		if strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "--") && names[name] {
+			a = "-" + a
+		}
+		long[i] = a
+	}
+
+	return long
+}
+
+// printUsage prints the usage of fs, or its flags when it has no usage of its own
+func printUsage(fs *flag.FlagSet) {
+	if fs.Usage != nil {
+		fs.Usage()
+		return
+	}
+
+	fmt.Fprintf(fs.Output(), "Usage of flightsense %s:\n", fs.Name())
+	fs.PrintDefaults()
+}
+
+// usage prints the subcommands and examples, followed by the processing flags
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintln(w, "Usage: flightsense [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-11s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Examples:")
+	for _, e := range examples {
+		fmt.Fprintf(w, "  # %s\n  %s\n", e.summary, e.command)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'flightsense <command> -h' for the flags of a command. Flags of process:")
+	flag.PrintDefaults()
+}
+
+// runHelp prints the usage of the command named by args to standard output, or the
+// usage of flightsense without any
+func runHelp(root *cobra.Command, args []string) {
+	if len(args) > 0 {
+		cmd, _, err := root.Find(args)
+		if err != nil || cmd == root {
+			fatalf("Unknown command '%s'", strings.Join(args, " "))
+		}
+		cmd.Help()
+		return
+	}
+
+	flag.CommandLine.SetOutput(os.Stdout)
+	usage()
+}
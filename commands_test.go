@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Flags are given with one dash, and the value of a flag is never taken for a command
+func TestCommandLine(t *testing.T) {
+	root := newRootCommand()
+	indir, outdir, r := *inDir, *outDir, *recursive
+	t.Cleanup(func() { *inDir, *outDir, *recursive = indir, outdir, r })
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{"flag valued as a command", []string{"-indir", "cache", "-outdir", "out"}, "flightsense", nil},
+		{"flag with its value", []string{"-indir=cache", "-r"}, "flightsense", nil},
+		{"cache subcommand", []string{"cache", "stats", "-cache", "weather.txt"}, "stats", nil},
+		{"flags after arguments", []string{"validate", "2017_01.csv", "-sample", "100"}, "validate", []string{"2017_01.csv"}},
+		{"processing flags after --", []string{"demo", "-outdir", "demo", "--", "-quiet"}, "demo", []string{"-quiet"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args, err := root.Find(longFlags(root, tt.args))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Name() != tt.wantCmd {
+				t.Errorf("Command %q, want %q", cmd.Name(), tt.wantCmd)
+			}
+			if err := cmd.ParseFlags(args); err != nil {
+				t.Fatal(err)
+			}
+			if got := cmd.Flags().Args(); len(got) > 0 || len(tt.wantArgs) > 0 {
+				if !reflect.DeepEqual(got, tt.wantArgs) {
+					t.Errorf("Arguments %q, want %q", got, tt.wantArgs)
+				}
+			}
+		})
+	}
+
+	if *inDir != "cache" {
+		t.Errorf("-indir = %q, want %q", *inDir, "cache")
+	}
+}
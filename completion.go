@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completionShells are the shells 'completion' writes scripts for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionCommand defines the flags of completion on fs and returns its function,
+// which prints a script completing the commands, the flags of processing and the
+// cache subcommands in the named shell
+func completionCommand(fs *flag.FlagSet) func(args []string) {
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense completion bash|zsh|fish")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "  bash: source <(flightsense completion bash)")
+		fmt.Fprintln(os.Stderr, "  zsh:  flightsense completion zsh > \"${fpath[1]}/_flightsense\"")
+		fmt.Fprintln(os.Stderr, "  fish: flightsense completion fish > ~/.config/fish/completions/flightsense.fish")
+	}
+
+	return func(args []string) {
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+
+		flags := completionFlags(flag.CommandLine)
+
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(os.Stdout, flags)
+		case "zsh":
+			writeZshCompletion(os.Stdout, flags)
+		case "fish":
+			writeFishCompletion(os.Stdout, flags)
+		default:
+			fatalf("Unknown shell '%s', expected %s", args[0], strings.Join(completionShells, ", "))
+		}
+	}
+}
+
+// completionFlag is a flag offered for completion with a one line description
+type completionFlag struct {
+	name string
+	desc string
+}
+
+// completionFlags returns the flags of fs sorted by name, each described by the
+// first sentence of its usage
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		desc := strings.TrimPrefix(f.Usage, "Optional: ")
+		if i := strings.Index(desc, ". "); i >= 0 {
+			desc = desc[:i]
+		}
+		flags = append(flags, completionFlag{f.Name, strings.TrimSuffix(desc, ".")})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+
+	return flags
+}
+
+// commandNames returns the names of the subcommands
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+
+	return names
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = "-" + f.name
+	}
+
+	fmt.Fprintf(w, `# bash completion for flightsense
+_flightsense() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+
+	if [ "$COMP_CWORD" -eq 1 ] && [[ "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+
+	case "${COMP_WORDS[1]}" in
+	cache)
+		if [ "$COMP_CWORD" -eq 2 ]; then
+			COMPREPLY=($(compgen -W "%s" -- "$cur"))
+			return
+		fi
+		;;
+	completion)
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+		;;
+	process|-*)
+		if [[ "$cur" == -* ]]; then
+			COMPREPLY=($(compgen -W "%s" -- "$cur"))
+			return
+		fi
+		;;
+	esac
+
+	COMPREPLY=($(compgen -f -- "$cur"))
+}
+complete -o filenames -F _flightsense flightsense
+`, strings.Join(commandNames(), " "), strings.Join(cacheCommands, " "),
+		strings.Join(completionShells, " "), strings.Join(names, " "))
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	var cmds, opts []string
+	for _, c := range commands {
+		cmds = append(cmds, quote(c.name+":"+c.summary))
+	}
+	for _, f := range flags {
+		opts = append(opts, quote("-"+f.name+":"+f.desc))
+	}
+
+	fmt.Fprintf(w, `#compdef flightsense
+_flightsense() {
+	local -a commands flags
+	commands=(
+		%s
+	)
+	flags=(
+		%s
+	)
+
+	if (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then
+		_describe 'command' commands
+		return
+	fi
+
+	case $words[2] in
+	cache)
+		if (( CURRENT == 3 )); then
+			compadd %s
+			return
+		fi
+		;;
+	completion)
+		compadd %s
+		return
+		;;
+	process|-*)
+		if [[ $PREFIX == -* ]]; then
+			_describe 'flag' flags
+			return
+		fi
+		;;
+	esac
+
+	_files
+}
+_flightsense "$@"
+`, strings.Join(cmds, "\n\t\t"), strings.Join(opts, "\n\t\t"),
+		strings.Join(cacheCommands, " "), strings.Join(completionShells, " "))
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+
+	fmt.Fprintln(w, "# fish completion for flightsense")
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c flightsense -n __fish_use_subcommand -f -a %s -d %s\n", c.name, quote(c.summary))
+	}
+	fmt.Fprintf(w, "complete -c flightsense -n '__fish_seen_subcommand_from cache' -f -a %s\n", quote(strings.Join(cacheCommands, " ")))
+	fmt.Fprintf(w, "complete -c flightsense -n '__fish_seen_subcommand_from completion' -f -a %s\n", quote(strings.Join(completionShells, " ")))
+
+	// Processing is the default command, so its flags are offered without one too
+	for _, f := range flags {
+		fmt.Fprintf(w, "complete -c flightsense -n '__fish_use_subcommand; or __fish_seen_subcommand_from process' -o %s -d %s\n", f.name, quote(f.desc))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configName is the config file read from the working directory when -config isn't given
+const configName = "flightsense.yaml"
+
+// config is a YAML config file of flag values. Each section maps flag names, without
+// the leading dash, to their values, e.g.
+//
+//	input:
+//	  indir: data
+//	  encoding: latin1
+//	output:
+//	  outdir: out
+//	  format: parquet
+//	provider:
+//	  price: {darksky: 0.0001}
+//	filters:
+//	  filter-carrier: [DL, AA]
+//	columns: [absoluteTime, airline, delay]
+//
+// The sections only group the settings; a flag may be set in any of them. Lists are
+// joined with commas and maps written as comma separated key=value pairs.
+type config struct {
+	Input       map[string]interface{} `yaml:"input"`
+	Output      map[string]interface{} `yaml:"output"`
+	Provider    map[string]interface{} `yaml:"provider"`
+	Cache       map[string]interface{} `yaml:"cache"`
+	Concurrency map[string]interface{} `yaml:"concurrency"`
+	Filters     map[string]interface{} `yaml:"filters"`
+	Columns     interface{}            `yaml:"columns"`
+}
+
+// applyConfig sets the flags of fs which weren't given on the command line from a
+// config file, or from flightsense.yaml when filename is empty and it exists. When
+// strict, settings of flags fs doesn't have are an error; subcommands sharing the
+// config file with processing ignore them.
+func applyConfig(fs *flag.FlagSet, filename string, strict bool) error {
+	if filename == "" {
+		if _, err := os.Stat(configName); err != nil {
+			return nil
+		}
+		filename = configName
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var c config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return fmt.Errorf("Cannot parse config '%s': %s", filename, err)
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	settings := make(map[string]interface{})
+	for _, section := range []map[string]interface{}{c.Input, c.Output, c.Provider, c.Cache, c.Concurrency, c.Filters} {
+		for name, v := range section {
+			if _, ok := settings[name]; ok {
+				return fmt.Errorf("Config '%s' sets '%s' twice", filename, name)
+			}
+			settings[name] = v
+		}
+	}
+	if c.Columns != nil {
+		if _, ok := settings["columns"]; ok {
+			return fmt.Errorf("Config '%s' sets 'columns' twice", filename)
+		}
+		settings["columns"] = c.Columns
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	n := 0
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			if strict {
+				return fmt.Errorf("Config '%s' sets unknown flag '%s'", filename, name)
+			}
+			continue
+		}
+		if given[name] {
+			continue
+		}
+
+		if err := fs.Set(name, configValue(settings[name])); err != nil {
+			return fmt.Errorf("Invalid value of '%s' in config '%s': %s", name, filename, err)
+		}
+		n++
+	}
+	infof("Read %d settings from config '%s'", n, filename)
+
+	return nil
+}
+
+// configValue formats a YAML value as it would be given on the command line
+func configValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, x := range v {
+			s[i] = configValue(x)
+		}
+		return strings.Join(s, ",")
+	case map[interface{}]interface{}:
+		s := make([]string, 0, len(v))
+		for k, x := range v {
+			s = append(s, fmt.Sprintf("%v=%s", k, configValue(x)))
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// errDuplicate is the reason recorded for dropped duplicate rows
+var errDuplicate = errors.New("Duplicate of an earlier flight")
+
+// dedupe remembers the key of every flight in a run, across input files, so
+// flights in overlapping inputs are only written once
+type dedupe struct {
+	mu   sync.Mutex
+	keys []column
+	seen map[string]bool
+}
+
+// dedupeFlights is the run's dedupe stage, or nil if duplicates are kept
+var dedupeFlights *dedupe
+
+// newDedupe returns a dedupe stage keyed on the key columns of the latest schema
+// version, whether or not they are written
+func newDedupe() *dedupe {
+	var keys []column
+	for _, c := range schemaColumns(latestSchema) {
+		if c.Key {
+			keys = append(keys, c)
+		}
+	}
+
+	return &dedupe{keys: keys, seen: make(map[string]bool)}
+}
+
+// duplicate reports whether a flight with the same key was seen earlier in the run
+func (d *dedupe) duplicate(f *Flight) bool {
+	var b strings.Builder
+	for i, c := range d.keys {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		b.WriteString(output.Format(c.value(f)))
+	}
+	k := b.String()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen[k] {
+		return true
+	}
+	d.seen[k] = true
+
+	return false
+}
+
+// setupDedupe enables the dedupe stage for a -dedupe mode. Only flagging
+// duplicates adds the duplicate column to the output.
+func setupDedupe(mode string) error {
+	switch mode {
+	case "", "drop", "flag":
+	default:
+		return fmt.Errorf("Unknown dedupe mode '%s'", mode)
+	}
+
+	if mode != "" {
+		dedupeFlights = newDedupe()
+	}
+	if mode != "flag" {
+		removeColumn("duplicate")
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Twenty flights between eight airports in January 2017, in the legacy input columns
+//
+//go:embed demo/sample.csv
+var demoSample []byte
+
+// Canned weather for every airport and hour the sample flights need, in the cache
+// file format
+//
+//go:embed demo/weather-cache.txt
+var demoWeather []byte
+
+// demoEndpoint is the weather provider of the demo, which refuses connections so a
+// flight missing from the canned weather fails rather than reaching Dark Sky
+const demoEndpoint = "http://127.0.0.1:1/forecast/"
+
+// demoCommand defines the flags of demo on fs and returns its function, which writes
+// the sample input and canned weather to <outdir>/demo-input and returns the
+// arguments to process them offline, without an API key, followed by any arguments
+// after --
+func demoCommand(fs *flag.FlagSet) func(args []string) []string {
+	outdir := fs.String("outdir", "demo-out", "Directory to write the example output to")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense demo [-outdir demo-out] [-- processing flags]")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) []string {
+		input, weather, key := writeDemoInputs(filepath.Join(*outdir, "demo-input"))
+
+		return append(demoArgs(input, weather, key, *outdir), args...)
+	}
+}
+
+// writeDemoInputs writes the sample input, the canned weather and a placeholder API
+// key to dir and returns their paths
+func writeDemoInputs(dir string) (input string, weather string, key string) {
+	err := os.MkdirAll(dir, 0755)
+	check(err)
+
+	input = filepath.Join(dir, "sample.csv")
+	weather = filepath.Join(dir, "weather-cache.txt")
+	key = filepath.Join(dir, "api-key.txt")
+	err = os.WriteFile(input, demoSample, 0644)
+	check(err)
+	err = os.WriteFile(weather, demoWeather, 0644)
+	check(err)
+	err = os.WriteFile(key, []byte("demo\n"), 0600)
+	check(err)
+
+	return input, weather, key
+}
+
+// demoArgs returns the arguments processing input into outdir with only the canned
+// weather
+func demoArgs(input string, weather string, key string, outdir string) []string {
+	return []string{
+		"-in", input,
+		"-outdir", outdir,
+		"-cache", weather,
+		"-cache-backend", "file",
+		"-cache-mode", "read-only",
+		"-api-key-file", key,
+		"-endpoints", demoEndpoint,
+		"-ledger", "",
+		"-schema-version", "2",
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// Delimiters which can be given by name, as tabs and pipes are awkward to pass in a shell
+var delimiterNames = map[string]rune{
+	"comma":     ',',
+	"tab":       '\t',
+	"semicolon": ';',
+	"pipe":      '|',
+}
+
+// parseDelimiter returns the delimiter named by s, or the single character s
+func parseDelimiter(s string) (rune, error) {
+	if r, ok := delimiterNames[s]; ok {
+		return r, nil
+	}
+
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 || n != len(s) || r == utf8.RuneError {
+		return 0, fmt.Errorf("Delimiter must be a single character or one of comma, tab, semicolon or pipe, not '%s'", s)
+	}
+	if r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("Delimiter cannot be a quote or line break")
+	}
+
+	return r, nil
+}
+
+// inputComma is the field delimiter of CSV inputs, or 0 to sniff it from each input
+var inputComma rune
+
+// Delimiters which sniffing chooses between, preferring the earlier on a tie
+var sniffedDelimiters = []rune{',', '\t', '|', ';'}
+
+// sniffDelimiter picks the delimiter occurring most often outside quotes in the
+// first line of sample, defaulting to a comma
+func sniffDelimiter(sample []byte) rune {
+	if i := bytes.IndexByte(sample, '\n'); i >= 0 {
+		sample = sample[:i]
+	}
+
+	counts := make(map[rune]int)
+	quoted := false
+	for _, c := range string(sample) {
+		if c == '"' {
+			quoted = !quoted
+		} else if !quoted {
+			counts[c]++
+		}
+	}
+
+	best := ','
+	for _, d := range sniffedDelimiters {
+		if counts[d] > counts[best] {
+			best = d
+		}
+	}
+
+	return best
+}
+
+// headerReader reads the header of a CSV input, naming the columns of inputs
+// without one by position from -input-columns. Inputs whose first row holds a
+// date are taken to have no header, as column names never are dates.
+type headerReader struct {
+	r       rowReader
+	name    string
+	checked bool
+	first   []string
+}
+
+// Read returns the header on the first call, and then the rows of the input
+func (h *headerReader) Read() ([]string, error) {
+	if h.first != nil {
+		row := h.first
+		h.first = nil
+		return row, nil
+	}
+
+	row, err := h.r.Read()
+	if err != nil || h.checked {
+		return row, err
+	}
+	h.checked = true
+
+	if !*noHeader && !isDataRow(row) {
+		return row, nil
+	}
+	if !*noHeader {
+		infof("'%s' has no header, naming its columns from -input-columns", h.name)
+	}
+
+	// The first row is data, returned by the next call
+	h.first = append([]string(nil), row...)
+
+	return splitList(*inputColumns), nil
+}
+
+// isDataRow reports whether a row holds a YYYY-MM-DD date
+func isDataRow(row []string) bool {
+	for _, v := range row {
+		if _, err := time.Parse("2006-01-02", strings.TrimSpace(v)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseQuoting returns the CSV quoting style named by s
+func parseQuoting(s string) (output.Quoting, error) {
+	switch s {
+	case "minimal":
+		return output.QuoteMinimal, nil
+	case "all":
+		return output.QuoteAll, nil
+	case "none":
+		return output.QuoteNone, nil
+	}
+
+	return 0, fmt.Errorf("Unknown quoting '%s'", s)
+}
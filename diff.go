@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// Columns which together identify a flight across two output files
+var diffKey = []string{"absoluteTime", "airline", "originAirport", "destAirport", "scheduledDeparture"}
+
+type columnDiff struct {
+	differing int
+	numeric   int
+	sumAbs    float64
+	maxAbs    float64
+}
+
+// diffCommand defines the flags of diff on fs and returns its function, which compares
+// two enriched output files row-by-key and prints a summary of the columns that differ
+func diffCommand(fs *flag.FlagSet) func(args []string) {
+	fs.StringVar(delimiter, "delimiter", ",", "Field delimiter of the outputs, as for processing")
+	fs.StringVar(quoteStyle, "quote", "minimal", "Quoting of the outputs, as for processing")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense diff [-delimiter ,] [-quote minimal] out_a.csv out_b.csv")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) {
+		if len(args) != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		// The outputs are read in the dialect they were written in
+		comma, err := parseDelimiter(*delimiter)
+		check(err)
+		q, err := parseQuoting(*quoteStyle)
+		check(err)
+		output.SetCSVDialect(comma, q, false)
+
+		headA, rowsA := readKeyed(args[0])
+		headB, rowsB := readKeyed(args[1])
+
+		// Only columns present in both files can be compared
+		colsB := make(map[string]int)
+		for i, c := range headB {
+			colsB[c] = i
+		}
+
+		diffs := make(map[string]*columnDiff)
+		var onlyA, onlyB, matched, changed int
+
+		for k, a := range rowsA {
+			b, ok := rowsB[k]
+			if !ok {
+				onlyA++
+				continue
+			}
+			matched++
+
+			rowChanged := false
+			for i, c := range headA {
+				j, ok := colsB[c]
+				if !ok || a[i] == b[j] {
+					continue
+				}
+				rowChanged = true
+
+				d, ok := diffs[c]
+				if !ok {
+					d = &columnDiff{}
+					diffs[c] = d
+				}
+				d.differing++
+
+				// Record the magnitude of numeric differences
+				x, errA := strconv.ParseFloat(a[i], 64)
+				y, errB := strconv.ParseFloat(b[j], 64)
+				if errA == nil && errB == nil {
+					abs := math.Abs(x - y)
+					d.numeric++
+					d.sumAbs += abs
+					if abs > d.maxAbs {
+						d.maxAbs = abs
+					}
+				}
+			}
+
+			if rowChanged {
+				changed++
+			}
+		}
+
+		for k := range rowsB {
+			if _, ok := rowsA[k]; !ok {
+				onlyB++
+			}
+		}
+
+		fmt.Printf("Rows matched: %d (%d differ)\n", matched, changed)
+		fmt.Printf("Rows only in %s: %d\n", args[0], onlyA)
+		fmt.Printf("Rows only in %s: %d\n", args[1], onlyB)
+
+		if len(diffs) == 0 {
+			return
+		}
+
+		fmt.Printf("\n%-24s %10s %12s %12s\n", "column", "differing", "mean |diff|", "max |diff|")
+		for _, c := range headA {
+			d, ok := diffs[c]
+			if !ok {
+				continue
+			}
+
+			if d.numeric == 0 {
+				fmt.Printf("%-24s %10d %12s %12s\n", c, d.differing, "-", "-")
+			} else {
+				fmt.Printf("%-24s %10d %12.4f %12.4f\n", c, d.differing, d.sumAbs/float64(d.numeric), d.maxAbs)
+			}
+		}
+	}
+}
+
+// readKeyed loads an output file into a map keyed by flight identity
+func readKeyed(filename string) ([]string, map[string][]string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		fatalf("Cannot open '%s': %s\n", filename, err.Error())
+	}
+	defer f.Close()
+
+	r := output.NewCSVReader(f)
+	h, err := r.Read()
+	check(err)
+
+	idx := make([]int, len(diffKey))
+	for i, k := range diffKey {
+		idx[i] = -1
+		for j, c := range h {
+			if c == k {
+				idx[i] = j
+			}
+		}
+		if idx[i] < 0 {
+			fatalf("'%s' is missing key column '%s'", filename, k)
+		}
+	}
+
+	rows := make(map[string][]string)
+	seen := make(map[string]int)
+	key := make([]string, len(idx))
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalf("Cannot read '%s': %s", filename, err)
+		}
+
+		for i, j := range idx {
+			key[i] = row[j]
+		}
+		k := strings.Join(key, "|")
+
+		// Number repeated keys so duplicate flights still pair up in order
+		seen[k]++
+		if n := seen[k]; n > 1 {
+			k = fmt.Sprintf("%s|%d", k, n)
+		}
+		rows[k] = row
+	}
+
+	return h, rows
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// malformed counts the input rows of the run which could not be read or parsed
+var malformed int64
+
+// checkErrorMode checks that at most one of -strict, -lenient and -max-errors is set
+func checkErrorMode() error {
+	modes := 0
+	for _, set := range []bool{*strict, *lenient, *maxErrors > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("Only one of -strict, -lenient and -max-errors can be used")
+	}
+	if *maxErrors < 0 {
+		return fmt.Errorf("-max-errors cannot be negative")
+	}
+
+	return nil
+}
+
+// malformedRow counts a row of an input which could not be read or parsed, canceling
+// the run in -strict mode or once there are more than -max-errors
+func malformedRow(in string, err error) {
+	n := atomic.AddInt64(&malformed, 1)
+
+	if *strict {
+		fail("Aborting, '%s' has a malformed row: %s", in, err)
+	}
+	if *maxErrors > 0 && n > int64(*maxErrors) {
+		fail("Aborting after %d malformed rows, more than -max-errors allows. Last in '%s': %s", n, in, err)
+	}
+}
+
+// logMalformed reports the malformed rows skipped during the run
+func logMalformed() {
+	if n := atomic.LoadInt64(&malformed); n > 0 {
+		warnf("Skipped %d malformed rows", n)
+	}
+}
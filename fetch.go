@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// btsURL is the address of the monthly BTS on-time performance downloads, by year and month
+const btsURL = "https://transtats.bts.gov/PREZIP/On_Time_Reporting_Carrier_On_Time_Performance_1987_present_%d_%d.zip"
+
+// btsClient downloads from transtats, whose monthly zips are tens of megabytes
+var btsClient = &http.Client{Timeout: 10 * time.Minute}
+
+// fetchCommand defines the flags of fetch on fs and returns its function, which
+// downloads and unzips the BTS on-time performance data for a range of months. When
+// -process is set it returns the arguments to process the downloaded files with;
+// otherwise it returns nil.
+func fetchCommand(fs *flag.FlagSet) func(args []string) []string {
+	from := fs.String("from", "", "First month to download, as YYYY-MM")
+	to := fs.String("to", "", "Last month to download, as YYYY-MM (default -from)")
+	dir := fs.String("dir", "data", "Directory to save the CSV files to")
+	keepZip := fs.Bool("keep-zip", false, "Keep the downloaded zips beside the CSV files")
+	process := fs.Bool("process", false, "Process the downloaded months once fetched, passing any arguments after -- to processing")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense fetch -from 2019-01 [-to 2019-12] [-dir data] [-process [-- processing flags]]")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) []string {
+		if *from == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if *to == "" {
+			*to = *from
+		}
+
+		first, err := time.Parse("2006-01", *from)
+		if err != nil {
+			fatalf("Invalid -from month '%s'", *from)
+		}
+		last, err := time.Parse("2006-01", *to)
+		if err != nil {
+			fatalf("Invalid -to month '%s'", *to)
+		}
+		if last.Before(first) {
+			fatalf("-to is before -from")
+		}
+
+		err = os.MkdirAll(*dir, 0755)
+		check(err)
+
+		for m := first; !m.After(last); m = m.AddDate(0, 1, 0) {
+			if err := fetchMonth(*dir, m.Year(), int(m.Month()), *keepZip); err != nil {
+				fatalf("Cannot fetch %s: %s", m.Format("2006-01"), err)
+			}
+		}
+
+		if !*process {
+			return nil
+		}
+
+		return append([]string{"-indir", *dir}, args...)
+	}
+}
+
+// fetchMonth downloads the zip of a month's flights to dir, checks it and extracts
+// its CSV file. Months already extracted are skipped.
+func fetchMonth(dir string, year int, month int, keepZip bool) error {
+	url := fmt.Sprintf(btsURL, year, month)
+	zipName := filepath.Join(dir, filepath.Base(url))
+	csvName := strings.TrimSuffix(zipName, ".zip") + ".csv"
+
+	if _, err := os.Stat(csvName); err == nil {
+		infof("Skipping %d-%02d, '%s' already exists", year, month, csvName)
+		return nil
+	}
+
+	infof("Downloading %s", url)
+	if err := download(url, zipName); err != nil {
+		return err
+	}
+
+	// Reading the CSV to the end checks the zip's CRC
+	if err := extractCSV(zipName, csvName); err != nil {
+		os.Remove(zipName)
+		return fmt.Errorf("Download '%s' is corrupt: %s", zipName, err)
+	}
+	infof("Extracted '%s'", csvName)
+
+	if keepZip {
+		return nil
+	}
+
+	return os.Remove(zipName)
+}
+
+// download saves the body of a GET of url to filename, only creating filename once
+// the whole body has arrived
+func download(url string, filename string) error {
+	resp, err := btsClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	tmp := filename + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// extractCSV writes the CSV file in a BTS zip to filename
+func extractCSV(zipName string, filename string) error {
+	r, err := openZip(zipName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := filename + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		if err == zip.ErrChecksum {
+			return fmt.Errorf("checksum mismatch")
+		}
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// flightFilter keeps the flights matching every filter flag given
+type flightFilter struct {
+	carriers map[string]bool
+	origins  map[string]bool
+	dests    map[string]bool
+	routes   map[string]bool
+	from, to time.Time
+}
+
+// runFilter is the filter of the run, or nil when every flight is kept
+var runFilter *flightFilter
+
+// setupFilter parses the filter flags
+func setupFilter() error {
+	f := &flightFilter{
+		carriers: setOf(*filterCarrier),
+		origins:  setOf(*filterOrigin),
+		dests:    setOf(*filterDest),
+		routes:   setOf(*filterRoute),
+	}
+
+	for r := range f.routes {
+		if len(strings.Split(r, "-")) != 2 {
+			return fmt.Errorf("Route '%s' is not ORIGIN-DEST", r)
+		}
+	}
+
+	if *filterDate != "" {
+		bounds := strings.SplitN(*filterDate, ":", 2)
+		if len(bounds) != 2 {
+			return fmt.Errorf("Date range '%s' is not FROM:TO", *filterDate)
+		}
+
+		var err error
+		if bounds[0] != "" {
+			if f.from, err = time.Parse("2006-01-02", bounds[0]); err != nil {
+				return fmt.Errorf("Invalid date range start '%s'", bounds[0])
+			}
+		}
+		if bounds[1] != "" {
+			if f.to, err = time.Parse("2006-01-02", bounds[1]); err != nil {
+				return fmt.Errorf("Invalid date range end '%s'", bounds[1])
+			}
+		}
+	}
+
+	if f.carriers != nil || f.origins != nil || f.dests != nil || f.routes != nil || *filterDate != "" {
+		runFilter = f
+	}
+
+	return nil
+}
+
+// setOf returns the upper case items of a comma separated list, or nil if it is empty
+func setOf(list string) map[string]bool {
+	items := splitList(list)
+	if len(items) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[strings.ToUpper(item)] = true
+	}
+
+	return set
+}
+
+// keep reports whether a flight matches the filters. Dates are compared on the
+// flight's date, and both ends of the range are inclusive.
+func (f *flightFilter) keep(fl *Flight) bool {
+	if f.carriers != nil && !f.carriers[fl.Carrier.IATA] {
+		return false
+	}
+	if f.origins != nil && !f.origins[fl.Origin.IATA] {
+		return false
+	}
+	if f.dests != nil && !f.dests[fl.Destination.IATA] {
+		return false
+	}
+	if f.routes != nil && !f.routes[fl.Origin.IATA+"-"+fl.Destination.IATA] {
+		return false
+	}
+
+	if !f.from.IsZero() && fl.Date.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && fl.Date.After(f.to) {
+		return false
+	}
+
+	return true
+}
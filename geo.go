@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+
+	"github.com/leonm1/airports-go"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// Mean radius of the earth in statute miles
+const earthRadius = 3958.8
+
+// greatCircle returns the great-circle distance in miles between two airports, and
+// the initial bearing in degrees clockwise from true north to fly from a to b
+func greatCircle(a airports.Airport, b airports.Airport) (float64, float64) {
+	lat1, lon1 := radians(a.Latitude), radians(a.Longitude)
+	lat2, lon2 := radians(b.Latitude), radians(b.Longitude)
+	dlat, dlon := lat2-lat1, lon2-lon1
+
+	// Haversine formula
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	distance := 2 * earthRadius * math.Asin(math.Sqrt(h))
+
+	y := math.Sin(dlon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dlon)
+	bearing := math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+
+	return distance, bearing
+}
+
+// stationDistance returns the distance in miles from an airport to the weather
+// station its observations are requested for, which is 0 without a -stations mapping
+func stationDistance(a airports.Airport) float64 {
+	st, ok := weather.StationFor(a.IATA)
+	if !ok || isUnknown(a) {
+		return 0
+	}
+
+	d, _ := greatCircle(a, airports.Airport{Latitude: st.Latitude, Longitude: st.Longitude})
+	return d
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Holidays by year, computed on first use
+var (
+	holidaysMu sync.Mutex
+	holidays   = make(map[int][]time.Time)
+)
+
+// usHolidays returns the dates of the US federal holidays in a year, at midnight UTC.
+// Holidays are on their calendar dates rather than the weekdays they're observed on.
+func usHolidays(year int) []time.Time {
+	holidaysMu.Lock()
+	defer holidaysMu.Unlock()
+
+	if h, ok := holidays[year]; ok {
+		return h
+	}
+
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(year, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	h := []time.Time{
+		date(time.January, 1),
+		nthWeekday(year, time.January, time.Monday, 3),  // Martin Luther King Jr. Day
+		nthWeekday(year, time.February, time.Monday, 3), // Washington's Birthday
+		nthWeekday(year, time.May, time.Monday, -1),     // Memorial Day
+		date(time.July, 4),
+		nthWeekday(year, time.September, time.Monday, 1), // Labor Day
+		nthWeekday(year, time.October, time.Monday, 2),   // Columbus Day
+		date(time.November, 11),
+		nthWeekday(year, time.November, time.Thursday, 4), // Thanksgiving
+		date(time.December, 25),
+	}
+	if year >= 2021 {
+		h = append(h, date(time.June, 19))
+	}
+	holidays[year] = h
+
+	return h
+}
+
+// nthWeekday returns the nth weekday of a month, or the last when n is -1
+func nthWeekday(year int, m time.Month, wd time.Weekday, n int) time.Time {
+	if n < 0 {
+		last := time.Date(year, m+1, 0, 0, 0, 0, 0, time.UTC)
+		return last.AddDate(0, 0, -int((last.Weekday()-wd+7)%7))
+	}
+
+	first := time.Date(year, m, 1, 0, 0, 0, 0, time.UTC)
+	return first.AddDate(0, 0, int((wd-first.Weekday()+7)%7)+7*(n-1))
+}
+
+// daysToHoliday returns the number of days between the local date of t and the
+// nearest US federal holiday, before or after it
+func daysToHoliday(t time.Time) int {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	nearest := -1
+	for y := t.Year() - 1; y <= t.Year()+1; y++ {
+		for _, h := range usHolidays(y) {
+			d := int(h.Sub(day).Hours() / 24)
+			if d < 0 {
+				d = -d
+			}
+			if nearest < 0 || d < nearest {
+				nearest = d
+			}
+		}
+	}
+
+	return nearest
+}
+
+// isWeekend reports whether t falls on a Saturday or Sunday
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
+
+// hourBucket names the part of the day of a local departure time
+func hourBucket(t time.Time) string {
+	switch h := t.Hour(); {
+	case h < 5:
+		return "red-eye"
+	case h < 12:
+		return "morning"
+	case h < 17:
+		return "afternoon"
+	default:
+		return "evening"
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// stdin is the input name which reads flights from standard input
+const stdin = "-"
+
+// isInput reports whether a file in an input directory holds flights: a CSV or JSONL
+// file, either of them gzipped, or a BTS download zip
+func isInput(name string) bool {
+	name = strings.ToLower(name)
+
+	return strings.HasSuffix(name, ".csv") || strings.HasSuffix(name, ".csv.gz") || strings.HasSuffix(name, ".zip") || isJSONL(name)
+}
+
+// findInputs returns the paths below dir of the input files to process: the file
+// named name if it is set, or else every input file which matches one of the
+// include patterns, if any, and none of the exclude patterns. Subdirectories are
+// searched when recursive is set.
+func findInputs(dir string, name string, recursive bool, include []string, exclude []string) ([]string, error) {
+	for _, p := range append(append([]string(nil), include...), exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s': %s", p, err)
+		}
+	}
+
+	var inputs []string
+	err := filepath.Walk(dir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if f.IsDir() {
+			if p != dir && !recursive {
+				debugf("Skipping dir \"%s\"", p)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if name != "" {
+			if f.Name() == name {
+				inputs = append(inputs, rel)
+			}
+		} else if isInput(p) && (len(include) == 0 || matchAny(include, rel)) && !matchAny(exclude, rel) {
+			inputs = append(inputs, rel)
+		}
+
+		return nil
+	})
+
+	return inputs, err
+}
+
+// matchAny reports whether the path of an input relative to the input directory
+// matches any of the glob patterns. Patterns without a / match the file name.
+func matchAny(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+
+	for _, p := range patterns {
+		target := rel
+		if !strings.Contains(p, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// inputBase returns the name of an input file without its extensions, from which the
+// names of its output files are made
+func inputBase(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".gz") {
+		name = name[:len(name)-len(".gz")]
+	}
+
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// openInput opens an input file, decompressing gzipped files and streaming the CSV
+// file inside zips. Inputs given as URLs are streamed as they download.
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == stdin {
+		return openStdin()
+	}
+	if isURL(filename) {
+		return openURL(filename)
+	}
+
+	lower := strings.ToLower(filename)
+
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return openZip(filename)
+	case strings.HasSuffix(lower, ".gz"):
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Cannot decompress '%s': %s", filename, err)
+		}
+		return &closeBoth{z, f}, nil
+	}
+
+	return os.Open(filename)
+}
+
+// openStdin reads standard input, decompressing it if it starts with the gzip
+// magic number. Zips can't be streamed, as their directory is at the end.
+func openStdin() (io.ReadCloser, error) {
+	r := bufio.NewReader(os.Stdin)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decompress standard input: %s", err)
+		}
+		return z, nil
+	}
+
+	return io.NopCloser(r), nil
+}
+
+// openZip streams the CSV file in a zip. BTS downloads hold a single CSV file
+// beside a readme.
+func openZip(filename string) (io.ReadCloser, error) {
+	z, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var csvs []*zip.File
+	for _, f := range z.File {
+		if strings.HasSuffix(strings.ToLower(f.Name), ".csv") {
+			csvs = append(csvs, f)
+		}
+	}
+	if len(csvs) != 1 {
+		z.Close()
+		return nil, fmt.Errorf("'%s' holds %d CSV files, expected 1", filename, len(csvs))
+	}
+
+	r, err := csvs[0].Open()
+	if err != nil {
+		z.Close()
+		return nil, err
+	}
+
+	return &closeBoth{r, z}, nil
+}
+
+// closeBoth reads from a decompressing reader and closes it along with the file beneath
+type closeBoth struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+// Close closes the reader and then the file
+func (c *closeBoth) Close() error {
+	err := c.ReadCloser.Close()
+	if e := c.file.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// inputTree creates a directory of input files in nested directories, with a
+// directory whose name matches the input file patterns of the tests
+func inputTree(t *testing.T) string {
+	dir := t.TempDir()
+
+	for _, name := range []string{
+		"2017_01.csv",
+		"2017_02.csv.gz",
+		"2018_01.csv",
+		"notes.txt",
+		"2017_archive/2016_12.csv",
+		"nested/2017_03.csv",
+		"nested/deep/2017_04.zip",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestFindInputs(t *testing.T) {
+	dir := inputTree(t)
+
+	tests := []struct {
+		name      string
+		in        string
+		recursive bool
+		include   []string
+		exclude   []string
+		want      []string
+	}{
+		{"top level only", "", false, nil, nil,
+			[]string{"2017_01.csv", "2017_02.csv.gz", "2018_01.csv"}},
+		{"recursive", "", true, nil, nil,
+			[]string{"2017_01.csv", "2017_02.csv.gz", "2017_archive/2016_12.csv", "2018_01.csv", "nested/2017_03.csv", "nested/deep/2017_04.zip"}},
+		{"include file names at any depth", "", true, []string{"2017_*.csv"}, nil,
+			[]string{"2017_01.csv", "nested/2017_03.csv"}},
+		{"include without recursion", "", false, []string{"2017_*.csv"}, nil,
+			[]string{"2017_01.csv"}},
+		{"exclude", "", true, nil, []string{"*.zip", "2018_*"},
+			[]string{"2017_01.csv", "2017_02.csv.gz", "2017_archive/2016_12.csv", "nested/2017_03.csv"}},
+		{"include and exclude", "", true, []string{"2017_*"}, []string{"*.gz"},
+			[]string{"2017_01.csv", "nested/2017_03.csv", "nested/deep/2017_04.zip"}},
+		{"pattern matching a directory but no file", "", true, []string{"2017_archive"}, nil,
+			nil},
+		{"file name patterns don't match directories", "", true, []string{"2017_*"}, nil,
+			[]string{"2017_01.csv", "2017_02.csv.gz", "nested/2017_03.csv", "nested/deep/2017_04.zip"}},
+		{"patterns with a / match the path", "", true, []string{"nested/*"}, nil,
+			[]string{"nested/2017_03.csv"}},
+		{"exclude a path", "", true, nil, []string{"nested/*/*"},
+			[]string{"2017_01.csv", "2017_02.csv.gz", "2017_archive/2016_12.csv", "2018_01.csv", "nested/2017_03.csv"}},
+		{"named file", "2018_01.csv", false, nil, nil,
+			[]string{"2018_01.csv"}},
+		{"named file below the directory", "2017_03.csv", true, nil, nil,
+			[]string{"nested/2017_03.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findInputs(dir, tt.in, tt.recursive, tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want []string
+			for _, w := range tt.want {
+				want = append(want, filepath.FromSlash(w))
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("findInputs() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFindInputsInvalidPattern(t *testing.T) {
+	if _, err := findInputs(inputTree(t), "", true, []string{"2017_[01"}, nil); err == nil {
+		t.Error("findInputs() accepted an invalid pattern")
+	}
+}
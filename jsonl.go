@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonm1/flightsense-go/parse"
+)
+
+// rowReader reads the header and then the rows of an input file
+type rowReader interface {
+	Read() ([]string, error)
+}
+
+// isJSONL reports whether an input file holds newline-delimited JSON flights
+func isJSONL(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".gz")
+
+	return strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".ndjson")
+}
+
+// jsonField is an input column read from the JSON field named by a Flight json tag
+type jsonField struct {
+	column string
+	key    string
+}
+
+// jsonFields are the input columns of JSONL inputs, with the fields they are read from
+var jsonFields = flightJSONFields()
+
+// flightJSONFields pairs the csv tag of each Flight field the parser reads with its json tag
+func flightJSONFields() []jsonField {
+	read := make(map[string]bool)
+	for _, c := range parse.Columns {
+		read[c] = true
+	}
+
+	var fields []jsonField
+	t := reflect.TypeOf(Flight{})
+	for i := 0; i < t.NumField(); i++ {
+		col, key := t.Field(i).Tag.Get("csv"), t.Field(i).Tag.Get("json")
+		if read[col] && key != "" {
+			fields = append(fields, jsonField{column: col, key: key})
+		}
+	}
+
+	return fields
+}
+
+// jsonlReader reads JSONL flights as rows of the legacy CSV columns, so they pass
+// through the same parser. Each line is an object keyed by the json tags of Flight,
+// e.g. {"fullDate":"2017-01-01","carrier":"DL","origin":"ATL",...}.
+type jsonlReader struct {
+	s      *bufio.Scanner
+	header bool
+	line   int
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxReadBuffer)
+
+	return &jsonlReader{s: s}
+}
+
+// Read returns the header on the first call, and then a row for each flight. Lines
+// which aren't JSON objects are returned as a *csv.ParseError, as malformed CSV rows are.
+func (r *jsonlReader) Read() ([]string, error) {
+	if !r.header {
+		r.header = true
+		h := make([]string, len(jsonFields))
+		for i, f := range jsonFields {
+			h[i] = f.column
+		}
+		return h, nil
+	}
+
+	for r.s.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.s.Text())
+		if line == "" {
+			continue
+		}
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			return nil, &csv.ParseError{StartLine: r.line, Line: r.line, Err: fmt.Errorf("Not a JSON object: %s", err)}
+		}
+
+		row := make([]string, len(jsonFields))
+		for i, f := range jsonFields {
+			row[i] = jsonValue(f.column, obj[f.key])
+		}
+		return row, nil
+	}
+
+	if err := r.s.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// jsonValue formats a JSON value as it appears in the CSV column. Airports and
+// airlines may be objects with an IATA code, and times may be RFC 3339 timestamps.
+func jsonValue(column string, v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return v
+		}
+		if column == "FL_DATE" {
+			return t.Format("2006-01-02")
+		}
+		return t.Format("1504")
+	case bool:
+		if v {
+			return "1.00"
+		}
+		return "0.00"
+	case float64:
+		if column == "CRS_DEP_TIME" || column == "DEP_TIME" {
+			return fmt.Sprintf("%04d", int(v))
+		}
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	case map[string]interface{}:
+		for k, code := range v {
+			if strings.EqualFold(k, "iata") {
+				return jsonValue(column, code)
+			}
+		}
+	}
+
+	return ""
+}
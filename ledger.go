@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+var ledgerHeader = []string{"time", "project", "provider", "calls", "cost"}
+
+// parsePrices applies a comma separated list of provider=price pairs
+func parsePrices(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid provider price '%s', expected provider=price", pair)
+		}
+
+		price, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return fmt.Errorf("Invalid price for provider '%s': %s", kv[0], err)
+		}
+		weather.SetPrice(kv[0], price)
+	}
+
+	return nil
+}
+
+// appendLedger adds the run's provider usage to the cumulative ledger file
+func appendLedger(filename string, project string, usage []weather.ProviderUsage) error {
+	_, err := os.Stat(filename)
+	exists := err == nil
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if !exists {
+		w.Write(ledgerHeader)
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	for _, u := range usage {
+		w.Write([]string{now, project, u.Provider, strconv.Itoa(u.Calls), strconv.FormatFloat(u.Cost, 'f', -1, 64)})
+	}
+	w.Flush()
+
+	return w.Error()
+}
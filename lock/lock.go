@@ -0,0 +1,55 @@
+// Package lock provides advisory file locks so concurrent flightsense runs don't
+// corrupt shared caches and output directories
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned by Try when another process holds the lock
+var ErrLocked = errors.New("Locked by another process")
+
+// Lock is an advisory lock held on a lock file
+type Lock struct {
+	f *os.File
+}
+
+// Acquire takes the lock at path, blocking until it becomes available
+func Acquire(path string) (*Lock, error) {
+	return acquire(path, true)
+}
+
+// Try takes the lock at path, returning ErrLocked immediately if it is held elsewhere
+func Try(path string) (*Lock, error) {
+	return acquire(path, false)
+}
+
+func acquire(path string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Record the owner to help debugging stuck runs
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+
+	return &Lock{f: f}, nil
+}
+
+// Release unlocks and closes the lock file
+func (l *Lock) Release() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+
+	return l.f.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/leonm1/flightsense-go/cache"
+	"github.com/leonm1/flightsense-go/lock"
+)
+
+// acquireLocks takes the advisory locks on the cache file and the output directory
+// (either may be empty for none) according to the -lock policy and returns a function releasing them
+func acquireLocks(policy string, cacheFile string, outPath string) func() {
+	var held []*lock.Lock
+
+	take := func(path string, what string) bool {
+		var (
+			l   *lock.Lock
+			err error
+		)
+
+		switch policy {
+		case "wait":
+			infof("Waiting for lock on %s", what)
+			l, err = lock.Acquire(path)
+		case "fail", "readonly":
+			l, err = lock.Try(path)
+		default:
+			fatalf("Unknown lock policy '%s'", policy)
+		}
+
+		if err == lock.ErrLocked {
+			return false
+		}
+		if err != nil {
+			fatalf("Cannot lock %s: %s", what, err)
+		}
+
+		held = append(held, l)
+		return true
+	}
+
+	if cacheFile != "" && !take(cacheFile+".lock", "cache '"+cacheFile+"'") {
+		if policy != "readonly" {
+			fatalf("Cache '%s' is in use by another run (use -lock=wait or -lock=readonly)", cacheFile)
+		}
+
+		warnf("Cache '%s' is in use by another run, new weather data will not be saved", cacheFile)
+		cachemap.SetReadOnly(true)
+	}
+
+	if outPath != "" && !take(filepath.Join(outPath, ".flightsense.lock"), "output directory '"+outPath+"'") {
+		fatalf("Output directory '%s' is in use by another run (use -lock=wait)", outPath)
+	}
+
+	return func() {
+		for _, l := range held {
+			l.Release()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/leonm1/flightsense-go/metrics"
+)
+
+// Number of times a repeated message is logged in full before only its count is
+const repeatShown = 10
+
+// skippedRows is logged for each input row which produces no output
+var skippedRows = &repeated{what: "rows skipped"}
+
+// logLevel is the least severe level logged, set by -log-level
+var logLevel = new(slog.LevelVar)
+
+// setupLogging logs records of at least the named level to w, as JSON objects when
+// json is set and otherwise as key=value text. Packages logging through slog and
+// the standard log package are included, the latter at the info level.
+func setupLogging(w io.Writer, level string, json bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Unknown log level '%s', expected debug, info, warn or error", level)
+	}
+	logLevel.Set(l)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if json {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+
+	return nil
+}
+
+// debugf logs detail only needed to diagnose a run
+func debugf(format string, v ...interface{}) {
+	logf(slog.LevelDebug, format, v...)
+}
+
+// infof logs the progress of a run
+func infof(format string, v ...interface{}) {
+	logf(slog.LevelInfo, format, v...)
+}
+
+// warnf logs a problem the run continues past, such as a skipped row
+func warnf(format string, v ...interface{}) {
+	logf(slog.LevelWarn, format, v...)
+}
+
+// fatalf logs an error the run cannot continue past and exits
+func fatalf(format string, v ...interface{}) {
+	logf(slog.LevelError, format, v...)
+	os.Exit(exitFatal)
+}
+
+// repeated is a message logged for many rows, such as a skipped row. The first
+// repeatShown are logged in full and later ones only counted, logging the count at
+// round numbers, unless debug messages are logged.
+type repeated struct {
+	what string
+	n    int64
+}
+
+// warnf logs the message in full or counts it
+func (r *repeated) warnf(format string, v ...interface{}) {
+	n := atomic.AddInt64(&r.n, 1)
+
+	switch {
+	case n <= repeatShown || logLevel.Level() <= slog.LevelDebug:
+		warnf(format, v...)
+	case metrics.Milestone(n):
+		warnf("%d %s so far", n, r.what)
+	}
+}
+
+func logf(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+
+	slog.Log(ctx, level, fmt.Sprintf(format, v...))
+}
+
+// rotatingFile is a log file which is moved to name.1 once it reaches maxSize
+// bytes, shifting older backups up to name.<backups> and deleting the oldest
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+// createLog creates the log file name, rotating it once it reaches maxSize bytes
+// unless maxSize is 0
+func createLog(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rotatingFile{name: name, maxSize: maxSize, backups: backups, f: f}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log to the first backup and starts a new one
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.backups > 0 {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		}
+		if err := os.Rename(r.name, r.name+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(r.name)
+	if err != nil {
+		return err
+	}
+	r.f, r.size = f, 0
+
+	return nil
+}
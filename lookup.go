@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonm1/airlines-go"
+	"github.com/leonm1/airports-go"
+	"github.com/leonm1/flightsense-go/weather"
+	darksky "github.com/mlbright/darksky/v2"
+)
+
+// unknownName is the name given to airlines and airports missing from the bundled
+// datasets and the overrides
+const unknownName = "unknown"
+
+// Airlines and airports from -overrides, by IATA code
+var (
+	airlineOverrides = make(map[string]airlines.Airline)
+	airportOverrides = make(map[string]airports.Airport)
+)
+
+// loadOverrides reads airlines and airports missing from the bundled datasets from
+// a CSV file with the header type,iata,name,latitude,longitude,tz. The type is
+// 'airline' or 'airport'; airlines leave the location columns empty.
+func loadOverrides(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 6
+	if _, err := r.Read(); err != nil {
+		return fmt.Errorf("Cannot read overrides '%s': %s", filename, err)
+	}
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read overrides '%s': %s", filename, err)
+		}
+
+		iata := strings.ToUpper(strings.TrimSpace(row[1]))
+		switch row[0] {
+		case "airline":
+			airlineOverrides[iata] = airlines.Airline{IATA: iata, Name: row[2], Active: true}
+		case "airport":
+			lat, err := strconv.ParseFloat(row[3], 64)
+			if err != nil {
+				return fmt.Errorf("Invalid latitude of %s in overrides '%s'", iata, filename)
+			}
+			lon, err := strconv.ParseFloat(row[4], 64)
+			if err != nil {
+				return fmt.Errorf("Invalid longitude of %s in overrides '%s'", iata, filename)
+			}
+			if _, err := time.LoadLocation(row[5]); err != nil {
+				return fmt.Errorf("Invalid time zone of %s in overrides '%s'", iata, filename)
+			}
+			airportOverrides[iata] = airports.Airport{IATA: iata, Name: row[2], Latitude: lat, Longitude: lon, Tz: row[5]}
+		default:
+			return fmt.Errorf("Unknown type '%s' in overrides '%s', expected airline or airport", row[0], filename)
+		}
+	}
+}
+
+// Airlines, airports and time zones already looked up, shared by the parsers as the
+// same few recur on nearly every row. Failed lookups are remembered too.
+var (
+	airlineLookups  sync.Map // IATA code to airlineLookup
+	airportLookups  sync.Map // IATA code to airportLookup
+	locationLookups sync.Map // Time zone name to locationLookup
+)
+
+type airlineLookup struct {
+	airline airlines.Airline
+	err     error
+}
+
+type airportLookup struct {
+	airport airports.Airport
+	err     error
+}
+
+type locationLookup struct {
+	location *time.Location
+	err      error
+}
+
+// lookupAirline returns the airline with an IATA code from the overrides or the
+// bundled dataset. Unknown airlines are kept with the code alone when -keep-unknown is set.
+func lookupAirline(iata string) (airlines.Airline, error) {
+	if l, ok := airlineLookups.Load(iata); ok {
+		l := l.(airlineLookup)
+		return l.airline, l.err
+	}
+
+	a, ok := airlineOverrides[iata]
+	var err error
+	if !ok {
+		a, err = airlines.LookupIATA(iata)
+		if err != nil && *keepUnknown {
+			a, err = airlines.Airline{IATA: iata, Name: unknownName}, nil
+		}
+	}
+	airlineLookups.Store(iata, airlineLookup{a, err})
+
+	return a, err
+}
+
+// lookupAirport returns the airport with an IATA code from the overrides or the
+// bundled dataset. Unknown airports are kept with the code alone when -keep-unknown
+// is set; their times are taken as UTC and they have no weather.
+func lookupAirport(iata string) (airports.Airport, error) {
+	if l, ok := airportLookups.Load(iata); ok {
+		l := l.(airportLookup)
+		return l.airport, l.err
+	}
+
+	a, ok := airportOverrides[iata]
+	var err error
+	if !ok {
+		a, err = airports.LookupIATA(iata)
+		if err != nil && *keepUnknown {
+			a, err = airports.Airport{IATA: iata, Name: unknownName, Tz: "UTC"}, nil
+		}
+	}
+	airportLookups.Store(iata, airportLookup{a, err})
+
+	return a, err
+}
+
+// loadLocation returns the time zone with a name, as time.LoadLocation does, which
+// reads the zone from disk on every call
+func loadLocation(name string) (*time.Location, error) {
+	if l, ok := locationLookups.Load(name); ok {
+		l := l.(locationLookup)
+		return l.location, l.err
+	}
+
+	location, err := time.LoadLocation(name)
+	locationLookups.Store(name, locationLookup{location, err})
+
+	return location, err
+}
+
+// isUnknown reports whether an airport is missing from the dataset and overrides
+func isUnknown(a airports.Airport) bool {
+	return a.Name == unknownName && a.Latitude == 0 && a.Longitude == 0
+}
+
+// airportWeather returns the weather at an airport and where it came from, which
+// are empty for unknown airports as their location isn't known
+func airportWeather(ctx context.Context, a airports.Airport, t time.Time) (*darksky.DataPoint, weather.Source, error) {
+	if isUnknown(a) {
+		return &darksky.DataPoint{}, weather.Source{}, nil
+	}
+
+	return weather.GetSource(ctx, a, t)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// manifestName is the name of the manifest written to the output directory
+const manifestName = "manifest.json"
+
+// manifest records the output files of a run and how they were produced, so an
+// experiment's inputs can be traced and checked for changes
+type manifest struct {
+	Version  string           `json:"version"`
+	Created  time.Time        `json:"created"`
+	Format   string           `json:"format"`
+	Schema   int              `json:"schemaVersion"`
+	Columns  []string         `json:"columns"`
+	Provider providerSettings `json:"provider"`
+	Files    []manifestFile   `json:"files"`
+
+	// Settings are the value of every option of a -deterministic run, by flag name
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// providerSettings are the weather provider options of a run
+type providerSettings struct {
+	Endpoints   string                  `json:"endpoints,omitempty"`
+	Stations    string                  `json:"stations,omitempty"`
+	NegativeTTL string                  `json:"negativeTTL"`
+	Usage       []weather.ProviderUsage `json:"usage"`
+}
+
+// manifestFile is an output file, relative to the manifest, and the inputs written to it
+type manifestFile struct {
+	Path   string   `json:"path"`
+	Inputs []string `json:"inputs"`
+	Rows   int      `json:"rows"`
+	SHA256 string   `json:"sha256"`
+}
+
+// outputs tracks the rows of every output file written during a run, and the
+// inputs written to each
+type outputs struct {
+	mu     sync.Mutex
+	rows   map[string]int
+	inputs map[string][]string
+}
+
+func newOutputs() *outputs {
+	return &outputs{rows: make(map[string]int), inputs: make(map[string][]string)}
+}
+
+// add records the rows of each output file after writing an input to them. When
+// added is true the counts are of rows added to files written earlier in the run.
+func (o *outputs) add(in string, counts map[string]int, added bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for name, n := range counts {
+		if added {
+			o.rows[name] += n
+		} else {
+			o.rows[name] = n
+		}
+		o.inputs[name] = append(o.inputs[name], in)
+	}
+}
+
+// count returns the rows of an output file
+func (o *outputs) count(name string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.rows[name]
+}
+
+// writeManifest writes the manifest of a run's output files to dir
+func writeManifest(dir string, o *outputs) (string, error) {
+	m := manifest{
+		Version: version,
+		Created: time.Now().UTC(),
+		Format:  *format,
+		Schema:  schemaVersion,
+		Columns: columnNames(selected),
+		Provider: providerSettings{
+			Endpoints:   *endpoints,
+			Stations:    *stations,
+			NegativeTTL: negativeTTL.String(),
+			Usage:       weather.Usage(),
+		},
+		Files: []manifestFile{},
+	}
+
+	names := make([]string, 0, len(o.rows))
+	for name := range o.rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if *deterministic {
+		m.Settings = settings()
+	}
+
+	for _, name := range names {
+		sum, err := sha256File(name)
+		if err != nil {
+			return "", err
+		}
+
+		path, err := filepath.Rel(dir, name)
+		if err != nil {
+			path = name
+		}
+
+		inputs := o.inputs[name]
+		if *deterministic {
+			// Inputs written to the same file in parallel finish in any order
+			inputs = append([]string(nil), inputs...)
+			sort.Strings(inputs)
+		}
+
+		m.Files = append(m.Files, manifestFile{
+			Path:   filepath.ToSlash(path),
+			Inputs: inputs,
+			Rows:   o.rows[name],
+			SHA256: sum,
+		})
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dir, manifestName)
+	return filename, os.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// settings returns the value of every flag, set or defaulted, with the passwords of
+// URLs such as a -output database redacted
+func settings() map[string]string {
+	s := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if strings.Contains(v, "://") {
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				v = u.Redacted()
+			}
+		}
+		s[f.Name] = v
+	})
+
+	return s
+}
+
+// sha256File returns the hex SHA-256 digest of a file's contents
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkManifest checks that every file listed in a manifest still has the recorded checksum
+func checkManifest(filename string) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("Cannot parse manifest '%s': %s", filename, err)
+	}
+
+	var problems []string
+	for _, f := range m.Files {
+		sum, err := sha256File(filepath.Join(filepath.Dir(filename), filepath.FromSlash(f.Path)))
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if sum != f.SHA256 {
+			problems = append(problems, fmt.Sprintf("'%s' has checksum %s, expected %s", f.Path, sum, f.SHA256))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// verifyCommand defines the flags of verify on fs and returns its function, which
+// checks the output files listed in a manifest against their checksums
+func verifyCommand(fs *flag.FlagSet) func(args []string) {
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense verify [outdir/manifest.json]")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) {
+		filename := manifestName
+		if len(args) > 0 {
+			filename = args[0]
+		}
+
+		if err := checkManifest(filename); err != nil {
+			fatalf("Verification of '%s' failed: %s", filename, err)
+		}
+		infof("Verified the files listed in '%s'", filename)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/leonm1/flightsense-go/parse"
+	"gopkg.in/yaml.v2"
+)
+
+// Number of leading parse.Columns every input must have. The others are read as
+// empty when missing.
+const requiredSourceColumns = 5
+
+// profiles map the names the parser reads to the names used by other vintages of
+// the BTS exports. Columns left out keep their names.
+var profiles = map[string]map[string]string{
+	"legacy": {},
+
+	// Table builder exports before 2018
+	"unique-carrier": {"CARRIER": "UNIQUE_CARRIER"},
+
+	// Table builder exports since 2018
+	"op-unique-carrier": {"CARRIER": "OP_UNIQUE_CARRIER", "FL_NUM": "OP_CARRIER_FL_NUM"},
+
+	// Monthly zips downloaded by 'fetch'
+	"prezip": {
+		"FL_DATE":             "FlightDate",
+		"CARRIER":             "Reporting_Airline",
+		"ORIGIN":              "Origin",
+		"DEST":                "Dest",
+		"CRS_DEP_TIME":        "CRSDepTime",
+		"DEP_TIME":            "DepTime",
+		"DEP_DELAY":           "DepDelay",
+		"CANCELLED":           "Cancelled",
+		"CANCELLATION_CODE":   "CancellationCode",
+		"DIVERTED":            "Diverted",
+		"WEATHER_DELAY":       "WeatherDelay",
+		"ARR_DELAY":           "ArrDelay",
+		"TAXI_OUT":            "TaxiOut",
+		"TAXI_IN":             "TaxiIn",
+		"WHEELS_OFF":          "WheelsOff",
+		"AIR_TIME":            "AirTime",
+		"DISTANCE":            "Distance",
+		"CARRIER_DELAY":       "CarrierDelay",
+		"NAS_DELAY":           "NASDelay",
+		"SECURITY_DELAY":      "SecurityDelay",
+		"LATE_AIRCRAFT_DELAY": "LateAircraftDelay",
+		"FL_NUM":              "Flight_Number_Reporting_Airline",
+		"TAIL_NUM":            "Tail_Number",
+	},
+}
+
+// Order in which profiles are tried against an input's header
+var profileOrder = []string{"legacy", "op-unique-carrier", "unique-carrier", "prezip"}
+
+// userMapping holds the mapping read from -source-mapping, applied over the profile
+var userMapping map[string]string
+
+// loadMapping reads a YAML file mapping the parser's column names to an input's,
+// e.g. 'CARRIER: OP_UNIQUE_CARRIER'
+func loadMapping(filename string) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]string)
+	if err := yaml.UnmarshalStrict(b, &m); err != nil {
+		return fmt.Errorf("Cannot parse mapping '%s': %s", filename, err)
+	}
+
+	known := make(map[string]bool)
+	for _, c := range parse.Columns {
+		known[c] = true
+	}
+	for k := range m {
+		if !known[k] {
+			return fmt.Errorf("Mapping '%s' maps unknown column '%s' (known: %s)", filename, k, strings.Join(parse.Columns, ", "))
+		}
+	}
+
+	userMapping = m
+	return nil
+}
+
+// checkProfile checks that a -source-profile names a profile, or is auto
+func checkProfile(name string) error {
+	if _, ok := profiles[name]; ok || name == "auto" {
+		return nil
+	}
+
+	names := make([]string, 0, len(profiles))
+	for p := range profiles {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("Unknown source profile '%s' (available: auto, %s)", name, strings.Join(names, ", "))
+}
+
+// mapHeader renames the columns of an input's header to the names the parser
+// reads, using the -source-profile, or the first profile matching the header when
+// it is auto, and then the -source-mapping
+func mapHeader(header []string) ([]string, error) {
+	name := *sourceProfile
+	if name == "auto" {
+		name = ""
+		for _, p := range profileOrder {
+			if len(missingColumns(header, mapping(p))) == 0 {
+				name = p
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("Header matches no source profile, missing %s from the legacy columns",
+				strings.Join(missingColumns(header, mapping("legacy")), ", "))
+		}
+	}
+
+	m := mapping(name)
+	if missing := missingColumns(header, m); len(missing) > 0 {
+		return nil, fmt.Errorf("Header is missing %s for source profile '%s'", strings.Join(missing, ", "), name)
+	}
+
+	// Invert the mapping to rename the input's columns
+	rename := make(map[string]string, len(m))
+	for to, from := range m {
+		rename[from] = to
+	}
+
+	mapped := make([]string, len(header))
+	for i, h := range header {
+		if to, ok := rename[h]; ok {
+			mapped[i] = to
+		} else {
+			mapped[i] = h
+		}
+	}
+
+	return mapped, nil
+}
+
+// mapping returns the input column name of each column the parser reads under a profile,
+// with the -source-mapping applied
+func mapping(profile string) map[string]string {
+	m := make(map[string]string, len(parse.Columns))
+	for _, c := range parse.Columns {
+		m[c] = c
+	}
+	for to, from := range profiles[profile] {
+		m[to] = from
+	}
+	for to, from := range userMapping {
+		m[to] = from
+	}
+
+	return m
+}
+
+// missingColumns returns the required input columns of a mapping which the header lacks
+func missingColumns(header []string, m map[string]string) []string {
+	have := make(map[string]bool, len(header))
+	for _, h := range header {
+		have[h] = true
+	}
+
+	var missing []string
+	for _, c := range parse.Columns[:requiredSourceColumns] {
+		if !have[m[c]] {
+			missing = append(missing, m[c])
+		}
+	}
+
+	return missing
+}
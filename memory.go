@@ -0,0 +1,69 @@
+package main
+
+import (
+	"runtime/debug"
+
+	"github.com/leonm1/flightsense-go/cache"
+)
+
+const (
+	// Rows of each input between the reader and the output, and the bounds of the
+	// number sized from -max-memory. The fewest keep every worker busy.
+	maxRowsInFlight = 8192
+	minRowsInFlight = 2 * concurrencyLimit
+
+	// Rough size in memory of a row between the reader and the output: its fields,
+	// the parsed flight and the output row
+	rowBytes = 4 << 10
+)
+
+// setupMemory keeps the run within the -max-memory hint, when it is set: the garbage
+// collector works harder as the heap nears it, the rows in flight are sized from it,
+// and the entries of a file cache are read from disk as they are used rather than
+// all being held in memory
+func setupMemory() {
+	if *maxMemory <= 0 {
+		return
+	}
+
+	debug.SetMemoryLimit(int64(*maxMemory) << 20)
+
+	switch cacheOpts.backend {
+	case "file":
+		cachemap.SetLazy(true)
+	case "gzip":
+		warnf("The gzip cache backend holds every entry in memory; the file, bolt and sqlite backends don't under -max-memory")
+	}
+	if *dedupeMode != "" {
+		warnf("-dedupe holds a key for every flight in memory, which grows with the inputs")
+	}
+	if *format == "xlsx" {
+		warnf("xlsx output is built in memory before it is written; csv, jsonl and parquet are streamed")
+	}
+
+	infof("Keeping memory under about %d MiB, with up to %d rows of each input in flight", *maxMemory, rowsInFlight())
+}
+
+// rowsInFlight returns the number of rows of each input allowed between the reader
+// and the output. Under -max-memory, an eighth of it is shared by the inputs
+// processed at once.
+func rowsInFlight() int {
+	if *maxMemory <= 0 {
+		return maxRowsInFlight
+	}
+
+	files := *parallelFiles
+	if files < 1 {
+		files = 1
+	}
+
+	n := (*maxMemory << 20) / 8 / rowBytes / files
+	if n < minRowsInFlight {
+		return minRowsInFlight
+	}
+	if n > maxRowsInFlight {
+		return maxRowsInFlight
+	}
+
+	return n
+}
@@ -0,0 +1,194 @@
+// Package metrics records latency histograms for the stages of a flightsense run,
+// and when counts of repeated events are worth reporting
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Smallest bucket boundary and the growth factor between boundaries, giving
+	// percentiles within 10% of the true value from 1µs up to about an hour
+	minBucket   = time.Microsecond
+	growth      = 1.1
+	bucketCount = 230
+)
+
+var (
+	mu         sync.Mutex
+	histograms = make(map[string]*Histogram)
+)
+
+// Milestone reports whether a running count has reached a round number worth
+// reporting: 1, 2, 5, 10, 20, 50, 100 and so on
+func Milestone(n int64) bool {
+	if n <= 0 {
+		return false
+	}
+	for n >= 10 {
+		if n%10 != 0 {
+			return false
+		}
+		n /= 10
+	}
+
+	return n == 1 || n == 2 || n == 5
+}
+
+// Histogram counts durations in exponentially sized buckets
+type Histogram struct {
+	mu     sync.Mutex
+	counts [bucketCount]uint64
+	n      uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// Summary holds the headline statistics of a histogram
+type Summary struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// Get returns the histogram registered under name, creating it if needed
+func Get(name string) *Histogram {
+	mu.Lock()
+	defer mu.Unlock()
+
+	h, ok := histograms[name]
+	if !ok {
+		h = &Histogram{}
+		histograms[name] = h
+	}
+
+	return h
+}
+
+// Since records the time elapsed since start in the histogram registered under name
+func Since(name string, start time.Time) {
+	Get(name).Observe(time.Since(start))
+}
+
+// Names returns the sorted names of all registered histograms
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Snapshot summarizes every registered histogram
+func Snapshot() map[string]Summary {
+	ret := make(map[string]Summary)
+	for _, name := range Names() {
+		ret[name] = Get(name).Summary()
+	}
+
+	return ret
+}
+
+// WriteJSON writes the summaries of every registered histogram to filename
+func WriteJSON(filename string) error {
+	b, err := json.MarshalIndent(Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, b, 0644)
+}
+
+// Observe records a duration
+func (h *Histogram) Observe(d time.Duration) {
+	i := bucket(d)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[i]++
+	h.n++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Quantile returns an upper bound on the q-th quantile (0 < q <= 1) of the recorded durations
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.quantile(q)
+}
+
+// Summary returns the count, mean, p50, p95, p99 and maximum of the recorded durations
+func (h *Histogram) Summary() Summary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := Summary{Count: h.n, Max: h.max}
+	if h.n == 0 {
+		return s
+	}
+
+	s.Mean = h.sum / time.Duration(h.n)
+	s.P50 = h.quantile(0.50)
+	s.P95 = h.quantile(0.95)
+	s.P99 = h.quantile(0.99)
+
+	return s
+}
+
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(h.n)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			// Never report more than the largest observation
+			if upper := boundary(i); upper < h.max {
+				return upper
+			}
+			return h.max
+		}
+	}
+
+	return h.max
+}
+
+// bucket returns the index of the bucket holding d
+func bucket(d time.Duration) int {
+	if d <= minBucket {
+		return 0
+	}
+
+	i := int(math.Ceil(math.Log(float64(d)/float64(minBucket)) / math.Log(growth)))
+	if i >= bucketCount {
+		i = bucketCount - 1
+	}
+
+	return i
+}
+
+// boundary returns the upper bound of bucket i
+func boundary(i int) time.Duration {
+	return time.Duration(float64(minBucket) * math.Pow(growth, float64(i)))
+}
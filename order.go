@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// inputRow is a row of the input file and its index
+type inputRow struct {
+	seq    int
+	fields []string
+}
+
+// skipSet holds the indexes of the rows of an input which produce no output, so
+// ordered output doesn't wait for them. Rows are removed once the output passes them.
+type skipSet struct {
+	m sync.Map
+
+	// Signalled when a row is added, as records waiting on it may now be written
+	added chan struct{}
+}
+
+func newSkipSet() *skipSet {
+	return &skipSet{added: make(chan struct{}, 1)}
+}
+
+// add records that an input row produces no output
+func (s *skipSet) add(seq int) {
+	if !*ordered {
+		return
+	}
+
+	s.m.Store(seq, true)
+	select {
+	case s.added <- struct{}{}:
+	default:
+	}
+}
+
+// has reports whether an input row produces no output
+func (s *skipSet) has(seq int) bool {
+	_, ok := s.m.Load(seq)
+	return ok
+}
+
+// reorderer buffers records which arrive out of order and releases them in input order
+type reorderer struct {
+	next    int
+	pending map[int]*record
+	skipped *skipSet
+}
+
+func newReorderer(skipped *skipSet) *reorderer {
+	return &reorderer{pending: make(map[int]*record), skipped: skipped}
+}
+
+// add buffers a record, if r isn't nil, and returns the records now ready to be
+// written, in order
+func (o *reorderer) add(r *record) []*record {
+	if r != nil {
+		o.pending[r.seq] = r
+	}
+
+	var ready []*record
+	for {
+		if r, ok := o.pending[o.next]; ok {
+			ready = append(ready, r)
+			delete(o.pending, o.next)
+		} else if o.skipped.has(o.next) {
+			o.skipped.m.Delete(o.next)
+		} else {
+			return ready
+		}
+		o.next++
+	}
+}
+
+// drain returns every buffered record in order, once no more records will arrive
+func (o *reorderer) drain() []*record {
+	ready := make([]*record, 0, len(o.pending))
+	for _, r := range o.pending {
+		ready = append(ready, r)
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].seq < ready[j].seq })
+	o.pending = make(map[int]*record)
+
+	return ready
+}
+
+// rowWindow counts the rows of an input between the reader and the output, holding
+// back the reader once there are its size of them. Rows finishing out of order, a
+// slow output or stalled lookups then stop the reader rather than filling memory.
+type rowWindow struct {
+	slots chan struct{}
+}
+
+func newRowWindow(size int) *rowWindow {
+	return &rowWindow{slots: make(chan struct{}, size)}
+}
+
+// add counts a row read from the input, waiting for room in the window. It reports
+// false, without counting the row, once ctx is canceled.
+func (w *rowWindow) add(ctx context.Context) bool {
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Done counts a row which is written or produces no output
+func (w *rowWindow) Done() {
+	<-w.slots
+}
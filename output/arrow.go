@@ -0,0 +1,176 @@
+package output
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+)
+
+func init() {
+	Register("arrow", NewArrow)
+
+	// Feather version 2 is the Arrow IPC file format
+	Register("feather", NewArrow)
+}
+
+// Number of rows in each Arrow record batch
+const arrowBatchSize = 64 << 10
+
+// Arrow is a Writer of Arrow IPC files, which pandas and polars can memory-map
+// without parsing. Time columns are written as UTC timestamps.
+type Arrow struct {
+	f    *os.File
+	mem  memory.Allocator
+	cols []Column
+	b    *array.RecordBuilder
+	w    *ipc.FileWriter
+	rows int
+}
+
+// NewArrow creates the file at path and returns an Arrow writer writing to it
+func NewArrow(path string) (Writer, error) {
+	if appendMode {
+		return nil, fmt.Errorf("Arrow files cannot be appended to")
+	}
+	if path == Stdout {
+		return nil, fmt.Errorf("Arrow output cannot be streamed to standard output")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Arrow{f: f, mem: memory.NewGoAllocator()}, nil
+}
+
+// WriteHeader starts the file with a schema holding a nullable field per column
+func (a *Arrow) WriteHeader(cols []Column) error {
+	fields := make([]arrow.Field, len(cols))
+	for i, col := range cols {
+		t, err := arrowType(col)
+		if err != nil {
+			return err
+		}
+		fields[i] = arrow.Field{Name: col.Name, Type: t, Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	w, err := ipc.NewFileWriter(a.f, ipc.WithSchema(schema), ipc.WithAllocator(a.mem))
+	if err != nil {
+		return err
+	}
+	a.w, a.cols, a.b = w, cols, array.NewRecordBuilder(a.mem, schema)
+
+	return nil
+}
+
+// WriteRow appends a row to the current record batch, writing the batch once it is full
+func (a *Arrow) WriteRow(row []interface{}) error {
+	for i, v := range row {
+		if err := appendArrow(a.b.Field(i), a.cols[i], v); err != nil {
+			return err
+		}
+	}
+
+	a.rows++
+	if a.rows < arrowBatchSize {
+		return nil
+	}
+
+	return a.Flush()
+}
+
+// Flush writes the buffered rows to the file as a record batch
+func (a *Arrow) Flush() error {
+	if a.rows == 0 {
+		return nil
+	}
+
+	rec := a.b.NewRecord()
+	defer rec.Release()
+	a.rows = 0
+
+	return a.w.Write(rec)
+}
+
+// Close writes the buffered rows and the file footer and closes the file
+func (a *Arrow) Close() error {
+	if a.w != nil {
+		err := a.Flush()
+		if err == nil {
+			err = a.w.Close()
+		}
+		a.b.Release()
+		if err != nil {
+			a.f.Close()
+			return err
+		}
+	}
+
+	return a.f.Close()
+}
+
+// arrowType returns the Arrow data type of a column
+func arrowType(col Column) (arrow.DataType, error) {
+	switch col.Type {
+	case String:
+		return arrow.BinaryTypes.String, nil
+	case Int:
+		return arrow.PrimitiveTypes.Int64, nil
+	case Float:
+		return arrow.PrimitiveTypes.Float64, nil
+	case Bool:
+		return arrow.FixedWidthTypes.Boolean, nil
+	case Time:
+		return &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}, nil
+	}
+
+	return nil, fmt.Errorf("Column '%s' has unknown type %d", col.Name, col.Type)
+}
+
+// appendArrow appends a column value to the column's builder
+func appendArrow(b array.Builder, col Column, v interface{}) error {
+	if v == nil {
+		b.AppendNull()
+		return nil
+	}
+
+	switch col.Type {
+	case String:
+		b.(*array.StringBuilder).Append(Format(v))
+		return nil
+	case Int:
+		if n, ok := v.(int); ok {
+			b.(*array.Int64Builder).Append(int64(n))
+			return nil
+		}
+	case Float:
+		if f, ok := v.(float64); ok {
+			b.(*array.Float64Builder).Append(f)
+			return nil
+		}
+	case Bool:
+		if x, ok := v.(bool); ok {
+			b.(*array.BooleanBuilder).Append(x)
+			return nil
+		}
+	case Time:
+		if t, ok := v.(time.Time); ok {
+			// Times which never happened, such as the departure of a cancelled flight
+			if t.IsZero() {
+				b.AppendNull()
+				return nil
+			}
+			b.(*array.TimestampBuilder).Append(arrow.Timestamp(t.UnixMilli()))
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Column '%s' cannot hold %T value %v", col.Name, v, v)
+}
@@ -0,0 +1,66 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+)
+
+// The zero departure time of a cancelled flight is written as null, and other times
+// as milliseconds since the epoch
+func TestArrowCancelledFlight(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flights.arrow")
+	cols := []Column{{Name: "airline"}, {Name: "scheduledDepartureUTC", Type: Time}, {Name: "actualDepartureUTC", Type: Time}, {Name: "cancelled", Type: Bool}}
+	scheduled := time.Date(2017, 1, 15, 13, 30, 0, 0, time.UTC)
+	rows := [][]interface{}{
+		{"DL", scheduled, scheduled.Add(5 * time.Minute), false},
+		{"DL", scheduled, time.Time{}, true},
+	}
+
+	w, err := NewArrow(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(cols); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := ipc.NewFileReader(f, ipc.WithAllocator(memory.NewGoAllocator()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	rec, err := r.Record(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := rec.Column(2).(*array.Timestamp)
+	if actual.IsNull(0) || int64(actual.Value(0)) != scheduled.Add(5*time.Minute).UnixMilli() {
+		t.Errorf("Departure written as %v, want %d", actual.Value(0), scheduled.Add(5*time.Minute).UnixMilli())
+	}
+	if !actual.IsNull(1) {
+		t.Errorf("Departure of the cancelled flight written as %v, want null", actual.Value(1))
+	}
+	if sched := rec.Column(1); sched.IsNull(1) {
+		t.Error("Scheduled departure of the cancelled flight written as null")
+	}
+}
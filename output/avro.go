@@ -0,0 +1,116 @@
+package output
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+func init() {
+	Register("avro", NewAvro)
+}
+
+// Number of rows in each Avro block
+const avroBlockSize = 4096
+
+var (
+	// Name, namespace and version recorded in the schema of Avro output
+	avroName      = "Record"
+	avroNamespace string
+	avroVersion   string
+)
+
+// SetAvroSchema sets the record name, namespace and version in the schema of
+// subsequently opened Avro writers
+func SetAvroSchema(name string, namespace string, version string) {
+	avroName, avroNamespace, avroVersion = name, namespace, version
+}
+
+// Avro is a Writer of deflate-compressed Avro object container files. The schema
+// embedded in each file is the one AvroSchema returns, so it can be registered
+// with a schema registry as it is.
+type Avro struct {
+	f     io.WriteCloser
+	w     *goavro.OCFWriter
+	names []string
+	block []interface{}
+}
+
+// NewAvro creates the file at path and returns an Avro writer writing to it
+func NewAvro(path string) (Writer, error) {
+	if appendMode {
+		return nil, fmt.Errorf("Avro files cannot be appended to")
+	}
+
+	f, err := create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Avro{f: f}, nil
+}
+
+// WriteHeader starts the file with the schema of the columns
+func (a *Avro) WriteHeader(cols []Column) error {
+	schema, err := AvroSchema(avroName, avroNamespace, avroVersion, cols)
+	if err != nil {
+		return err
+	}
+
+	w, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               a.f,
+		Schema:          string(schema),
+		CompressionName: goavro.CompressionDeflateLabel,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.w = w
+	a.names = make([]string, len(cols))
+	for i, col := range cols {
+		a.names[i] = col.Name
+	}
+
+	return nil
+}
+
+// WriteRow adds a row to the current block, writing the block once it is full
+func (a *Avro) WriteRow(row []interface{}) error {
+	rec := make(map[string]interface{}, len(row))
+	for i, v := range row {
+		rec[a.names[i]] = v
+	}
+	a.block = append(a.block, rec)
+
+	if len(a.block) < avroBlockSize {
+		return nil
+	}
+
+	return a.Flush()
+}
+
+// Flush writes the buffered rows to the file as a block
+func (a *Avro) Flush() error {
+	if len(a.block) == 0 {
+		return nil
+	}
+
+	err := a.w.Append(a.block)
+	a.block = a.block[:0]
+
+	return err
+}
+
+// Close writes the buffered rows and closes the file
+func (a *Avro) Close() error {
+	if a.w != nil {
+		if err := a.Flush(); err != nil {
+			a.f.Close()
+			return err
+		}
+	}
+
+	return a.f.Close()
+}
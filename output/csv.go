@@ -0,0 +1,300 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+func init() {
+	Register("csv", NewCSV)
+}
+
+// Header already streamed to standard output, which later CSV writers to
+// standard output don't repeat
+var stdoutHeader []string
+
+// Quoting selects which CSV fields are quoted
+type Quoting int
+
+// Quoting styles
+const (
+	// QuoteMinimal quotes fields containing the delimiter, quotes or line breaks
+	QuoteMinimal Quoting = iota
+	// QuoteAll quotes every field
+	QuoteAll
+	// QuoteNone never quotes, failing on fields which would need it
+	QuoteNone
+)
+
+var (
+	// Field delimiter, quoting and line ending of CSV output
+	comma   = ','
+	quoting = QuoteMinimal
+	useCRLF bool
+)
+
+// SetCSVDialect sets the field delimiter, quoting and line endings of subsequently
+// opened CSV writers and readers
+func SetCSVDialect(delimiter rune, q Quoting, crlf bool) {
+	comma, quoting, useCRLF = delimiter, q, crlf
+}
+
+// NewCSVReader returns a csv.Reader of the dialect CSV output is written in
+func NewCSVReader(r io.Reader) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.LazyQuotes = quoting == QuoteNone
+
+	return cr
+}
+
+// CSV is a Writer of comma separated values
+type CSV struct {
+	path string
+	f    io.WriteCloser
+	w    *fieldWriter
+
+	// Header already at the start of the file or stream being added to, if any
+	existing []string
+}
+
+// NewCSV creates the file at path, gzip-compressed if it ends in .gz, and returns a
+// CSV sink writing to it
+func NewCSV(path string) (Writer, error) {
+	var existing []string
+	if path == Stdout {
+		existing = stdoutHeader
+	} else if appendMode {
+		h, err := csvHeader(path)
+		if err != nil {
+			return nil, err
+		}
+		existing = h
+	}
+
+	f, err := create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CSV{path: path, f: f, w: &fieldWriter{w: bufio.NewWriter(f)}, existing: existing}, nil
+}
+
+// fieldWriter writes CSV records in the configured dialect, field by field, so
+// values are formatted straight into its buffer rather than into a string each.
+// Minimal quoting follows csv.Writer.
+type fieldWriter struct {
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+// Write writes a record of strings
+func (q *fieldWriter) Write(record []string) error {
+	for i, field := range record {
+		q.buf = append(q.buf[:0], field...)
+		q.field(i, q.buf)
+	}
+
+	return q.end()
+}
+
+// field writes the i-th field of a record, quoting it as configured
+func (q *fieldWriter) field(i int, field []byte) {
+	if q.err != nil {
+		return
+	}
+	if i > 0 {
+		q.w.WriteRune(comma)
+	}
+
+	switch {
+	case quoting == QuoteNone:
+		if bytes.ContainsRune(field, comma) || bytes.ContainsAny(field, "\"\r\n") {
+			q.err = fmt.Errorf("Field %q needs quoting, which is disabled", field)
+			return
+		}
+		q.w.Write(field)
+		return
+	case quoting == QuoteMinimal && !needsQuotes(field):
+		q.w.Write(field)
+		return
+	}
+
+	q.w.WriteByte('"')
+	for len(field) > 0 {
+		i := bytes.IndexAny(field, "\"\r\n")
+		if i < 0 {
+			i = len(field)
+		}
+		q.w.Write(field[:i])
+		field = field[i:]
+		if len(field) == 0 {
+			break
+		}
+
+		// Line breaks in minimally quoted fields follow the line ending, as in csv.Writer
+		switch {
+		case field[0] == '"':
+			q.w.WriteString(`""`)
+		case quoting == QuoteAll:
+			q.w.WriteByte(field[0])
+		case field[0] == '\n' && useCRLF:
+			q.w.WriteString("\r\n")
+		case field[0] == '\n' || !useCRLF:
+			q.w.WriteByte(field[0])
+		}
+		field = field[1:]
+	}
+	q.w.WriteByte('"')
+}
+
+// end ends a record, returning the first error writing it
+func (q *fieldWriter) end() error {
+	if q.err != nil {
+		return q.err
+	}
+
+	var err error
+	if useCRLF {
+		_, err = q.w.WriteString("\r\n")
+	} else {
+		err = q.w.WriteByte('\n')
+	}
+	if err != nil {
+		q.err = err
+	}
+
+	return q.err
+}
+
+// needsQuotes reports whether csv.Writer would quote a field
+func needsQuotes(field []byte) bool {
+	if len(field) == 0 {
+		return false
+	}
+	if string(field) == `\.` || bytes.ContainsRune(field, comma) || bytes.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+
+	r, _ := utf8.DecodeRune(field)
+	return unicode.IsSpace(r)
+}
+
+// Flush writes any buffered records
+func (q *fieldWriter) Flush() {
+	if err := q.w.Flush(); err != nil && q.err == nil {
+		q.err = err
+	}
+}
+
+// Error returns the first error from writing or flushing
+func (q *fieldWriter) Error() error {
+	return q.err
+}
+
+// WriteHeader writes the column names as the first record. When appending to a
+// file which already has a header, it checks the columns match instead.
+func (c *CSV) WriteHeader(cols []Column) error {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name
+	}
+
+	if c.existing != nil {
+		if strings.Join(c.existing, ",") != strings.Join(names, ",") {
+			return fmt.Errorf("Cannot append columns %v to a file with columns %v", names, c.existing)
+		}
+		return nil
+	}
+
+	if c.path == Stdout {
+		stdoutHeader = names
+	}
+
+	return c.w.Write(names)
+}
+
+// csvHeader returns the first record of the CSV file at path, or nil if the file
+// is missing or empty
+func csvHeader(path string) ([]string, error) {
+	f, err := open(path)
+	if os.IsNotExist(err) || err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := NewCSVReader(f).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+
+	return h, err
+}
+
+// WriteRow formats and writes a row
+func (c *CSV) WriteRow(row []interface{}) error {
+	for i, v := range row {
+		c.w.buf = AppendFormat(c.w.buf[:0], v)
+		c.w.field(i, c.w.buf)
+	}
+
+	return c.w.end()
+}
+
+// Flush writes any buffered rows to the file
+func (c *CSV) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// Close flushes and closes the file
+func (c *CSV) Close() error {
+	if err := c.Flush(); err != nil {
+		c.f.Close()
+		return err
+	}
+
+	return c.f.Close()
+}
+
+// Format returns the text representation of a column value
+func Format(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	return string(AppendFormat(nil, v))
+}
+
+// AppendFormat appends the text representation of a column value to b
+func AppendFormat(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(b, v...)
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case float64:
+		return strconv.AppendFloat(b, v, 'f', -1, 64)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case time.Time:
+		return v.AppendFormat(b, time.RFC3339)
+	case nil:
+		return b
+	}
+
+	return fmt.Append(b, v)
+}
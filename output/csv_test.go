@@ -0,0 +1,139 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"math"
+	"strings"
+	"testing"
+)
+
+// edgeFields are CSV fields which need quoting, or nearly do
+var edgeFields = []string{
+	"", "plain", "two words", `say "hi"`, `"`, `""`,
+	"a,b", "a;b", "a\tb", "a|b",
+	"line\nbreak", "carriage\rreturn", "crlf\r\nline", "\n", "\r",
+	" leading space", "\tleading tab", "\u00a0leading nbsp", "trailing space ",
+	`\.`, `\.x`, "NaN", "+Inf",
+	"café", "\xff\xfeinvalid", "mixed\xff,\"\n",
+}
+
+// withDialect sets the CSV dialect for the rest of a test
+func withDialect(t *testing.T, delimiter rune, q Quoting, crlf bool) {
+	SetCSVDialect(delimiter, q, crlf)
+	t.Cleanup(func() { SetCSVDialect(',', QuoteMinimal, false) })
+}
+
+// writeFields writes a record with a fieldWriter in the current dialect
+func writeFields(t *testing.T, record []string) string {
+	var buf bytes.Buffer
+	w := &fieldWriter{w: bufio.NewWriter(&buf)}
+	if err := w.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+// Minimally quoted records match csv.Writer's in every delimiter and line ending
+func TestFieldWriterMatchesEncodingCSV(t *testing.T) {
+	for _, delimiter := range []rune{',', ';', '\t', '|'} {
+		for _, crlf := range []bool{false, true} {
+			withDialect(t, delimiter, QuoteMinimal, crlf)
+
+			for _, field := range edgeFields {
+				record := []string{field, "x", field}
+
+				var want bytes.Buffer
+				cw := csv.NewWriter(&want)
+				cw.Comma, cw.UseCRLF = delimiter, crlf
+				if err := cw.Write(record); err != nil {
+					t.Fatal(err)
+				}
+				cw.Flush()
+
+				if got := writeFields(t, record); got != want.String() {
+					t.Errorf("Delimiter %q, crlf %v: fieldWriter wrote %q, csv.Writer %q", delimiter, crlf, got, want.String())
+				}
+			}
+		}
+	}
+}
+
+// Fully quoted records read back as written, apart from carriage returns in fields,
+// which csv.Reader drops before line feeds
+func TestFieldWriterQuoteAll(t *testing.T) {
+	withDialect(t, ';', QuoteAll, false)
+
+	for _, field := range edgeFields {
+		if strings.Contains(field, "\r") {
+			continue
+		}
+
+		line := writeFields(t, []string{field, "x"})
+		if !strings.HasPrefix(line, `"`) {
+			t.Errorf("Field %q wasn't quoted: %q", field, line)
+		}
+
+		got, err := NewCSVReader(strings.NewReader(line)).Read()
+		if err != nil {
+			t.Fatalf("Cannot read back %q: %s", line, err)
+		}
+		if len(got) != 2 || got[0] != field || got[1] != "x" {
+			t.Errorf("Read back %q as %q", field, got)
+		}
+	}
+}
+
+// Unquoted fields which would need quoting fail rather than corrupt the record
+func TestFieldWriterQuoteNone(t *testing.T) {
+	withDialect(t, ',', QuoteNone, false)
+
+	for _, field := range edgeFields {
+		var buf bytes.Buffer
+		w := &fieldWriter{w: bufio.NewWriter(&buf)}
+		err := w.Write([]string{field})
+		w.Flush()
+
+		needs := strings.ContainsAny(field, ",\"\r\n")
+		if needs && err == nil {
+			t.Errorf("Field %q needing quotes was written as %q", field, buf.String())
+		}
+		if !needs && (err != nil || buf.String() != field+"\n") {
+			t.Errorf("Field %q was written as %q (%v)", field, buf.String(), err)
+		}
+	}
+}
+
+// Rows of typed values are written as csv.Writer writes the fields from Format
+func TestCSVWriteRowMatchesEncodingCSV(t *testing.T) {
+	row := []interface{}{
+		"a,\"b\"\n", 42, -7, 1.5, math.NaN(), math.Inf(1), math.Inf(-1), 1e-7, 1e21,
+		true, false, nil, " x", "\xff",
+	}
+
+	var got bytes.Buffer
+	c := &CSV{w: &fieldWriter{w: bufio.NewWriter(&got)}}
+	if err := c.WriteRow(row); err != nil {
+		t.Fatal(err)
+	}
+	c.w.Flush()
+
+	fields := make([]string, len(row))
+	for i, v := range row {
+		fields[i] = Format(v)
+	}
+	var want bytes.Buffer
+	cw := csv.NewWriter(&want)
+	cw.Write(fields)
+	cw.Flush()
+
+	if got.String() != want.String() {
+		t.Errorf("WriteRow wrote %q, csv.Writer %q", got.String(), want.String())
+	}
+}
@@ -0,0 +1,153 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+func init() {
+	Register("jsonl", NewJSONL)
+}
+
+// JSONL is a Writer of one JSON object per line
+type JSONL struct {
+	f    io.WriteCloser
+	w    *bufio.Writer
+	keys [][]byte
+	buf  []byte
+}
+
+// NewJSONL creates the file at path, gzip-compressed if it ends in .gz, and returns
+// a JSONL sink writing to it
+func NewJSONL(path string) (Writer, error) {
+	f, err := create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONL{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// NewJSONLStream returns a JSONL sink writing to w, such as an HTTP response, which
+// closing the sink leaves open
+func NewJSONLStream(w io.Writer) Writer {
+	return &JSONL{f: openWriter{w}, w: bufio.NewWriter(w)}
+}
+
+// WriteHeader records the column names used as object keys
+func (j *JSONL) WriteHeader(cols []Column) error {
+	j.keys = make([][]byte, len(cols))
+	for i, col := range cols {
+		k, err := json.Marshal(col.Name)
+		if err != nil {
+			return err
+		}
+		j.keys[i] = k
+	}
+
+	return nil
+}
+
+// WriteRow writes a row as a JSON object, keeping the keys in column order
+func (j *JSONL) WriteRow(row []interface{}) error {
+	j.w.WriteByte('{')
+	for i, v := range row {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+
+		b, err := appendJSON(j.buf[:0], v)
+		if err != nil {
+			return err
+		}
+		j.buf = b
+		j.w.Write(j.keys[i])
+		j.w.WriteByte(':')
+		j.w.Write(b)
+	}
+	j.w.WriteByte('}')
+
+	return j.w.WriteByte('\n')
+}
+
+// appendJSON appends the JSON encoding of a column value to b, as json.Marshal
+// encodes it, without allocating for the common column types
+func appendJSON(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		if !plainJSON(v) {
+			break
+		}
+		b = append(b, '"')
+		b = append(b, v...)
+		return append(b, '"'), nil
+	case int:
+		return strconv.AppendInt(b, int64(v), 10), nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			break
+		}
+
+		// Exponents for very small and large values, as encoding/json
+		format := byte('f')
+		if abs := math.Abs(v); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+			format = 'e'
+		}
+		b = strconv.AppendFloat(b, v, format, -1, 64)
+		if n := len(b); format == 'e' && n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+		return b, nil
+	case bool:
+		return strconv.AppendBool(b, v), nil
+	case time.Time:
+		if y := v.Year(); y < 0 || y > 9999 {
+			break
+		}
+		b = append(b, '"')
+		b = v.AppendFormat(b, time.RFC3339Nano)
+		return append(b, '"'), nil
+	case nil:
+		return append(b, "null"...), nil
+	}
+
+	m, err := json.Marshal(v)
+	if err != nil {
+		return b, err
+	}
+
+	return append(b, m...), nil
+}
+
+// plainJSON reports whether s is encoded by json.Marshal as itself in quotes
+func plainJSON(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= utf8.RuneSelf || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Flush writes any buffered rows to the file
+func (j *JSONL) Flush() error {
+	return j.w.Flush()
+}
+
+// Close flushes and closes the file
+func (j *JSONL) Close() error {
+	if err := j.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+
+	return j.f.Close()
+}
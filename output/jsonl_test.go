@@ -0,0 +1,76 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// Column values are encoded byte for byte as json.Marshal encodes them, and fail
+// where it fails
+func TestAppendJSONMatchesEncodingJSON(t *testing.T) {
+	values := []interface{}{
+		"", "plain", `say "hi"`, `back\slash`, "<tag> & amp", "tab\tand\nnewline\r",
+		"\x00\x1f", "café", "line\u2028separator", "\xff\xfeinvalid", "delim,;|",
+		0, 42, -7, math.MaxInt64,
+		0.0, math.Copysign(0, -1), 1.5, -2.25, 1e-6, 9.99e-7, 1e-7, 1e20, 1e21, 123456789e15, math.MaxFloat64, math.SmallestNonzeroFloat64,
+		math.NaN(), math.Inf(1), math.Inf(-1),
+		true, false, nil,
+		time.Date(2017, 1, 15, 8, 30, 0, 0, time.UTC),
+		time.Date(2017, 3, 12, 3, 30, 0, 500, time.FixedZone("EDT", -4*3600)),
+		time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(-1, 1, 1, 0, 0, 0, 0, time.UTC),
+		[]string{"fallback"},
+	}
+
+	for _, v := range values {
+		want, wantErr := json.Marshal(v)
+		got, err := appendJSON(nil, v)
+
+		if (err != nil) != (wantErr != nil) {
+			t.Errorf("appendJSON(%#v) error = %v, json.Marshal error = %v", v, err, wantErr)
+			continue
+		}
+		if err == nil && !bytes.Equal(got, want) {
+			t.Errorf("appendJSON(%#v) = %s, json.Marshal = %s", v, got, want)
+		}
+	}
+}
+
+// Rows are objects with the columns' names as keys, in order, decoding to the values
+// json.Marshal encodes
+func TestJSONLWriteRow(t *testing.T) {
+	cols := []Column{{Name: "name"}, {Name: "quote\"d"}, {Name: "n", Type: Int}, {Name: "t", Type: Time}}
+	row := []interface{}{"café <&>", "a\"b\n", 3, time.Date(2017, 1, 15, 8, 30, 0, 0, time.UTC)}
+
+	var buf bytes.Buffer
+	j := &JSONL{w: bufio.NewWriter(&buf)}
+	if err := j.WriteHeader(cols); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.WriteRow(row); err != nil {
+		t.Fatal(err)
+	}
+	j.Flush()
+
+	want := []byte{'{'}
+	for i, c := range cols {
+		if i > 0 {
+			want = append(want, ',')
+		}
+		k, _ := json.Marshal(c.Name)
+		v, _ := json.Marshal(row[i])
+		want = append(append(append(want, k...), ':'), v...)
+	}
+	want = append(want, "}\n"...)
+
+	if buf.String() != string(want) {
+		t.Errorf("WriteRow wrote %s, want %s", buf.String(), want)
+	}
+	if !json.Valid(bytes.TrimSpace(buf.Bytes())) {
+		t.Errorf("WriteRow wrote invalid JSON %s", buf.String())
+	}
+}
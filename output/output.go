@@ -0,0 +1,198 @@
+// Package output writes enriched flight records through pluggable, named Writers.
+// Writers register themselves by name so new formats and sinks can be compiled in
+// without changing the pipeline which feeds them.
+package output
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Type is the kind of value held in a column
+type Type int
+
+// Column value types
+const (
+	String Type = iota
+	Int
+	Float
+	Bool
+	Time
+)
+
+// Column describes one field of the output records
+type Column struct {
+	Name string
+	Type Type
+
+	// Key columns together identify a record
+	Key bool
+
+	// Unit of measurement of numeric values, if any
+	Unit string
+}
+
+// Writer writes rows of typed values, whose order matches the columns passed to WriteHeader
+type Writer interface {
+	WriteHeader(cols []Column) error
+	WriteRow(row []interface{}) error
+	Flush() error
+	Close() error
+}
+
+// Factory opens a Writer to the destination named by path
+type Factory func(path string) (Writer, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+
+	// Whether Writers add to existing files rather than replacing them
+	appendMode bool
+)
+
+// Register makes a Writer available by name. It panics if a Writer is registered
+// twice under the same name.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, dup := factories[name]; dup {
+		panic("output: Register called twice for writer " + name)
+	}
+	factories[name] = f
+}
+
+// Open opens a new Writer of the named format to path
+func Open(name string, path string) (Writer, error) {
+	mu.RLock()
+	f, ok := factories[name]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown output format '%s' (available: %v)", name, Names())
+	}
+
+	return f(path)
+}
+
+// Names returns the sorted names of the registered Writers
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// gzipFile is a file written through a gzip compressor
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+// Close finishes the compressed stream and closes the file
+func (g *gzipFile) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.f.Close()
+		return err
+	}
+
+	return g.f.Close()
+}
+
+// SetAppend makes subsequently opened Writers add rows to existing files instead of
+// truncating them. Formats which cannot be appended to fail to open.
+func SetAppend(a bool) {
+	appendMode = a
+}
+
+// Stdout is the path which streams output to standard output
+const Stdout = "-"
+
+// stdout is standard output, which is left open when a sink closes
+type stdout struct{}
+
+func (stdout) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdout) Close() error {
+	return nil
+}
+
+// openWriter is a writer which a sink leaves open when it closes
+type openWriter struct {
+	io.Writer
+}
+
+func (openWriter) Close() error {
+	return nil
+}
+
+// create creates the file at path for a sink, compressing what is written to it
+// when path ends in .gz. In append mode existing files are added to. The path
+// Stdout writes to standard output.
+func create(path string) (io.WriteCloser, error) {
+	if path == Stdout {
+		return stdout{}, nil
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendMode {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		// Appended data is a new gzip member, which readers treat as a continuation
+		return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+	}
+
+	return f, nil
+}
+
+// open opens the file at path for reading, decompressing it when path ends in .gz
+func open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &gzipReader{Reader: z, f: f}, nil
+	}
+
+	return f, nil
+}
+
+// gzipReader is a file read through a gzip decompressor
+type gzipReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+// Close closes the decompressor and the file
+func (g *gzipReader) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
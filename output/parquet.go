@@ -0,0 +1,147 @@
+package output
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+func init() {
+	Register("parquet", NewParquet)
+}
+
+// Number of goroutines encoding each parquet row group
+const parquetParallelism = 4
+
+// Parquet is a Writer of typed Parquet files, so pandas and Spark can load
+// the output without re-parsing text
+type Parquet struct {
+	f    *os.File
+	w    *writer.CSVWriter
+	cols []Column
+	rec  []interface{}
+}
+
+// NewParquet creates the file at path and returns a Parquet sink writing to it.
+// The file is written once the schema is known from WriteHeader.
+func NewParquet(path string) (Writer, error) {
+	if appendMode {
+		return nil, fmt.Errorf("Parquet files cannot be appended to")
+	}
+	if path == Stdout {
+		return nil, fmt.Errorf("Parquet output cannot be streamed to standard output")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Parquet{f: f}, nil
+}
+
+// WriteHeader starts the file with a schema holding a nullable field per column
+func (p *Parquet) WriteHeader(cols []Column) error {
+	md := make([]string, len(cols))
+	for i, col := range cols {
+		t, err := parquetType(col)
+		if err != nil {
+			return err
+		}
+		md[i] = fmt.Sprintf("name=%s, type=%s, repetitiontype=OPTIONAL", col.Name, t)
+	}
+
+	w, err := writer.NewCSVWriterFromWriter(md, p.f, parquetParallelism)
+	if err != nil {
+		return err
+	}
+	p.w, p.cols = w, cols
+
+	return nil
+}
+
+// WriteRow converts a row to Parquet's physical types and buffers it in the current row group
+func (p *Parquet) WriteRow(row []interface{}) error {
+	rec := make([]interface{}, len(row))
+	for i, v := range row {
+		pv, err := parquetValue(p.cols[i], v)
+		if err != nil {
+			return err
+		}
+		rec[i] = pv
+	}
+
+	return p.w.Write(rec)
+}
+
+// Flush writes the buffered rows to the file as a row group
+func (p *Parquet) Flush() error {
+	return p.w.Flush(true)
+}
+
+// Close writes the buffered rows and the file footer and closes the file
+func (p *Parquet) Close() error {
+	if p.w != nil {
+		if err := p.w.WriteStop(); err != nil {
+			p.f.Close()
+			return err
+		}
+	}
+
+	return p.f.Close()
+}
+
+// parquetType returns the type of a column in parquet-go's schema metadata, which
+// names logical types in place of the physical types they are stored as
+func parquetType(col Column) (string, error) {
+	switch col.Type {
+	case String:
+		return "UTF8", nil
+	case Int:
+		return "INT64", nil
+	case Float:
+		return "DOUBLE", nil
+	case Bool:
+		return "BOOLEAN", nil
+	case Time:
+		return "TIMESTAMP_MILLIS", nil
+	}
+
+	return "", fmt.Errorf("Column '%s' has unknown type %d", col.Name, col.Type)
+}
+
+// parquetValue converts a column value to the Go type parquet-go writes for the column's type
+func parquetValue(col Column, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch col.Type {
+	case String:
+		return Format(v), nil
+	case Int:
+		if n, ok := v.(int); ok {
+			return int64(n), nil
+		}
+	case Float:
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+	case Bool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case Time:
+		if t, ok := v.(time.Time); ok {
+			// Times which never happened, such as the departure of a cancelled flight
+			if t.IsZero() {
+				return nil, nil
+			}
+			return t.UnixMilli(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Column '%s' cannot hold %T value %v", col.Name, v, v)
+}
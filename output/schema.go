@@ -0,0 +1,101 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSONSchema returns a JSON Schema (draft-07) describing records with the given
+// columns, as written by the given version of flightsense. Units are recorded in
+// a non-validating unit keyword.
+func JSONSchema(title string, version string, cols []Column) ([]byte, error) {
+	props := make(map[string]interface{}, len(cols))
+	required := make([]string, len(cols))
+
+	for i, col := range cols {
+		prop := map[string]interface{}{}
+		switch col.Type {
+		case String:
+			prop["type"] = "string"
+		case Int:
+			prop["type"] = "integer"
+		case Float:
+			prop["type"] = "number"
+		case Bool:
+			prop["type"] = "boolean"
+		case Time:
+			prop["type"] = "string"
+			prop["format"] = "date-time"
+		default:
+			return nil, fmt.Errorf("Column '%s' has unknown type %d", col.Name, col.Type)
+		}
+
+		if col.Unit != "" {
+			prop["unit"] = col.Unit
+		}
+
+		props[col.Name] = prop
+		required[i] = col.Name
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-07/schema#",
+		"title":      title,
+		"version":    version,
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}, "", "  ")
+}
+
+// avroField is a field of an Avro record schema
+type avroField struct {
+	Name string      `json:"name"`
+	Type interface{} `json:"type"`
+	Unit string      `json:"unit,omitempty"`
+}
+
+// AvroSchema returns an Avro record schema (.avsc) describing records with the given
+// columns, as written by the given version of flightsense
+func AvroSchema(name string, namespace string, version string, cols []Column) ([]byte, error) {
+	fields := make([]avroField, len(cols))
+
+	for i, col := range cols {
+		t, err := avroType(col)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = avroField{Name: col.Name, Type: t, Unit: col.Unit}
+	}
+
+	schema := map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": fields,
+	}
+	if namespace != "" {
+		schema["namespace"] = namespace
+	}
+	if version != "" {
+		schema["version"] = version
+	}
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func avroType(col Column) (interface{}, error) {
+	switch col.Type {
+	case String:
+		return "string", nil
+	case Int:
+		return "long", nil
+	case Float:
+		return "double", nil
+	case Bool:
+		return "boolean", nil
+	case Time:
+		return map[string]string{"type": "long", "logicalType": "timestamp-millis"}, nil
+	}
+
+	return nil, fmt.Errorf("Column '%s' has unknown type %d", col.Name, col.Type)
+}
@@ -0,0 +1,176 @@
+package output
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	// Register the postgres and sqlite3 database/sql drivers
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	Register("sqlite", NewSQLite)
+	Register("postgres", NewPostgres)
+}
+
+const (
+	// Table the database sinks write flights to
+	sqlTable = "flights"
+
+	// Number of rows inserted per transaction
+	sqlBatchSize = 500
+)
+
+// SQL is a Writer inserting rows straight into a database table. The table is created
+// from the columns if it doesn't exist, and rows are upserted on the key columns
+// so an interrupted run can be repeated without duplicating flights.
+type SQL struct {
+	db          *sql.DB
+	placeholder func(i int) string
+	cols        []Column
+	insert      string
+	batch       [][]interface{}
+}
+
+// NewSQLite returns a sink writing to the SQLite database file at path
+func NewSQLite(path string) (Writer, error) {
+	return openSQL("sqlite3", path, func(int) string { return "?" })
+}
+
+// NewPostgres returns a sink writing to the PostgreSQL database at the connection URL path
+func NewPostgres(path string) (Writer, error) {
+	return openSQL("postgres", path, func(i int) string { return fmt.Sprintf("$%d", i+1) })
+}
+
+func openSQL(driver string, dsn string, placeholder func(i int) string) (Writer, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQL{db: db, placeholder: placeholder}, nil
+}
+
+// WriteHeader creates the table if needed and prepares the upsert statement
+func (s *SQL) WriteHeader(cols []Column) error {
+	var defs, names, values, keys, updates []string
+
+	for i, col := range cols {
+		t, err := sqlType(col)
+		if err != nil {
+			return err
+		}
+
+		name := quoteIdent(col.Name)
+		defs = append(defs, name+" "+t)
+		names = append(names, name)
+		values = append(values, s.placeholder(i))
+		if col.Key {
+			keys = append(keys, name)
+		} else {
+			updates = append(updates, name+" = excluded."+name)
+		}
+	}
+	if len(keys) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(keys, ", ")+")")
+	}
+
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteIdent(sqlTable), strings.Join(defs, ", "))
+	if _, err := s.db.Exec(create); err != nil {
+		return fmt.Errorf("Cannot create table '%s': %s", sqlTable, err)
+	}
+
+	s.insert = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(sqlTable), strings.Join(names, ", "), strings.Join(values, ", "))
+	if len(keys) > 0 {
+		s.insert += " ON CONFLICT (" + strings.Join(keys, ", ") + ")"
+		if len(updates) > 0 {
+			s.insert += " DO UPDATE SET " + strings.Join(updates, ", ")
+		} else {
+			s.insert += " DO NOTHING"
+		}
+	}
+	s.cols = cols
+
+	return nil
+}
+
+// WriteRow buffers a row, inserting the batch once it is full
+func (s *SQL) WriteRow(row []interface{}) error {
+	s.batch = append(s.batch, append([]interface{}(nil), row...))
+	if len(s.batch) < sqlBatchSize {
+		return nil
+	}
+
+	return s.Flush()
+}
+
+// Flush inserts the buffered rows in a single transaction
+func (s *SQL) Flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range s.batch {
+		if _, err := stmt.Exec(row...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.batch = s.batch[:0]
+
+	return nil
+}
+
+// Close inserts any buffered rows and closes the database
+func (s *SQL) Close() error {
+	if err := s.Flush(); err != nil {
+		s.db.Close()
+		return err
+	}
+
+	return s.db.Close()
+}
+
+// sqlType returns the column type of a column, understood by both SQLite and PostgreSQL
+func sqlType(col Column) (string, error) {
+	switch col.Type {
+	case String:
+		return "TEXT", nil
+	case Int:
+		return "BIGINT", nil
+	case Float:
+		return "DOUBLE PRECISION", nil
+	case Bool:
+		return "BOOLEAN", nil
+	case Time:
+		return "TIMESTAMP WITH TIME ZONE", nil
+	}
+
+	return "", fmt.Errorf("Column '%s' has unknown type %d", col.Name, col.Type)
+}
+
+// quoteIdent quotes a table or column name, preserving its case
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,203 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/360EntSecGroup-Skylar/excelize/v2"
+)
+
+func init() {
+	Register("xlsx", NewXLSX)
+}
+
+// Names of the sheets written to an xlsx file
+const (
+	xlsxRowsSheet    = "Flights"
+	xlsxSummarySheet = "Summary"
+)
+
+var (
+	// Columns summarised on an extra sheet, if any
+	summaryGroup, summaryValue string
+)
+
+// SetXLSXSummary makes subsequently opened xlsx Writers add a sheet with the count and
+// average of the value column for each distinct value of the group column. Empty
+// names disable the summary sheet.
+func SetXLSXSummary(group string, value string) {
+	summaryGroup, summaryValue = group, value
+}
+
+// xlsxGroup accumulates the summary of one group
+type xlsxGroup struct {
+	n   int
+	sum float64
+}
+
+// XLSX is a Writer of Excel workbooks. Numbers, booleans and times are written as
+// typed cells, so spreadsheets can sort and chart them without conversion.
+type XLSX struct {
+	path string
+	f    *excelize.File
+	sw   *excelize.StreamWriter
+	date int
+	rows int
+
+	// Index of the summary columns, or -1 if there is no summary
+	group, value int
+	groups       map[string]*xlsxGroup
+}
+
+// NewXLSX returns an XLSX writer which saves a workbook to path when closed
+func NewXLSX(path string) (Writer, error) {
+	if appendMode {
+		return nil, fmt.Errorf("Excel workbooks cannot be appended to")
+	}
+	if path == Stdout {
+		return nil, fmt.Errorf("Excel output cannot be streamed to standard output")
+	}
+
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", xlsxRowsSheet)
+
+	return &XLSX{path: path, f: f, group: -1, value: -1}, nil
+}
+
+// WriteHeader writes the column names as the first row of the sheet
+func (x *XLSX) WriteHeader(cols []Column) error {
+	sw, err := x.f.NewStreamWriter(xlsxRowsSheet)
+	if err != nil {
+		return err
+	}
+
+	// Excel stores times as numbers, which only display as dates once styled
+	x.date, err = x.f.NewStyle(`{"custom_number_format":"yyyy-mm-dd hh:mm"}`)
+	if err != nil {
+		return err
+	}
+
+	head := make([]interface{}, len(cols))
+	for i, col := range cols {
+		head[i] = col.Name
+		if col.Name == summaryGroup {
+			x.group = i
+		}
+		if col.Name == summaryValue && (col.Type == Int || col.Type == Float) {
+			x.value = i
+		}
+	}
+	if x.group >= 0 && x.value >= 0 {
+		x.groups = make(map[string]*xlsxGroup)
+	}
+
+	x.sw, x.rows = sw, 1
+
+	return sw.SetRow("A1", head)
+}
+
+// WriteRow writes a row of typed cells and adds it to the summary
+func (x *XLSX) WriteRow(row []interface{}) error {
+	cells := make([]interface{}, len(row))
+	for i, v := range row {
+		if t, ok := v.(time.Time); ok {
+			cells[i] = excelize.Cell{StyleID: x.date, Value: t.UTC()}
+		} else {
+			cells[i] = v
+		}
+	}
+
+	x.rows++
+	axis, err := excelize.CoordinatesToCellName(1, x.rows)
+	if err != nil {
+		return err
+	}
+	if err := x.sw.SetRow(axis, cells); err != nil {
+		return err
+	}
+
+	if x.groups != nil {
+		x.summarise(row)
+	}
+
+	return nil
+}
+
+// summarise adds a row's value to the running average of its group
+func (x *XLSX) summarise(row []interface{}) {
+	var v float64
+	switch n := row[x.value].(type) {
+	case int:
+		v = float64(n)
+	case float64:
+		v = n
+	default:
+		return
+	}
+
+	k := Format(row[x.group])
+	g, ok := x.groups[k]
+	if !ok {
+		g = &xlsxGroup{}
+		x.groups[k] = g
+	}
+	g.n++
+	g.sum += v
+}
+
+// Flush does nothing, as a workbook can only be written once it is complete
+func (x *XLSX) Flush() error {
+	return nil
+}
+
+// Close adds the summary sheet, if any, and saves the workbook
+func (x *XLSX) Close() error {
+	if x.sw != nil {
+		if err := x.sw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if x.groups != nil {
+		if err := x.writeSummary(); err != nil {
+			return err
+		}
+	}
+
+	return x.f.SaveAs(x.path)
+}
+
+// writeSummary writes the count and average of each group, in group order
+func (x *XLSX) writeSummary() error {
+	x.f.NewSheet(xlsxSummarySheet)
+
+	sw, err := x.f.NewStreamWriter(xlsxSummarySheet)
+	if err != nil {
+		return err
+	}
+
+	head := []interface{}{summaryGroup, "flights", "mean " + summaryValue}
+	if err := sw.SetRow("A1", head); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(x.groups))
+	for k := range x.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		g := x.groups[k]
+		axis, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+		if err := sw.SetRow(axis, []interface{}{k, g.n, g.sum / float64(g.n)}); err != nil {
+			return err
+		}
+	}
+
+	return sw.Flush()
+}
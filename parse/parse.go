@@ -0,0 +1,380 @@
+// Package parse parses flights from the rows of BTS on-time performance exports,
+// before they are enriched with weather
+package parse
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/leonm1/airlines-go"
+	"github.com/leonm1/airports-go"
+)
+
+// Columns are the input columns the parser reads, by the names of the BTS exports it
+// was first written against
+var Columns = []string{
+	"FL_DATE", "CARRIER", "ORIGIN", "DEST", "CRS_DEP_TIME", "DEP_TIME", "DEP_DELAY",
+	"CANCELLED", "CANCELLATION_CODE", "DIVERTED", "WEATHER_DELAY",
+	"ARR_DELAY", "TAXI_OUT", "TAXI_IN", "WHEELS_OFF", "AIR_TIME", "DISTANCE",
+	"CARRIER_DELAY", "NAS_DELAY", "SECURITY_DELAY", "LATE_AIRCRAFT_DELAY",
+	"FL_NUM", "TAIL_NUM",
+}
+
+// Positions of the columns in Columns
+const (
+	colDate = iota
+	colCarrier
+	colOrigin
+	colDest
+	colScheduledDep
+	colDep
+	colDepDelay
+	colCancelled
+	colCancellationCode
+	colDiverted
+	colWeatherDelay
+	colArrDelay
+	colTaxiOut
+	colTaxiIn
+	colWheelsOff
+	colAirTime
+	colDistance
+	colCarrierDelay
+	colNASDelay
+	colSecurityDelay
+	colLateAircraftDelay
+	colFlightNumber
+	colTailNumber
+	numColumns
+)
+
+// Flight is a flight as the BTS reports it. Times are local to the airport they
+// refer to, and durations are in minutes.
+type Flight struct {
+	// Local calendar date of the scheduled departure
+	Date time.Time
+
+	Carrier      airlines.Airline
+	Origin       airports.Airport
+	Destination  airports.Airport
+	FlightNumber string
+	TailNumber   string
+
+	ScheduledDep time.Time
+	ActualDep    time.Time
+	WheelsOff    time.Time
+
+	// Departure delay, with early departures counted as on time
+	Delay int
+
+	Cancelled        bool
+	CancellationCode string
+	Diverted         bool
+
+	// Arrival side, empty for cancelled and diverted flights
+	ArrivalDelay int
+	TaxiOut      int
+	TaxiIn       int
+	AirTime      int
+
+	// Distance in miles
+	Distance float64
+
+	// Causes of the delay, only reported for flights arriving 15 or more minutes late
+	CarrierDelay      int
+	WeatherDelay      int
+	NASDelay          int
+	SecurityDelay     int
+	LateAircraftDelay int
+}
+
+// Options are the lookups the parser resolves airline and airport codes and time
+// zones with. Nil lookups use the bundled datasets and time.LoadLocation.
+type Options struct {
+	Airline  func(iata string) (airlines.Airline, error)
+	Airport  func(iata string) (airports.Airport, error)
+	Location func(name string) (*time.Location, error)
+}
+
+// ParseRow parses a flight from its input values, keyed by the names in Columns.
+// Missing columns are read as empty.
+func ParseRow(values map[string]string, opts Options) (*Flight, error) {
+	return parse(func(col int) string { return values[Columns[col]] }, opts)
+}
+
+// Index holds the position in an input's rows of each of the Columns, or -1 when the
+// input lacks it, resolved once from the header so rows are parsed without a map
+type Index struct {
+	at    [numColumns]int
+	width int
+}
+
+// NewIndex resolves the Columns in a header. A column named twice is read from the last.
+func NewIndex(header []string) *Index {
+	pos := make(map[string]int, len(header))
+	for i, h := range header {
+		pos[h] = i
+	}
+
+	ix := &Index{width: len(header)}
+	for i, name := range Columns {
+		ix.at[i] = -1
+		if p, ok := pos[name]; ok {
+			ix.at[i] = p
+		}
+	}
+
+	return ix
+}
+
+// Width returns the number of columns of the header
+func (ix *Index) Width() int {
+	return ix.width
+}
+
+// Parse parses a flight from the fields of a row of the input whose header ix was
+// resolved from. Columns the input lacks are read as empty.
+func (ix *Index) Parse(fields []string, opts Options) (*Flight, error) {
+	if len(fields) < ix.width {
+		return nil, fmt.Errorf("Row has %d columns, expected %d", len(fields), ix.width)
+	}
+
+	return parse(func(col int) string { return ix.get(fields, col) }, opts)
+}
+
+// get returns the value of column col of a row, empty when the input lacks it
+func (ix *Index) get(fields []string, col int) string {
+	if i := ix.at[col]; i >= 0 {
+		return fields[i]
+	}
+
+	return ""
+}
+
+// parse parses a flight from the value of each column
+func parse(value func(col int) string, opts Options) (*Flight, error) {
+	lookupAirline, lookupAirport, loadLocation := opts.Airline, opts.Airport, opts.Location
+	if lookupAirline == nil {
+		lookupAirline = airlines.LookupIATA
+	}
+	if lookupAirport == nil {
+		lookupAirport = airports.LookupIATA
+	}
+	if loadLocation == nil {
+		loadLocation = time.LoadLocation
+	}
+
+	f := &Flight{}
+
+	// Date, the local calendar date of the scheduled departure
+	date, err := flightDate(value(colDate))
+	if err != nil {
+		return nil, err
+	}
+	f.Date = date
+
+	// Carrier airline struct
+	carrier, err := lookupAirline(value(colCarrier))
+	if err != nil {
+		return nil, err
+	}
+	f.Carrier = carrier
+
+	// Origin Airport struct
+	orig, err := lookupAirport(value(colOrigin))
+	if err != nil {
+		return nil, err
+	}
+	f.Origin = orig
+	location, err := loadLocation(f.Origin.Tz)
+	if err != nil {
+		return nil, err
+	}
+
+	// Destination Airport struct
+	dest, err := lookupAirport(value(colDest))
+	if err != nil {
+		return nil, err
+	}
+	f.Destination = dest
+
+	// Cancellation status
+	f.Cancelled, err = indicator(value(colCancelled))
+	if err != nil {
+		return nil, err
+	}
+
+	// Scheduled Departure time, parsed for cancelled flights too so their weather is
+	// looked up at the hour they were due to leave
+	f.ScheduledDep, err = clockTime(value(colScheduledDep), f.Date, location)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cancellation code
+	f.CancellationCode = value(colCancellationCode)
+
+	// Flight and aircraft
+	f.FlightNumber = value(colFlightNumber)
+	f.TailNumber = value(colTailNumber)
+
+	if !f.Cancelled {
+		// Actual Departure time, on the day nearest the scheduled departure plus the
+		// delay, as flights delayed past midnight leave on the next calendar day
+		f.ActualDep, err = clockTime(value(colDep), f.Date, location)
+		if err != nil {
+			return nil, err
+		}
+		expected := f.ScheduledDep
+		if delay, err := strconv.ParseFloat(value(colDepDelay), 64); err == nil {
+			expected = expected.Add(time.Duration(delay) * time.Minute)
+		}
+		f.ActualDep = nearestDay(f.ActualDep, expected)
+
+		// Delay (in minutes), with early departures counted as on time
+		if f.Delay, err = minutes(value(colDepDelay)); err != nil {
+			return nil, err
+		}
+		if f.Delay < 0 {
+			f.Delay = 0
+		}
+
+		// Causes of the delay, only reported for flights arriving 15 or more minutes late
+		causes := [...]struct {
+			column int
+			delay  *int
+		}{
+			{colCarrierDelay, &f.CarrierDelay},
+			{colWeatherDelay, &f.WeatherDelay},
+			{colNASDelay, &f.NASDelay},
+			{colSecurityDelay, &f.SecurityDelay},
+			{colLateAircraftDelay, &f.LateAircraftDelay},
+		}
+		for _, c := range causes {
+			if *c.delay, err = minutes(value(c.column)); err != nil {
+				return nil, err
+			}
+		}
+
+		// Flight diverted flag
+		f.Diverted, err = indicator(value(colDiverted))
+		if err != nil {
+			return nil, err
+		}
+
+		// Arrival side, empty for diverted flights (in minutes)
+		if f.ArrivalDelay, err = minutes(value(colArrDelay)); err != nil {
+			return nil, err
+		}
+		if f.TaxiOut, err = minutes(value(colTaxiOut)); err != nil {
+			return nil, err
+		}
+		if f.TaxiIn, err = minutes(value(colTaxiIn)); err != nil {
+			return nil, err
+		}
+		if f.AirTime, err = minutes(value(colAirTime)); err != nil {
+			return nil, err
+		}
+
+		// Wheels off time, after taxiing out from the actual departure
+		if v := value(colWheelsOff); v != "" {
+			f.WheelsOff, err = clockTime(v, f.Date, location)
+			if err != nil {
+				return nil, err
+			}
+			f.WheelsOff = nearestDay(f.WheelsOff, f.ActualDep.Add(time.Duration(f.TaxiOut)*time.Minute))
+		}
+	}
+
+	// Distance (in miles)
+	if v := value(colDistance); v != "" {
+		f.Distance, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// clockTime parses a BTS hhmm time on date, which are local to the airport's
+// location. 2400 is midnight at the end of the day. Times skipped when clocks go
+// forward are moved on by the hour, and repeated times when clocks go back are
+// taken as the first.
+func clockTime(hhmm string, date time.Time, location *time.Location) (time.Time, error) {
+	midnight := hhmm == "2400"
+	if midnight {
+		hhmm = "0000"
+	}
+
+	clock, err := time.Parse("1504", hhmm)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t := time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), 0, 0, location)
+	if t.Hour() != clock.Hour() || t.Minute() != clock.Minute() {
+		t = t.Add(time.Hour)
+	}
+	if midnight {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// First day of the BTS on-time performance data
+var firstFlightDate = time.Date(1987, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+// flightDate parses the YYYY-MM-DD date of a flight, which must be within the BTS
+// data or the coming year
+func flightDate(v string) (time.Time, error) {
+	d, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid flight date '%s'", v)
+	}
+	if d.Before(firstFlightDate) || d.After(time.Now().AddDate(1, 0, 0)) {
+		return time.Time{}, fmt.Errorf("Flight date '%s' is out of range", v)
+	}
+
+	return d, nil
+}
+
+// nearestDay moves t by whole days to the day which puts it nearest to expected,
+// for times written on the calendar day of the scheduled departure
+func nearestDay(t time.Time, expected time.Time) time.Time {
+	days := math.Round(expected.Sub(t).Hours() / 24)
+
+	return t.AddDate(0, 0, int(days))
+}
+
+// indicator parses a BTS 0/1 flag, which exports write as 1, 1.0 or 1.00. Empty
+// flags are false.
+func indicator(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false, fmt.Errorf("Invalid indicator '%s'", v)
+	}
+
+	return n != 0, nil
+}
+
+// minutes parses a duration in minutes from the input, which may be empty
+func minutes(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	m, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(m), nil
+}
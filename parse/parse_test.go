@@ -0,0 +1,207 @@
+package parse
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leonm1/airlines-go"
+	"github.com/leonm1/airports-go"
+)
+
+// testOptions look codes up in small fixed datasets, so the tests don't depend on
+// the bundled ones
+var testOptions = Options{
+	Airline: func(iata string) (airlines.Airline, error) {
+		if iata == "DL" {
+			return airlines.Airline{IATA: "DL", Name: "Delta Air Lines", Active: true}, nil
+		}
+		return airlines.Airline{}, errors.New("Unknown airline " + iata)
+	},
+	Airport: func(iata string) (airports.Airport, error) {
+		switch iata {
+		case "ATL":
+			return airports.Airport{IATA: "ATL", Latitude: 33.6367, Longitude: -84.4281, Tz: "America/New_York"}, nil
+		case "LAX":
+			return airports.Airport{IATA: "LAX", Latitude: 33.9425, Longitude: -118.4081, Tz: "America/Los_Angeles"}, nil
+		}
+		return airports.Airport{}, errors.New("Unknown airport " + iata)
+	},
+}
+
+// row returns the values of an on-time flight from ATL to LAX with changes applied
+func row(changes map[string]string) map[string]string {
+	values := map[string]string{
+		"FL_DATE":             "2017-01-15",
+		"CARRIER":             "DL",
+		"ORIGIN":              "ATL",
+		"DEST":                "LAX",
+		"CRS_DEP_TIME":        "0830",
+		"DEP_TIME":            "0845",
+		"DEP_DELAY":           "15.00",
+		"CANCELLED":           "0.00",
+		"CANCELLATION_CODE":   "",
+		"DIVERTED":            "0.00",
+		"WEATHER_DELAY":       "5.00",
+		"ARR_DELAY":           "20.00",
+		"TAXI_OUT":            "12.00",
+		"TAXI_IN":             "7.00",
+		"WHEELS_OFF":          "0857",
+		"AIR_TIME":            "250.00",
+		"DISTANCE":            "1947.00",
+		"CARRIER_DELAY":       "15.00",
+		"NAS_DELAY":           "0.00",
+		"SECURITY_DELAY":      "0.00",
+		"LATE_AIRCRAFT_DELAY": "0.00",
+		"FL_NUM":              "1234",
+		"TAIL_NUM":            "N123DL",
+	}
+	for k, v := range changes {
+		if v == "" {
+			delete(values, k)
+			continue
+		}
+		values[k] = v
+	}
+
+	return values
+}
+
+func TestParseRow(t *testing.T) {
+	f, err := ParseRow(row(nil), testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atl, _ := time.LoadLocation("America/New_York")
+	want := &Flight{
+		Date:              time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC),
+		Carrier:           airlines.Airline{IATA: "DL", Name: "Delta Air Lines", Active: true},
+		Origin:            airports.Airport{IATA: "ATL", Latitude: 33.6367, Longitude: -84.4281, Tz: "America/New_York"},
+		Destination:       airports.Airport{IATA: "LAX", Latitude: 33.9425, Longitude: -118.4081, Tz: "America/Los_Angeles"},
+		FlightNumber:      "1234",
+		TailNumber:        "N123DL",
+		ScheduledDep:      time.Date(2017, 1, 15, 8, 30, 0, 0, atl),
+		ActualDep:         time.Date(2017, 1, 15, 8, 45, 0, 0, atl),
+		WheelsOff:         time.Date(2017, 1, 15, 8, 57, 0, 0, atl),
+		Delay:             15,
+		ArrivalDelay:      20,
+		TaxiOut:           12,
+		TaxiIn:            7,
+		AirTime:           250,
+		Distance:          1947,
+		CarrierDelay:      15,
+		WeatherDelay:      5,
+		NASDelay:          0,
+		SecurityDelay:     0,
+		LateAircraftDelay: 0,
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("ParseRow() = %+v, want %+v", f, want)
+	}
+}
+
+func TestParseRowFields(t *testing.T) {
+	atl, _ := time.LoadLocation("America/New_York")
+
+	tests := []struct {
+		name    string
+		changes map[string]string
+		check   func(f *Flight) bool
+	}{
+		{"early departures are on time", map[string]string{"DEP_TIME": "0825", "DEP_DELAY": "-5.00", "WHEELS_OFF": "0837"},
+			func(f *Flight) bool { return f.Delay == 0 }},
+		{"cancelled flights keep their scheduled departure only", map[string]string{"CANCELLED": "1.00", "CANCELLATION_CODE": "B", "DEP_TIME": "", "DEP_DELAY": ""},
+			func(f *Flight) bool {
+				return f.Cancelled && f.CancellationCode == "B" && f.ActualDep.IsZero() && f.ScheduledDep.Equal(time.Date(2017, 1, 15, 8, 30, 0, 0, atl))
+			}},
+		{"diverted flights have no arrival", map[string]string{"DIVERTED": "1", "ARR_DELAY": "", "TAXI_IN": "", "AIR_TIME": ""},
+			func(f *Flight) bool { return f.Diverted && f.ArrivalDelay == 0 && f.AirTime == 0 }},
+		{"missing optional columns are empty", map[string]string{"FL_NUM": "", "TAIL_NUM": "", "DISTANCE": "", "WHEELS_OFF": ""},
+			func(f *Flight) bool { return f.FlightNumber == "" && f.Distance == 0 && f.WheelsOff.IsZero() }},
+		{"delays past midnight leave the next day", map[string]string{"CRS_DEP_TIME": "2350", "DEP_TIME": "0020", "DEP_DELAY": "30.00", "WHEELS_OFF": "0032"},
+			func(f *Flight) bool {
+				return f.ActualDep.Equal(time.Date(2017, 1, 16, 0, 20, 0, 0, atl)) && f.WheelsOff.Equal(time.Date(2017, 1, 16, 0, 32, 0, 0, atl))
+			}},
+		{"2400 is midnight at the end of the day", map[string]string{"CRS_DEP_TIME": "2400", "DEP_TIME": "2400", "DEP_DELAY": "0.00", "WHEELS_OFF": "0012"},
+			func(f *Flight) bool {
+				midnight := time.Date(2017, 1, 16, 0, 0, 0, 0, atl)
+				return f.ScheduledDep.Equal(midnight) && f.ActualDep.Equal(midnight) && f.Date.Day() == 15
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseRow(row(tt.changes), testOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(f) {
+				t.Errorf("ParseRow() = %+v", f)
+			}
+		})
+	}
+}
+
+func TestParseRowErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+	}{
+		{"invalid date", map[string]string{"FL_DATE": "01/15/2017"}},
+		{"date before the BTS data", map[string]string{"FL_DATE": "1980-01-01"}},
+		{"unknown airline", map[string]string{"CARRIER": "ZZ"}},
+		{"unknown origin", map[string]string{"ORIGIN": "ZZZ"}},
+		{"unknown destination", map[string]string{"DEST": "ZZZ"}},
+		{"invalid scheduled departure", map[string]string{"CRS_DEP_TIME": "8:30"}},
+		{"invalid indicator", map[string]string{"CANCELLED": "no"}},
+		{"invalid delay", map[string]string{"DEP_DELAY": "late"}},
+		{"invalid distance", map[string]string{"DISTANCE": "far"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if f, err := ParseRow(row(tt.changes), testOptions); err == nil {
+				t.Errorf("ParseRow() = %+v, want an error", f)
+			}
+		})
+	}
+}
+
+// Rows parsed by position match the same values parsed from a map, whatever the
+// order of the input's columns
+func TestIndexParse(t *testing.T) {
+	values := row(map[string]string{"TAIL_NUM": ""})
+	header := []string{"EXTRA"}
+	for i := len(Columns) - 1; i >= 0; i-- {
+		if _, ok := values[Columns[i]]; ok {
+			header = append(header, Columns[i])
+		}
+	}
+	fields := make([]string, len(header))
+	for i, h := range header {
+		fields[i] = values[h]
+	}
+
+	ix := NewIndex(header)
+	if ix.Width() != len(header) {
+		t.Errorf("Width() = %d, want %d", ix.Width(), len(header))
+	}
+
+	got, err := ix.Parse(fields, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ParseRow(values, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Index.Parse() = %+v, want %+v", got, want)
+	}
+
+	if _, err := ix.Parse(fields[:len(fields)-1], testOptions); err == nil {
+		t.Error("Index.Parse() of a short row succeeded")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// record is an output row, the partition it is written to and the index of the
+// input row it came from
+type record struct {
+	seq       int
+	row       *[]interface{}
+	partition string
+}
+
+// partitionOf returns the Hive-style partition directory of a flight, or "" when
+// output isn't partitioned
+func partitionOf(f *Flight) string {
+	switch *partitionBy {
+	case "month":
+		return fmt.Sprintf("year=%d/month=%02d", f.Date.Year(), int(f.Date.Month()))
+	case "airline":
+		return "airline=" + f.Carrier.IATA
+	}
+
+	return ""
+}
+
+// partitionPath returns the file written for a partition of the output file outname
+func partitionPath(outname string, partition string) string {
+	if partition == "" || *database != "" {
+		return outname
+	}
+
+	return filepath.Join(filepath.Dir(outname), filepath.FromSlash(partition), filepath.Base(outname))
+}
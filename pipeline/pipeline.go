@@ -0,0 +1,212 @@
+// Package pipeline runs the stages of a flightsense run, reading rows, parsing them,
+// enriching flights and writing them, each as a bounded pool of goroutines between
+// typed channels
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Func processes an item of a stage's input, sending its outputs, if any, with emit.
+// An error rejects the item, which is then sent on the stage's error channel. emit
+// drops the output once the stage's context is canceled.
+type Func[In, Out any] func(ctx context.Context, item In, emit func(Out)) error
+
+// Error is an item a stage rejected, and why
+type Error[In any] struct {
+	Item In
+	Err  error
+}
+
+// Stage is a pool of goroutines applying a Func to the items of an input channel.
+// Its output and error channels are closed once the input is closed and every
+// goroutine has returned, so both must be drained until then, unless its Func
+// never fails or the stage's context is canceled. A canceled stage keeps draining
+// its input without processing it, so the stages before it can return too.
+type Stage[In, Out any] struct {
+	name    string
+	workers int
+	out     chan Out
+	errs    chan Error[In]
+
+	// Closed once the output and error channels are, and the handlers of Handle
+	done     chan struct{}
+	handlers sync.WaitGroup
+
+	in, emitted, failed int64
+	busy                int64
+}
+
+// Stats are the items a stage has taken, emitted and rejected so far, the time its
+// goroutines spent processing them, including waiting to emit, and how many
+// goroutines it has
+type Stats struct {
+	Name    string
+	In      int64
+	Out     int64
+	Failed  int64
+	Busy    time.Duration
+	Workers int
+}
+
+// Start starts a stage of n goroutines applying fn to the items of in until ctx is
+// canceled. Its output channel holds up to buffer items.
+func Start[In, Out any](ctx context.Context, name string, n int, buffer int, in <-chan In, fn Func[In, Out]) *Stage[In, Out] {
+	if n < 1 {
+		n = 1
+	}
+
+	s := newStage[In, Out](name, n, buffer)
+	emit := s.emitter(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for item := range in {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				atomic.AddInt64(&s.in, 1)
+				start := time.Now()
+				err := fn(ctx, item, emit)
+				atomic.AddInt64(&s.busy, int64(time.Since(start)))
+				if err != nil {
+					s.reject(ctx, item, err)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		s.close()
+	}()
+
+	return s
+}
+
+// Run starts a stage of one goroutine passing the whole of in to fn, for a stage
+// which takes its input in batches or keeps state across items, such as one writing
+// rows in their input order. Once fn returns, the rest of in is drained. An error
+// fn returns is sent on the stage's error channel with the zero item. Its stats
+// count the items fn emits but not those it takes, and it is busy for as long as
+// fn runs.
+func Run[In, Out any](ctx context.Context, name string, buffer int, in <-chan In, fn func(ctx context.Context, in <-chan In, emit func(Out)) error) *Stage[In, Out] {
+	s := newStage[In, Out](name, 1, buffer)
+	emit := s.emitter(ctx)
+
+	go func() {
+		start := time.Now()
+		err := fn(ctx, in, emit)
+		atomic.AddInt64(&s.busy, int64(time.Since(start)))
+		if err != nil {
+			var zero In
+			s.reject(ctx, zero, err)
+		}
+
+		if in != nil {
+			for range in {
+			}
+		}
+		s.close()
+	}()
+
+	return s
+}
+
+// Source starts a stage of one goroutine producing the items fn emits, such as the
+// rows of an input file, until fn returns. An error fn returns is sent on the
+// stage's error channel.
+func Source[Out any](ctx context.Context, name string, buffer int, fn func(ctx context.Context, emit func(Out)) error) *Stage[struct{}, Out] {
+	return Run(ctx, name, buffer, nil, func(ctx context.Context, _ <-chan struct{}, emit func(Out)) error {
+		return fn(ctx, emit)
+	})
+}
+
+// newStage returns a stage of n goroutines whose output channel holds up to buffer
+// items
+func newStage[In, Out any](name string, n int, buffer int) *Stage[In, Out] {
+	return &Stage[In, Out]{
+		name:    name,
+		workers: n,
+		out:     make(chan Out, buffer),
+		errs:    make(chan Error[In]),
+		done:    make(chan struct{}),
+	}
+}
+
+// emitter returns the emit function of the stage's goroutines, which drops the
+// output once ctx is canceled
+func (s *Stage[In, Out]) emitter(ctx context.Context) func(Out) {
+	return func(v Out) {
+		select {
+		case s.out <- v:
+			atomic.AddInt64(&s.emitted, 1)
+		case <-ctx.Done():
+		}
+	}
+}
+
+// reject counts item as failed and sends it on the error channel, unless ctx is
+// canceled
+func (s *Stage[In, Out]) reject(ctx context.Context, item In, err error) {
+	atomic.AddInt64(&s.failed, 1)
+	select {
+	case s.errs <- Error[In]{item, err}:
+	case <-ctx.Done():
+	}
+}
+
+// close closes the stage's channels once its goroutines have returned
+func (s *Stage[In, Out]) close() {
+	close(s.out)
+	close(s.errs)
+	close(s.done)
+}
+
+// Handle calls fn with each item the stage rejects, one at a time in a goroutine,
+// draining its error channel
+func (s *Stage[In, Out]) Handle(fn func(Error[In])) {
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+
+		for e := range s.errs {
+			fn(e)
+		}
+	}()
+}
+
+// Wait blocks until the stage has finished and its rejected items are handled
+func (s *Stage[In, Out]) Wait() {
+	<-s.done
+	s.handlers.Wait()
+}
+
+// Out returns the channel of the stage's outputs
+func (s *Stage[In, Out]) Out() <-chan Out {
+	return s.out
+}
+
+// Errors returns the channel of the items the stage rejected
+func (s *Stage[In, Out]) Errors() <-chan Error[In] {
+	return s.errs
+}
+
+// Stats returns the stage's counts so far
+func (s *Stage[In, Out]) Stats() Stats {
+	return Stats{
+		Name:    s.name,
+		In:      atomic.LoadInt64(&s.in),
+		Out:     atomic.LoadInt64(&s.emitted),
+		Failed:  atomic.LoadInt64(&s.failed),
+		Busy:    time.Duration(atomic.LoadInt64(&s.busy)),
+		Workers: s.workers,
+	}
+}
@@ -0,0 +1,305 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// items returns a channel sending 0 to n-1, closed once they are sent
+func items(n int) <-chan int {
+	in := make(chan int)
+	go func() {
+		defer close(in)
+		for i := 0; i < n; i++ {
+			in <- i
+		}
+	}()
+
+	return in
+}
+
+// waitFor fails the test if ch isn't closed within a few seconds
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s", what)
+	}
+}
+
+// The output and error channels close only once every goroutine has returned, so
+// what the goroutines wrote is visible to the stage's consumers. Run with -race.
+func TestStageClosesAfterGoroutinesReturn(t *testing.T) {
+	const n = 200
+
+	// Written by the goroutines without synchronization, each element by one of them
+	finished := make([]bool, n)
+
+	s := Start(context.Background(), "test", 8, 0, items(n), func(ctx context.Context, item int, emit func(int)) error {
+		emit(item)
+		time.Sleep(time.Millisecond)
+		finished[item] = true
+		return nil
+	})
+
+	received := 0
+	for range s.Out() {
+		received++
+	}
+	for range s.Errors() {
+		t.Error("Unexpected rejected item")
+	}
+
+	if received != n {
+		t.Errorf("Received %d outputs, want %d", received, n)
+	}
+	for i, ok := range finished {
+		if !ok {
+			t.Fatalf("Item %d was still being processed when the output channel closed", i)
+		}
+	}
+}
+
+// A stage canceled mid-stream stops processing, drains its input so the sender
+// returns, and closes its channels without its outputs being read
+func TestStageCancel(t *testing.T) {
+	const n = 10000
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan int)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(in)
+		for i := 0; i < n; i++ {
+			in <- i
+		}
+	}()
+
+	s := Start(ctx, "test", 4, 1, in, func(ctx context.Context, item int, emit func(int)) error {
+		emit(item)
+		return nil
+	})
+
+	for i := 0; i < 10; i++ {
+		<-s.Out()
+	}
+	cancel()
+
+	waitFor(t, sent, "the input to be drained")
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	waitFor(t, done, "the stage to finish")
+
+	if got := s.Stats().In; got >= n {
+		t.Errorf("Processed all %d items despite the cancellation", got)
+	}
+}
+
+// A slow consumer holds back the stage: it takes no more items than its buffer and
+// goroutines can hold, and none are lost
+func TestStageSlowConsumer(t *testing.T) {
+	const (
+		n       = 50
+		workers = 4
+		buffer  = 2
+	)
+
+	s := Start(context.Background(), "test", workers, buffer, items(n), func(ctx context.Context, item int, emit func(int)) error {
+		emit(item)
+		return nil
+	})
+
+	seen := make(map[int]bool)
+	for item := range s.Out() {
+		seen[item] = true
+		time.Sleep(time.Millisecond)
+
+		st := s.Stats()
+		if queued := st.Out - int64(len(seen)); queued > buffer {
+			t.Fatalf("%d outputs queued beyond the consumer, want at most %d", queued, buffer)
+		}
+		if ahead := st.In - int64(len(seen)); ahead > buffer+workers {
+			t.Fatalf("%d items taken beyond the consumer, want at most %d", ahead, buffer+workers)
+		}
+	}
+	s.Wait()
+
+	if len(seen) != n {
+		t.Errorf("Received %d distinct outputs, want %d", len(seen), n)
+	}
+}
+
+// Stats count the items taken, each output emitted and each item rejected
+func TestStageStats(t *testing.T) {
+	const n = 100
+	errOdd := errors.New("odd")
+
+	s := Start(context.Background(), "double", 3, n*2, items(n), func(ctx context.Context, item int, emit func(int)) error {
+		if item%2 == 1 {
+			return errOdd
+		}
+		emit(item)
+		emit(item)
+		return nil
+	})
+	s.Handle(func(Error[int]) {})
+	s.Wait()
+
+	st := s.Stats()
+	want := Stats{Name: "double", In: n, Out: n, Failed: n / 2, Workers: 3}
+	st.Busy = 0
+	if st != want {
+		t.Errorf("Stats() = %+v, want %+v", st, want)
+	}
+
+	if got := Start(context.Background(), "one", 0, 0, items(0), func(context.Context, int, func(int)) error { return nil }).Stats().Workers; got != 1 {
+		t.Errorf("Stage started with 0 goroutines has %d, want 1", got)
+	}
+}
+
+// Rejected items reach the error channel with the error which rejected them
+func TestStageErrors(t *testing.T) {
+	const n = 20
+	errOdd := errors.New("odd")
+
+	s := Start(context.Background(), "test", 4, n, items(n), func(ctx context.Context, item int, emit func(int)) error {
+		if item%2 == 1 {
+			return fmt.Errorf("Item %d: %w", item, errOdd)
+		}
+		emit(item)
+		return nil
+	})
+
+	rejected := make(map[int]bool)
+	for e := range s.Errors() {
+		if !errors.Is(e.Err, errOdd) {
+			t.Errorf("Item %d rejected with %v, want %v", e.Item, e.Err, errOdd)
+		}
+		rejected[e.Item] = true
+	}
+
+	emitted := 0
+	for item := range s.Out() {
+		if rejected[item] {
+			t.Errorf("Item %d was both emitted and rejected", item)
+		}
+		emitted++
+	}
+
+	if len(rejected) != n/2 || emitted != n/2 {
+		t.Errorf("%d items rejected and %d emitted, want %d of each", len(rejected), emitted, n/2)
+	}
+	for item := range rejected {
+		if item%2 == 0 {
+			t.Errorf("Item %d was rejected", item)
+		}
+	}
+}
+
+// Wait returns only once the handlers of Handle have handled every rejected item,
+// after the output channel is closed
+func TestStageHandleWait(t *testing.T) {
+	const n = 50
+
+	s := Start(context.Background(), "test", 4, n, items(n), func(ctx context.Context, item int, emit func(int)) error {
+		return errors.New("rejected")
+	})
+
+	// Written by the handler without synchronization, read once Wait returns
+	var handled []int
+	s.Handle(func(e Error[int]) {
+		time.Sleep(time.Millisecond)
+		handled = append(handled, e.Item)
+	})
+	s.Wait()
+
+	if len(handled) != n {
+		t.Errorf("Wait returned after %d of %d rejected items were handled", len(handled), n)
+	}
+	select {
+	case _, ok := <-s.Out():
+		if ok {
+			t.Error("Output channel holds an item after Wait")
+		}
+	default:
+		t.Error("Output channel is still open after Wait")
+	}
+}
+
+// A source emits what its function produces and reports the error it returns
+func TestSource(t *testing.T) {
+	errRead := errors.New("read")
+
+	s := Source(context.Background(), "read", 0, func(ctx context.Context, emit func(int)) error {
+		for i := 0; i < 3; i++ {
+			emit(i)
+		}
+		return errRead
+	})
+
+	var errs []error
+	s.Handle(func(e Error[struct{}]) {
+		errs = append(errs, e.Err)
+	})
+	var got []int
+	for item := range s.Out() {
+		got = append(got, item)
+	}
+	s.Wait()
+
+	if len(got) != 3 || got[0] != 0 || got[2] != 2 {
+		t.Errorf("Source emitted %v, want [0 1 2]", got)
+	}
+	if len(errs) != 1 || errs[0] != errRead {
+		t.Errorf("Source reported errors %v, want %v", errs, errRead)
+	}
+	if st := s.Stats(); st.Out != 3 || st.Failed != 1 || st.Workers != 1 {
+		t.Errorf("Stats() = %+v, want 3 out and 1 failed by 1 goroutine", st)
+	}
+}
+
+// A stage run on the whole of its input drains what its function left unread, so
+// the stage before it returns
+func TestRunDrainsInput(t *testing.T) {
+	const n = 100
+
+	in := make(chan int)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(in)
+		for i := 0; i < n; i++ {
+			in <- i
+		}
+	}()
+
+	s := Run(context.Background(), "write", 0, in, func(ctx context.Context, in <-chan int, emit func(int)) error {
+		sum := 0
+		for i := 0; i < 10; i++ {
+			sum += <-in
+		}
+		emit(sum)
+		return errors.New("write failed")
+	})
+	s.Handle(func(Error[int]) {})
+
+	if sum := <-s.Out(); sum != 45 {
+		t.Errorf("Run emitted %d, want 45", sum)
+	}
+	waitFor(t, sent, "the input to be drained")
+	s.Wait()
+
+	if st := s.Stats(); st.In != 0 || st.Out != 1 || st.Failed != 1 {
+		t.Errorf("Stats() = %+v, want 0 in, 1 out and 1 failed", st)
+	}
+}
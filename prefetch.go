@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/leonm1/airports-go"
+	"github.com/leonm1/flightsense-go/parse"
+	"github.com/leonm1/flightsense-go/pipeline"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// Number of weather lookups the prefetcher runs at once
+const prefetchConcurrency = 8
+
+// prefetcher is the function of the prefetch stage, which emits the flights of parsed
+// into the stage's buffer, where they wait for a worker. The weather of flights
+// entering the buffer is fetched in the background when it isn't cached, overlapping
+// network latency with the workers' processing. It returns once parsed is closed and
+// its lookups have finished.
+func prefetcher(ctx context.Context, parsed <-chan *Flight, emit func(*Flight)) error {
+	var hits, warmed, skipped int64
+	sem := make(chan struct{}, prefetchConcurrency)
+
+	warm := func(a airports.Airport, f *Flight) {
+		if isUnknown(a) {
+			return
+		}
+		if weather.Cached(a, f.ScheduledDep) {
+			hits++
+			return
+		}
+
+		// Leave the lookup to the worker rather than holding up the buffer
+		select {
+		case sem <- struct{}{}:
+		default:
+			skipped++
+			return
+		}
+
+		warmed++
+		go func() {
+			defer func() { <-sem }()
+			weather.Get(ctx, a, f.ScheduledDep)
+		}()
+	}
+
+	for f := range parsed {
+		warm(f.Origin, f)
+		warm(f.Destination, f)
+		emit(f)
+	}
+
+	// Wait for the lookups still running, so none outlives the input
+	for i := 0; i < prefetchConcurrency; i++ {
+		sem <- struct{}{}
+	}
+
+	if total := hits + warmed + skipped; total > 0 {
+		infof("Prefetcher: %d cache hits (%.1f%%), %d prefetched, %d left to workers",
+			hits, 100*float64(hits)/float64(total), warmed, skipped)
+	}
+
+	return nil
+}
+
+// prefetchCommand defines the flags of prefetch on fs and returns its function, which
+// fetches the weather the flights of input files need into the cache, without
+// writing any output, so that processing them later only reads the cache
+func prefetchCommand(fs *flag.FlagSet) func(args []string) {
+	fs.StringVar(sourceProfile, "source-profile", "auto", "Input column names, as for processing")
+	mapping := fs.String("source-mapping", "", "Optional: YAML file mapping the legacy input column names to the input's, as for processing")
+	fs.StringVar(overrides, "overrides", "", "Optional: CSV of airlines and airports missing from the bundled datasets, as for processing")
+	fs.BoolVar(keepUnknown, "keep-unknown", true, "Keep flights of unknown airlines and airports, as for processing")
+	fs.StringVar(inEncoding, "encoding", "utf-8", "Character encoding of the inputs, as for processing")
+	fs.StringVar(endpoints, "endpoints", "", "Optional: Comma separated Dark Sky-compatible base URLs with optional weights, as for processing")
+	fs.StringVar(apiKeyFile, "api-key-file", "", "Optional: File holding the Dark Sky API key, as for processing")
+	fs.StringVar(stations, "stations", "", "Optional: CSV of airport,station,latitude,longitude mapping airports to preferred weather stations, as for processing")
+	fs.StringVar(lockPolicy, "lock", "fail", "When another run holds the cache: 'wait' or 'fail'")
+	fs.IntVar(maxRequests, "requests", 0, "Number of weather provider requests in flight at once, as for processing")
+	opts := cacheFlags(fs)
+	config := fs.String("config", "", "Optional: YAML config file, as for processing. Settings of flags prefetch doesn't have are ignored.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense prefetch [flags] file.csv...")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) {
+		err := applyConfig(fs, *config, false)
+		check(err)
+
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if *lockPolicy == "readonly" {
+			fatalf("Prefetching needs to write to the cache, use -lock=wait or -lock=fail")
+		}
+
+		err = setupAPIKey(*apiKeyFile)
+		check(err)
+		err = checkProfile(*sourceProfile)
+		check(err)
+		err = setEncoding(*inEncoding)
+		check(err)
+		if *overrides != "" {
+			err = loadOverrides(*overrides)
+			check(err)
+		}
+		if *mapping != "" {
+			err = loadMapping(*mapping)
+			check(err)
+		}
+		if *endpoints != "" {
+			err = weather.SetEndpoints(*endpoints)
+			check(err)
+		}
+		if *stations != "" {
+			err = weather.LoadStations(*stations)
+			check(err)
+		}
+
+		releaseLocks := acquireLocks(*lockPolicy, opts.path(), "")
+		closeCache := opts.load()
+		shutdown := onShutdown(closeCache, releaseLocks)
+		defer shutdown()
+
+		needed := make(map[string]neededHour)
+		for _, in := range args {
+			err := scanHours(in, needed)
+			check(err)
+		}
+		stopTuning := setupConcurrency()
+		calls, missing := prefetchHours(needed)
+		stopTuning()
+		if canceled() {
+			stopped(shutdown)
+		}
+
+		infof("Prefetched the weather of %d airport-hours with %d lookups, %d of which had no data",
+			len(needed), calls, missing)
+		logUsage(weather.Usage())
+	}
+}
+
+// neededHour is an hour at an airport whose weather a flight needs
+type neededHour struct {
+	airport airports.Airport
+	hour    time.Time
+}
+
+// scanHours adds the airport-hours the flights of an input need to needed, keyed
+// by their cache keys. Rows which cannot be read or parsed are skipped.
+func scanHours(filename string, needed map[string]neededHour) error {
+	f, err := openInput(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := newReader(f, filename)
+	h, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("Cannot read header of '%s': %s", filename, err)
+	}
+	h, err = mapHeader(append([]string(nil), h...))
+	if err != nil {
+		return fmt.Errorf("Cannot read '%s': %s", filename, err)
+	}
+	cols := parse.NewIndex(h)
+
+	for seq := 0; ; seq++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		fl, err := parseFlight(&inputRow{seq: seq, fields: row}, cols)
+		if err != nil {
+			continue
+		}
+
+		hour := fl.ScheduledDep.Round(time.Hour)
+		for _, a := range []airports.Airport{fl.Origin, fl.Destination} {
+			if !isUnknown(a) {
+				needed[weather.Key(a.IATA, hour)] = neededHour{a, hour}
+			}
+		}
+	}
+}
+
+// prefetchHours fetches the weather of the needed airport-hours which aren't cached,
+// returning the number of lookups made and how many the provider had no data for. A
+// provider call caches a whole day, so the hours of each airport are fetched in
+// order, each airport in its own goroutine, with -requests of them fetching at once.
+func prefetchHours(needed map[string]neededHour) (int, int) {
+	byAirport := make(map[string][]neededHour)
+	for _, n := range needed {
+		byAirport[n.airport.IATA] = append(byAirport[n.airport.IATA], n)
+	}
+
+	// The hours of each airport are fetched in order by one goroutine of the stage,
+	// which emits whether the provider had data for each hour it requested
+	queue := make(chan []neededHour)
+	fetch := pipeline.Start(runCtx, "prefetch", concurrencyLimit, 0, queue, func(ctx context.Context, hours []neededHour, emit func(bool)) error {
+		for _, n := range hours {
+			if weather.Cached(n.airport, n.hour) {
+				continue
+			}
+
+			_, err := weather.Get(ctx, n.airport, n.hour)
+			if err != nil && err != weather.ErrNoData {
+				fail("Could not get weather for %s on %s: %s", n.airport.IATA, n.hour, err)
+				return nil
+			}
+			emit(err == nil)
+		}
+
+		return nil
+	})
+	go func() {
+		for _, hours := range byAirport {
+			sort.Slice(hours, func(i, j int) bool { return hours[i].hour.Before(hours[j].hour) })
+			queue <- hours
+		}
+		close(queue)
+	}()
+
+	var calls, missing int
+	for found := range fetch.Out() {
+		calls++
+		if !found {
+			missing++
+		}
+	}
+
+	return calls, missing
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/csv"
+	"time"
+
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// scanNeeded reads the origin, destination and date of every row in the input files
+// and returns a cache key filter accepting only the airports and days they need
+func scanNeeded(files []string) func(key string) bool {
+	needed := make(map[string]bool)
+
+	for _, filename := range files {
+		f, err := openInput(filename)
+		if err != nil {
+			fatalf("Cannot open '%s': %s\n", filename, err.Error())
+		}
+
+		r := newReader(f, filename)
+		h, err := r.Read()
+		check(err)
+		h, err = mapHeader(h)
+		if err != nil {
+			fatalf("Cannot read '%s': %s", filename, err)
+		}
+
+		cols := make(map[string]int)
+		for i, c := range h {
+			cols[c] = i
+		}
+		date, origin, dest := cols["FL_DATE"], cols["ORIGIN"], cols["DEST"]
+
+		for {
+			row, err := r.Read()
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+			if err != nil {
+				break
+			}
+
+			d, err := time.Parse("2006-01-02", row[date])
+			if err != nil {
+				continue
+			}
+
+			// Local dates span two UTC days, and departures may be on the next day
+			for _, day := range []time.Time{d.AddDate(0, 0, -1), d, d.AddDate(0, 0, 1), d.AddDate(0, 0, 2)} {
+				needed[row[origin]+"|"+day.Format("2006-01-02")] = true
+				needed[row[dest]+"|"+day.Format("2006-01-02")] = true
+			}
+		}
+		f.Close()
+	}
+	infof("Preloading cache entries for %d airport-days", len(needed))
+
+	return func(key string) bool {
+		iata, t, ok := weather.ParseKey(key)
+		if !ok {
+			// Legacy keys can't be attributed, so keep them
+			return true
+		}
+
+		return needed[iata+"|"+t.UTC().Format("2006-01-02")]
+	}
+}
@@ -1,421 +1,1411 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/leonm1/airlines-go"
 	"github.com/leonm1/airports-go"
 	"github.com/leonm1/flightsense-go/cache"
+	"github.com/leonm1/flightsense-go/metrics"
+	"github.com/leonm1/flightsense-go/output"
+	"github.com/leonm1/flightsense-go/parse"
+	"github.com/leonm1/flightsense-go/pipeline"
 	"github.com/leonm1/flightsense-go/weather"
 )
 
 const (
 	concurrencyLimit = 32
+
+	// Bounds for the automatically sized input buffer
+	minReadBuffer = 64 << 10
+	maxReadBuffer = 8 << 20
+
+	// Number of rows the automatically sized input buffer should hold
+	rowsPerReadBuffer = 512
 )
 
-var header = []string{"absoluteTime",
-	"year",
-	"month",
-	"day",
-	"airline",
-	"originAirport",
-	"destAirport",
-	"scheduledDeparture",
-	"actualDeparture",
-	"delay",
-	"cancelled",
-	"cancellationCode",
-	"diverted",
-	"tempOrigin",
-	"precipTypeOrigin",
-	"precipIntensityOrigin",
-	"tempDest",
-	"precipTypeDest",
-	"precipIntensityDest",
-}
+var (
+	// The inputs and output directory, which only processing has
+	inName, inDir, outDir, recursive, include, exclude = inputFlags()
 
-// Flight includes data relating to weather conditions and general flight information
+	cacheOpts     = cacheFlags(flag.CommandLine)
+	configFile    = flag.String("config", "", "Optional: YAML file of flag values in input, output, provider, cache, concurrency, filters and columns sections, which flags given on the command line override (default "+configName+" if it exists)")
+	readBuffer    = flag.Int("read-buffer", 0, "Size in bytes of the input read buffer (0 sizes it from the width of the input rows)")
+	readAheadSize = flag.Int("read-ahead", 4<<20, "Size in bytes of each input read and decompressed ahead of the CSV reader in the background, overlapping disk reads with processing (0 disables read-ahead)")
+	reuseRecord   = flag.Bool("reuse-record", true, "Reuse the CSV reader's record slice between rows to reduce allocations")
+	prices        = flag.String("price", "", "Estimated USD price per request for weather providers, e.g. 'darksky=0.0001'")
+	ledger        = flag.String("ledger", "ledger.csv", "Cumulative ledger of weather provider usage (empty to disable)")
+	project       = flag.String("project", "", "Project name recorded in the usage ledger")
+	preload       = flag.Bool("preload-filter", false, "Scan the input files first and only load cache entries for the airports and dates they contain")
+	metricsFile   = flag.String("metrics", "", "Optional: Write latency metrics as JSON to this file at the end of the run")
+	cpuProfile    = flag.String("cpuprofile", "", "Optional: Write a CPU profile of the run to this file, for 'go tool pprof'")
+	memProfile    = flag.String("memprofile", "", "Optional: Write a memory profile of the run to this file at the end of the run, for 'go tool pprof'")
+	traceFile     = flag.String("trace", "", "Optional: Write an execution trace of the run to this file, for 'go tool trace', showing where goroutines wait on parsing, the cache and the network")
+	endpoints     = flag.String("endpoints", "", "Optional: Comma separated Dark Sky-compatible base URLs with optional weights, e.g. 'https://proxy.example.com/forecast/=3,https://api.darksky.net/forecast/=1'")
+	apiKeyFile    = flag.String("api-key-file", "", "Optional: File holding the Dark Sky API key (default DARK_SKY_API_KEY from the environment or .env, then "+apiKeySecret+")")
+	lookahead     = flag.Int("prefetch", 0, "Number of parsed flights to look ahead of the workers, fetching their weather in the background when it isn't cached (0 disables prefetching)")
+	negativeTTL   = flag.Duration("negative-ttl", 10*time.Minute, "How long to remember airport/hours the weather provider had no data for (0 to always retry)")
+	stations      = flag.String("stations", "", "Optional: CSV of airport,station,latitude,longitude mapping airports to preferred weather stations")
+	format        = flag.String("format", "csv", "Output format: "+strings.Join(output.Names(), ", "))
+	lockPolicy    = flag.String("lock", "fail", "When another run holds the cache or output directory: 'wait', 'fail', or 'readonly' (continue without saving to the cache)")
+	columnList    = flag.String("columns", "", "Optional: Comma separated output columns, in order (default all the columns of the -schema-version)")
+	schemaVer     = flag.Int("schema-version", 1, "Output schema version: 1 for the legacy 19 columns, or 2 (FlightV2) adding the arrival, delay cause, route, calendar, typed time and weather provenance columns")
+	outFile       = flag.String("o", "", "Optional: Write the flights of every input to this file instead of the output directory; '-' streams them to standard output and logs to standard error")
+	database      = flag.String("output", "", "Optional: Write the flights of every input into a database table instead of files: a postgres:// URL or a SQLite file (.db, .sqlite)")
+	inEncoding    = flag.String("encoding", "utf-8", "Character encoding of the inputs, e.g. 'latin1' or 'windows-1252', transcoded to UTF-8. Byte order marks are dropped.")
+	inDelimiter   = flag.String("input-delimiter", "auto", "Field delimiter of csv inputs: a single character, 'tab', 'semicolon', 'pipe' or 'comma', or 'auto' to sniff it from the first line")
+	noHeader      = flag.Bool("no-header", false, "Csv inputs have no header row, and their columns are named in order by -input-columns. Inputs whose first row holds a YYYY-MM-DD date are read this way without it.")
+	inputColumns  = flag.String("input-columns", strings.Join(parse.Columns, ","), "Comma separated names of the columns of csv inputs without a header row, in order")
+	delimiter     = flag.String("delimiter", ",", "Field delimiter of csv output: a single character, or 'tab', 'semicolon', 'pipe' or 'comma'")
+	quoteStyle    = flag.String("quote", "minimal", "Which csv output fields are quoted: 'minimal' (only those which need it), 'all' or 'none'")
+	crlf          = flag.Bool("crlf", false, "End csv output lines with CRLF instead of LF")
+	compress      = flag.Bool("compress", false, "Gzip the csv and jsonl output files, adding .gz to their names")
+	appendOut     = flag.Bool("append", false, "Add rows to existing output files instead of replacing them")
+	skipExist     = flag.Bool("skip-existing", false, "Skip inputs whose output file already exists")
+	partitionBy   = flag.String("partition", "", "Optional: Split each output into Hive-style directories by 'month' (year=YYYY/month=MM) or 'airline' (airline=XX)")
+	ordered       = flag.Bool("ordered", false, "Write rows in the order of the input rows rather than as they finish enriching")
+	flushInterval = flag.Duration("flush-interval", time.Second, "How often csv and jsonl output files are flushed to disk while rows are written, so they can be read during the run (0 only flushes them when they are closed)")
+	writeRejects  = flag.Bool("rejects", true, "Write input rows which fail parsing or weather lookup, with the reason, to <name>.rejects.csv in the output directory")
+	verify        = flag.Bool("verify", false, "Re-read each output file after writing it and fail the run if it doesn't match what was written")
+	schemaFile    = flag.String("schema", "", "Optional: Write the schema of each output file beside it, as 'jsonschema' (<name>.schema.json) or 'avro' (<name>.avsc)")
+	maxRows       = flag.Int("max-rows-per-file", 0, "Optional: Roll each output file over to numbered part files (<name>/part-0001.csv, ...) of at most this many rows")
+	maxSize       = flag.Int("max-output-size", 0, "Optional: Roll each output file over to numbered part files once a part reaches about this many MiB")
+	dedupeMode    = flag.String("dedupe", "", "Optional: 'drop' flights already seen earlier in the run, by date, airline, airports, scheduled departure and flight number, or 'flag' them in a duplicate column")
+	offset        = flag.Int("offset", 0, "Optional: Skip this many rows at the start of each input")
+	limit         = flag.Int("limit", 0, "Optional: Process at most this many rows of each input (0 for all)")
+	sample        = flag.Float64("sample", 1, "Optional: Process a random fraction of the rows of each input, e.g. 0.01")
+	sampleSeed    = flag.Int64("sample-seed", 1, "Seed choosing the rows processed by -sample")
+	filterCarrier = flag.String("filter-carrier", "", "Optional: Only process flights of these comma separated airlines, e.g. 'DL,AA'")
+	filterOrigin  = flag.String("filter-origin", "", "Optional: Only process flights from these comma separated airports")
+	filterDest    = flag.String("filter-dest", "", "Optional: Only process flights to these comma separated airports")
+	filterRoute   = flag.String("filter-route", "", "Optional: Only process flights on these comma separated routes, e.g. 'ATL-JFK,JFK-LAX'")
+	filterDate    = flag.String("filter-date", "", "Optional: Only process flights scheduled to depart within FROM:TO (inclusive local dates, either may be left empty), e.g. '2017-01-01:2017-03-31'")
+	progressEvery = flag.Duration("progress", 30*time.Second, "How often to log the rows processed, rate, cache hit rate and time remaining of each input, which are also shown in place on a terminal (0 to only show them)")
+	parallelFiles = flag.Int("parallel-files", 1, "Number of input files enriched at once, sharing the weather cache, -c parsers and -requests")
+	deterministic = flag.Bool("deterministic", false, "Make the output depend only on the inputs, settings and weather cache: implies -ordered, sends every request to the first of -endpoints without failing over, remembers lookups with no weather for the whole run, keeps the first of duplicate flights in input order, writes rejected rows in input order and records every setting in the manifest")
+	splitChunks   = flag.Int("split", 0, "Optional: Split each uncompressed csv input file into up to this many chunks of lines, enriched at once into their own output files which are joined in order at the end. Quoted fields must not hold line breaks.")
+	parserCount   = flag.Int("c", 0, "Number of rows parsed at once across the inputs (0 starts at the number of CPUs and tunes it while the run has spare CPU)")
+	maxMemory     = flag.Int("max-memory", 0, "Optional: Keep the run's memory under about this many MiB, by bounding the rows in flight, reading a file cache's entries from disk as they are used, and collecting garbage sooner")
+	maxRequests   = flag.Int("requests", 0, "Number of weather provider requests in flight at once (0 starts at 8 and tunes it while lookups wait on requests, backing off when the provider slows down)")
+	watch         = flag.Bool("watch", false, "After processing the inputs, keep watching -indir and process input files as they appear, moving each to <indir>/done/ once processed. Runs until interrupted.")
+	strict        = flag.Bool("strict", false, "Abort the run on the first input row which can't be read or parsed")
+	lenient       = flag.Bool("lenient", false, "Skip and count input rows which can't be read or parsed (the default)")
+	maxErrors     = flag.Int("max-errors", 0, "Optional: Skip input rows which can't be read or parsed, aborting the run once there are more than this many")
+	keepUnknown   = flag.Bool("keep-unknown", true, "Keep flights of airlines and airports missing from the bundled datasets and -overrides, named 'unknown'. Unknown airports have no weather. When false such flights are rejected.")
+	overrides     = flag.String("overrides", "", "Optional: CSV of airlines and airports missing from the bundled datasets, with the header type,iata,name,latitude,longitude,tz")
+	resume        = flag.Bool("resume", false, "Checkpoint progress to .flightsense-checkpoint.json in the output directory and continue from the checkpoint of an interrupted run, skipping the rows it wrote. Implies -ordered; csv and jsonl files only.")
+	sourceProfile = flag.String("source-profile", "auto", "Input column names: 'legacy', 'unique-carrier' or 'op-unique-carrier' (BTS table builder exports before and since 2018), 'prezip' (the monthly zips downloaded by fetch), or 'auto' to pick the first matching each input's header")
+	sourceMapping = flag.String("source-mapping", "", "Optional: YAML file mapping the legacy input column names to an input's, e.g. 'CARRIER: OP_UNIQUE_CARRIER', applied over the -source-profile")
+	xlsxSummary   = flag.Bool("xlsx-summary", false, "Add a sheet to xlsx output with the number of flights and mean delay of each airline")
+	logLevelName  = flag.String("log-level", "info", "Least severe log messages written: 'debug', 'info', 'warn' or 'error'")
+	logFile       = flag.String("log-file", "", "Log file, also written to the console (default log.txt in the output directory, 'none' to only log to the console)")
+	logMaxSize    = flag.Int("log-max-size", 100, "Rotate the log file once it reaches this many MiB (0 never rotates)")
+	logBackups    = flag.Int("log-backups", 3, "Number of rotated log files kept, as <log-file>.1 (newest) to <log-file>.N")
+	quiet         = flag.Bool("quiet", false, "Only log warnings and errors, as -log-level=warn")
+	verbose       = flag.Bool("v", false, "Log debug messages too, as -log-level=debug, including every cache miss and skipped row rather than their counts")
+	logJSON       = flag.Bool("log-json", false, "Write the log as JSON objects, one per line, instead of key=value text")
+	runSummaryOut = flag.String("run-summary", "", "Optional: Write a JSON summary of the run (status, exit code, rows in and out, rejected, filtered, API calls, duration) to this file. Runs exit with 3 when rows were rejected or malformed.")
+	manifestOut   = flag.Bool("manifest", true, "Write manifest.json to the output directory, listing each output file with its row count, SHA-256, inputs, and the tool version and weather provider settings")
+	required      = flag.String("required", "absoluteTime,year,month,day,airline,originAirport,destAirport,scheduledDeparture", "Comma separated columns which must be non-empty in every row when verifying")
+)
+
+// Flight includes data relating to weather conditions and general flight information.
+// The out tags define the output columns, in order: the column name followed by an
+// optional conversion of the field's value, from=Field to take the value of another
+// field, unit=U to record the unit of numeric values, key for the columns
+// identifying a flight, and since=N for columns added in output schema version N.
+// Blank fields add further columns derived from other fields.
 type Flight struct {
-	Date                  string           `json:"fullDate" csv:"FL_DATE"`
-	Carrier               airlines.Airline `json:"carrier" csv:"CARRIER"`
-	Origin                airports.Airport `json:"origin" csv:"ORIGIN"`
-	Destination           airports.Airport `json:"destination" csv:"DEST"`
-	ScheduledDep          time.Time        `json:"scheduledDep" csv:"CRS_DEP_TIME"`
-	ActualDep             time.Time        `json:"actualDep" csv:"DEP_TIME"`
-	Delay                 int              `json:"delay" csv:"DEP_DELAY"`
-	Cancelled             bool             `json:"cancelled" csv:"CANCELLED"`
-	CancellationCode      string           `json:"cancellationCode" csv:"CANCELLATION_CODE"`
-	Diverted              bool             `json:"diverted" csv:"DIVERTED"`
+	Date                  time.Time        `json:"fullDate" csv:"FL_DATE" out:"absoluteTime,date,key"`
+	_                     struct{}         `out:"year,year,from=Date"`
+	_                     struct{}         `out:"month,month,from=Date"`
+	_                     struct{}         `out:"day,day,from=Date"`
+	Carrier               airlines.Airline `json:"carrier" csv:"CARRIER" out:"airline,name,key"`
+	Origin                airports.Airport `json:"origin" csv:"ORIGIN" out:"originAirport,iata,key"`
+	Destination           airports.Airport `json:"destination" csv:"DEST" out:"destAirport,iata,key"`
+	ScheduledDep          time.Time        `json:"scheduledDep" csv:"CRS_DEP_TIME" out:"scheduledDeparture,hhmm,key"`
+	ActualDep             time.Time        `json:"actualDep" csv:"DEP_TIME" out:"actualDeparture,hhmm"`
+	Delay                 int              `json:"delay" csv:"DEP_DELAY" out:"delay,unit=minutes"`
+	Cancelled             bool             `json:"cancelled" csv:"CANCELLED" out:"cancelled"`
+	CancellationCode      string           `json:"cancellationCode" csv:"CANCELLATION_CODE" out:"cancellationCode"`
+	Diverted              bool             `json:"diverted" csv:"DIVERTED" out:"diverted"`
+	Duplicate             bool             `json:"duplicate" out:"duplicate"`
 	DaylightSavings       string           `json:"dst" csv:"DST"`
-	TempOrigin            float64          `json:"tempOrigin" csv:"TEMP_ORIG"`
-	PrecipIntensityOrigin float64          `json:"originPrecipIntensity" csv:"PRECIP_ORIG"`
-	PrecipTypeOrigin      string           `json:"originPrecipType" csv:"PRECIP_TYPE_ORIG"`
-	TempDest              float64          `json:"destTemp" csv:"TEMP_DEST"`
-	PrecipIntensityDest   float64          `json:"destPrecipIntensity" csv:"PRECIP_DEST"`
-	PrecipTypeDest        string           `json:"destPrecipType" csv:"PRECIP_TYPE_DEST"`
+	TempOrigin            float64          `json:"tempOrigin" csv:"TEMP_ORIG" out:"tempOrigin,unit=degF"`
+	PrecipTypeOrigin      string           `json:"originPrecipType" csv:"PRECIP_TYPE_ORIG" out:"precipTypeOrigin"`
+	PrecipIntensityOrigin float64          `json:"originPrecipIntensity" csv:"PRECIP_ORIG" out:"precipIntensityOrigin,unit=in/h"`
+	TempDest              float64          `json:"destTemp" csv:"TEMP_DEST" out:"tempDest,unit=degF"`
+	PrecipTypeDest        string           `json:"destPrecipType" csv:"PRECIP_TYPE_DEST" out:"precipTypeDest"`
+	PrecipIntensityDest   float64          `json:"destPrecipIntensity" csv:"PRECIP_DEST" out:"precipIntensityDest,unit=in/h"`
+	ArrivalDelay          int              `json:"arrDelay" csv:"ARR_DELAY" out:"arrivalDelay,unit=minutes,since=2"`
+	TaxiOut               int              `json:"taxiOut" csv:"TAXI_OUT" out:"taxiOut,unit=minutes,since=2"`
+	TaxiIn                int              `json:"taxiIn" csv:"TAXI_IN" out:"taxiIn,unit=minutes,since=2"`
+	WheelsOff             time.Time        `json:"wheelsOff" csv:"WHEELS_OFF" out:"wheelsOff,hhmm,since=2"`
+	AirTime               int              `json:"airTime" csv:"AIR_TIME" out:"airTime,unit=minutes,since=2"`
+	Distance              float64          `json:"distance" csv:"DISTANCE" out:"distance,unit=miles,since=2"`
+	CarrierDelay          int              `json:"carrierDelay" csv:"CARRIER_DELAY" out:"carrierDelay,unit=minutes,since=2"`
+	WeatherDelay          int              `json:"weatherDelay" csv:"WEATHER_DELAY" out:"weatherDelay,unit=minutes,since=2"`
+	NASDelay              int              `json:"nasDelay" csv:"NAS_DELAY" out:"nasDelay,unit=minutes,since=2"`
+	SecurityDelay         int              `json:"securityDelay" csv:"SECURITY_DELAY" out:"securityDelay,unit=minutes,since=2"`
+	LateAircraftDelay     int              `json:"lateAircraftDelay" csv:"LATE_AIRCRAFT_DELAY" out:"lateAircraftDelay,unit=minutes,since=2"`
+	FlightNumber          string           `json:"flightNumber" csv:"FL_NUM" out:"flightNumber,key,since=2"`
+	TailNumber            string           `json:"tailNumber" csv:"TAIL_NUM" out:"tailNumber,since=2"`
+	RouteDistance         float64          `json:"routeDistance" out:"routeDistance,unit=miles,since=2"`
+	Bearing               float64          `json:"bearing" out:"bearing,unit=degrees,since=2"`
+	WeatherProviderOrigin string           `json:"weatherProviderOrigin" out:"weatherProviderOrigin,since=2"`
+	WeatherCachedOrigin   bool             `json:"weatherCachedOrigin" out:"weatherCachedOrigin,since=2"`
+	WeatherTimeOrigin     time.Time        `json:"weatherTimeOrigin" out:"weatherTimeOrigin,since=2"`
+	StationDistOrigin     float64          `json:"stationDistanceOrigin" out:"stationDistanceOrigin,unit=miles,since=2"`
+	WeatherProviderDest   string           `json:"weatherProviderDest" out:"weatherProviderDest,since=2"`
+	WeatherCachedDest     bool             `json:"weatherCachedDest" out:"weatherCachedDest,since=2"`
+	WeatherTimeDest       time.Time        `json:"weatherTimeDest" out:"weatherTimeDest,since=2"`
+	StationDistDest       float64          `json:"stationDistanceDest" out:"stationDistanceDest,unit=miles,since=2"`
+
+	// Index and fields of the flight's row in the input file
+	seq   int
+	input []string
+
+	// Departure times in Local Standard Time, as published by ASPM
+	_ struct{} `out:"scheduledDepartureLST,lst,from=ScheduledDep,since=2"`
+	_ struct{} `out:"actualDepartureLST,lst,from=ActualDep,since=2"`
+
+	// Departure instants, carrying their UTC offsets, and in UTC
+	_ struct{} `out:"scheduledDepartureTime,from=ScheduledDep,since=2"`
+	_ struct{} `out:"actualDepartureTime,from=ActualDep,since=2"`
+	_ struct{} `out:"scheduledDepartureUTC,utc,from=ScheduledDep,since=2"`
+	_ struct{} `out:"actualDepartureUTC,utc,from=ActualDep,since=2"`
+
+	// Calendar features of the scheduled local departure
+	_ struct{} `out:"dayOfWeek,weekday,from=ScheduledDep,since=2"`
+	_ struct{} `out:"weekend,weekend,from=ScheduledDep,since=2"`
+	_ struct{} `out:"holiday,holiday,from=ScheduledDep,since=2"`
+	_ struct{} `out:"daysToHoliday,holidaydays,from=ScheduledDep,unit=days,since=2"`
+	_ struct{} `out:"hourBucket,hourbucket,from=ScheduledDep,since=2"`
+}
+
+// console is the terminal half of the log, which moves to standard error when
+// output is streamed to standard output
+type console struct{}
+
+func (console) Write(p []byte) (int, error) {
+	// Clear the progress line, which is redrawn after the log line
+	if atomic.LoadInt32(&progressShown) == 1 {
+		fmt.Fprint(consoleFile(), "\r\033[K")
+	}
+
+	return consoleFile().Write(p)
 }
 
 func check(e error) {
 	if e != nil {
-		log.Fatal(e)
+		fatalf("%s", e)
 	}
 }
 
 func main() {
-	// Create log file and direct output to file and console
-	logFile, err := os.Create("log.txt")
-	if err != nil {
-		log.Fatal(err)
+	flag.Usage = usage
+
+	root := newRootCommand()
+	root.SetArgs(longFlags(root, os.Args[1:]))
+	if err := root.Execute(); err != nil {
+		os.Exit(exitUsage)
 	}
-	logW := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(logW)
+}
+
+// runProcess enriches the input files selected by the processing flags, once parsed
+func runProcess() {
+	start := time.Now()
+
+	// Log to the console until the output directory is known
+	log.SetOutput(console{})
 
 	// Load files
-	files, filenames, outPath := parseArguments()
+	files, filenames, outPath, watched := parseArguments()
 
-	// Load environment vars (DARK_SKY_API_KEY)
-	err = godotenv.Load(".env")
-	if err != nil {
-		log.Fatal("Client secrets not found. Please configure dotenv")
+	// Log to the console and the log file, in the output directory by default
+	var logW io.Writer = console{}
+	if *logFile != "none" {
+		name := *logFile
+		if name == "" {
+			name = filepath.Join(*outPath, "log.txt")
+		}
+		f, err := createLog(name, int64(*logMaxSize)<<20, *logBackups)
+		if err != nil {
+			fatalf("Cannot create log file: %s", err)
+		}
+		logW = io.MultiWriter(console{}, f)
+	}
+	level := *logLevelName
+	switch {
+	case *quiet && *verbose:
+		fatalf("-quiet and -v cannot be used together")
+	case *quiet:
+		level = "warn"
+	case *verbose:
+		level = "debug"
+	}
+	err := setupLogging(logW, level, *logJSON)
+	check(err)
+
+	// Profiles cover the run up to closing the cache, which writes it to disk
+	stopProfiles := startProfiles()
+
+	err = setupAPIKey(*apiKeyFile)
+	check(err)
+
+	// Output columns
+	err = setSchemaVersion(*schemaVer)
+	check(err)
+	err = setupDedupe(*dedupeMode)
+	check(err)
+	err = selectColumns(*columnList)
+	check(err)
+
+	// Rows processed of each input
+	err = checkSubset()
+	check(err)
+	err = setupFilter()
+	check(err)
+
+	// Input column names
+	err = checkProfile(*sourceProfile)
+	check(err)
+	if *sourceMapping != "" {
+		err = loadMapping(*sourceMapping)
+		check(err)
+	}
+
+	// Columns checked by -verify
+	requiredCols, err := parseRequired(*required)
+	check(err)
+
+	// Lock the cache file and output directory against concurrent runs
+	releaseLocks := acquireLocks(*lockPolicy, cacheOpts.path(), *outPath)
+
+	// Preferred weather stations, which name the cache entries of their airports
+	if *stations != "" {
+		err = weather.LoadStations(*stations)
+		check(err)
+	}
+
+	// Restrict the cache to the entries the inputs need
+	if *preload && len(*files) > 0 && ((*files)[0] == stdin || isURL((*files)[0])) {
+		fatalf("-preload-filter cannot scan standard input or a URL ahead of processing it")
+	}
+	if *preload {
+		cachemap.SetFilter(scanNeeded(*files))
 	}
 
+	setupMemory()
+
 	// Load weather data cache
-	err = cachemap.Load("cache.txt")
-	if err != nil {
-		log.Fatal(err)
+	closeCache := cacheOpts.load()
+
+	// Close the cache, stop the profiles and release the locks on exit, including
+	// when interrupted
+	shutdown := onShutdown(closeCache, stopProfiles, releaseLocks)
+	defer shutdown()
+
+	// Weather provider pricing
+	err = parsePrices(*prices)
+	check(err)
+
+	// Self-hosted weather endpoints
+	if *endpoints != "" {
+		err = weather.SetEndpoints(*endpoints)
+		check(err)
+		weather.StartHealthChecks(30 * time.Second)
 	}
 
-	for i, in := range *files {
-		log.Printf("Processing %s to %s", in, *outPath+(*filenames)[i])
-		readFile(in, *outPath+(*filenames)[i])
+	// Deterministic runs ask one endpoint, and a lookup which had no weather has none
+	// for the rest of the run rather than depending on when it's retried
+	if *deterministic {
+		weather.PinEndpoint()
+		*negativeTTL = 100 * 365 * 24 * time.Hour
 	}
+	weather.SetNegativeTTL(*negativeTTL)
 
-}
+	err = checkErrorMode()
+	check(err)
 
-func readFile(infilename string, outfilename string) {
-	var wg sync.WaitGroup
-	printc := make(chan *[]string)
-	jobs := make(chan *Flight)
-	rowc := make(chan *[]string)
+	if *overrides != "" {
+		err = loadOverrides(*overrides)
+		check(err)
+	}
 
-	// Create CSV reader
-	infile, err := os.Open(infilename)
-	if err != nil {
-		log.Fatalf("Cannot open '%s': %s\n", infilename, err.Error())
+	if *appendOut && *skipExist {
+		fatalf("-append and -skip-existing cannot be used together")
 	}
-	defer infile.Close()
-	r := csv.NewReader(infile)
+	output.SetAppend(*appendOut)
 
-	// Read header row
-	header, err := r.Read()
+	comma, err := parseDelimiter(*delimiter)
+	check(err)
+	err = setEncoding(*inEncoding)
 	check(err)
+	if *inDelimiter != "auto" {
+		inputComma, err = parseDelimiter(*inDelimiter)
+		check(err)
+	}
+	q, err := parseQuoting(*quoteStyle)
+	check(err)
+	output.SetCSVDialect(comma, q, *crlf)
+	output.SetAvroSchema(schemaName(), avroNamespace, version)
+	if *xlsxSummary {
+		output.SetXLSXSummary("airline", "delay")
+	}
+
+	switch *partitionBy {
+	case "", "month", "airline":
+	default:
+		fatalf("Unknown partitioning '%s'", *partitionBy)
+	}
 
-	// Start writer thread
-	go printer(printc, &outfilename, &wg)
+	if *outFile != "" && *database != "" {
+		fatalf("-o and -output cannot be used together")
+	}
+	if *outFile == output.Stdout && (*partitionBy != "" || *verify) {
+		fatalf("Output streamed to standard output cannot be partitioned or verified")
+	}
+	if rotating() && (*outFile != "" || *database != "" || *appendOut) {
+		fatalf("-max-rows-per-file and -max-output-size cannot be used with -o, -output or -append")
+	}
 
-	// Start worker threads
-	for w := 0; w < concurrencyLimit; w++ {
-		go parser(rowc, jobs, &header, &wg)
-		go worker(jobs, printc)
+	if *parallelFiles > 1 && (*outFile != "" || *database != "" || *resume) {
+		fatalf("-parallel-files cannot be used with -o, -output or -resume")
+	}
+	if *splitChunks > 1 {
+		if *outFile != "" || *database != "" || *resume || *appendOut {
+			fatalf("-split cannot be used with -o, -output, -resume or -append")
+		}
+		if *format != "csv" && *format != "jsonl" || *compress || *partitionBy != "" || rotating() {
+			fatalf("-split needs csv or jsonl output, without -compress, -partition or rotated output")
+		}
+		if *offset > 0 || *limit > 0 || *sample < 1 {
+			fatalf("-split cannot be used with -offset, -limit or -sample, which count the rows of whole inputs")
+		}
 	}
 
-	// Iterate through file
-	for row, err := r.Read(); err == nil; row, err = r.Read() {
-		wg.Add(1)
-		rowc <- &row
+	// Deterministic runs write rows in input order. Duplicates are kept in input order
+	// by parsing each input's rows one at a time, which inputs enriched at once would
+	// undo.
+	if *deterministic {
+		if *dedupeMode != "" && (*parallelFiles > 1 || *splitChunks > 1) {
+			fatalf("-deterministic -dedupe cannot be used with -parallel-files or -split")
+		}
+		*ordered = true
 	}
 
-	wg.Wait()
-	close(jobs)
-}
+	// Resumed runs append to the output they were interrupted writing
+	if *resume {
+		if *database != "" || *format != "csv" && *format != "jsonl" {
+			fatalf("-resume needs csv or jsonl file output")
+		}
+		if *outFile == output.Stdout || *compress || rotating() {
+			fatalf("-resume cannot be used with standard output, -compress or rotated output")
+		}
+		*ordered = true
 
-func parser(rowc chan *[]string, jobs chan *Flight, h *[]string, wg *sync.WaitGroup) {
-	var (
-		r   *[]string
-		f   Flight
-		err error
-	)
+		err := loadCheckpoint(*outPath)
+		check(err)
+	}
 
-	skip := func() {
-		log.Printf("Skipping line: %s because of error:%s", *r, err)
-		wg.Done()
+	if *schemaFile != "" {
+		if _, err := schema(*schemaFile); err != nil {
+			fatalf("%s", err)
+		}
 	}
 
-	for r = range rowc {
-		values := make(map[string]string)
+	// Database output replaces the output files
+	if *database != "" {
+		*format, err = databaseFormat(*database)
+		check(err)
+	}
 
-		// Initialize values into map
-		for i, v := range *h {
-			values[v] = (*r)[i]
+	outs := newOutputs()
+	// process enriches input i, adding its output files to outs
+	process := func(i int, in string) {
+		name := outputName(*outPath, (*filenames)[i])
+		if *skipExist && *database == "" {
+			existing := name
+			if rotating() {
+				existing = partName(name, 1)
+			}
+			if _, err := os.Stat(existing); err == nil {
+				infof("Skipping %s, '%s' already exists", in, existing)
+				return
+			}
 		}
 
-		// Date
-		f.Date = values["FL_DATE"]
+		if *database != "" {
+			name = *database
+			infof("Processing %s into the %s database", in, *format)
+		} else if *outFile != "" {
+			name = *outFile
+			infof("Processing %s to %s", in, name)
+		} else {
+			infof("Processing %s to %s", in, name)
+		}
 
-		// Carrier airline struct
-		carrier, err := airlines.LookupIATA(values["CARRIER"])
-		if err != nil {
-			skip()
-			continue
+		// Progress through the input made by an interrupted run
+		var cp *inputCheckpoint
+		if run != nil {
+			var err error
+			cp, err = run.input(in)
+			check(err)
+			if cp.Done {
+				infof("Skipping %s, it was completed before the run was interrupted", in)
+
+				// Its output is still part of the run
+				counts := make(map[string]int)
+				for out := range cp.Outputs {
+					counts[out] = countRows(out, *format)
+				}
+				outs.add(in, counts, false)
+				return
+			}
 		}
-		f.Carrier = carrier
+		resumed := cp != nil && cp.Rows > 0
 
-		// Origin Airport struct
-		orig, err := airports.LookupIATA(values["ORIGIN"])
-		if err != nil {
-			skip()
-			continue
+		// Later inputs add to the file written for the first. Inputs enriched in
+		// parallel have their own files, so keep the mode set from -append.
+		if *parallelFiles <= 1 {
+			output.SetAppend(*appendOut || *outFile != "" && i > 0 || resumed)
 		}
-		f.Origin = orig
-		location, err := time.LoadLocation(f.Origin.Tz)
-		check(err)
 
-		// Destination Airport struct
-		dest, err := airports.LookupIATA(values["DEST"])
-		if err != nil {
-			skip()
-			continue
+		// Inputs in subdirectories are written to the same layout under the output directory
+		if *database == "" && *outFile == "" {
+			err := os.MkdirAll(filepath.Dir(name), 0755)
+			check(err)
 		}
-		f.Destination = dest
 
-		// Cancellation status
-		if values["CANCELLED"] == "1.00" {
-			f.Cancelled = true
+		// Rejected rows are written beside the output
+		rejectsName := ""
+		if *writeRejects {
+			rejectsName = rejectsFile(*outPath, (*filenames)[i])
+		}
+
+		// Large inputs may be split into chunks enriched at once
+		var counts map[string]int
+		if chunks := splitInput(in); len(chunks) > 1 {
+			counts = readChunks(in, chunks, name, rejectsName)
 		} else {
-			f.Cancelled = false
+			counts = readFile(in, nil, name, rejectsName, cp)
+		}
+		if canceled() {
+			return
+		}
+
+		// A single output file only needs its schema written once
+		if *schemaFile != "" && *database == "" && name != output.Stdout && (*outFile == "" || i == 0) {
+			err := writeSchemaSidecar(*schemaFile, name)
+			check(err)
+		}
+
+		// Later inputs written to -o add to the rows of the first, unless the rows
+		// already there were counted
+		outs.add(in, counts, *outFile != "" && i > 0 && !*appendOut && !resumed)
+
+		if *verify {
+			for out := range counts {
+				rows := outs.count(out)
+				if err := verifyOutput(out, *format, rows, requiredCols); err != nil {
+					fatalf("Verification of '%s' failed: %s", out, err)
+				}
+				infof("Verified %d rows of '%s'", rows, out)
+			}
 		}
+	}
+
+	// Inputs with their own output files may be enriched at the same time
+	// Parsers and provider requests are tuned while the inputs are processed
+	stopTuning := setupConcurrency()
+
+	if *parallelFiles > 1 {
+		var inputs sync.WaitGroup
+		sem := make(chan struct{}, *parallelFiles)
+		for i, in := range *files {
+			sem <- struct{}{}
+			if canceled() {
+				break
+			}
+			inputs.Add(1)
+			go func(i int, in string) {
+				defer inputs.Done()
+				process(i, in)
+				<-sem
+			}(i, in)
+		}
+		inputs.Wait()
+	} else {
+		for i, in := range *files {
+			if canceled() {
+				break
+			}
+			process(i, in)
+		}
+	}
+
+	// New inputs of watched directories are processed with the concurrency reached
+	stopTuning()
 
-		// Scheduled Departure time
-		f.ScheduledDep, err = time.Parse("15042006-01-02", values["CRS_DEP_TIME"]+values["FL_DATE"])
-		f.ScheduledDep = f.ScheduledDep.In(location)
+	// A canceled run stops once the outputs of the inputs in progress are closed
+	if canceled() {
+		stopped(shutdown)
+	}
+
+	// Watched directories only hold the inputs still to process
+	if watched != nil {
+		for _, in := range *files {
+			err := watched.done(in)
+			check(err)
+		}
+	}
+
+	// Process inputs added to the directory until interrupted. A watch session
+	// stopped by a signal finishes like a completed run, with the input in progress
+	// left in the directory to process again.
+	if watched != nil {
+		err := watched.watch(runCtx, func(filename string, rel string) {
+			*files = append(*files, filename)
+			*filenames = append(*filenames, rel)
+			process(len(*files)-1, filename)
+		})
+		check(err)
+		if canceled() && !interrupted() {
+			stopped(shutdown)
+		}
+	}
+
+	// A completed run has nothing to resume
+	if run != nil {
+		run.remove()
+	}
+
+	// Record the output files, with checksums, for reproducing the run
+	if *manifestOut && *database == "" && *outFile != output.Stdout && len(outs.rows) > 0 {
+		filename, err := writeManifest(*outPath, outs)
 		if err != nil {
-			skip()
-			continue
+			fatalf("Cannot write manifest: %s", err)
 		}
+		if *verify {
+			if err := checkManifest(filename); err != nil {
+				fatalf("Verification of '%s' failed: %s", filename, err)
+			}
+		}
+	}
+
+	// Run summary
+	logMalformed()
+	usage := weather.Usage()
+	logUsage(usage)
+	logLatencies()
+	if *metricsFile != "" {
+		if err := metrics.WriteJSON(*metricsFile); err != nil {
+			warnf("Could not write metrics '%s': %s", *metricsFile, err)
+		}
+	}
+	if *ledger != "" && len(usage) > 0 {
+		if err := appendLedger(*ledger, *project, usage); err != nil {
+			warnf("Could not update ledger '%s': %s", *ledger, err)
+		}
+	}
+	if *runSummaryOut != "" {
+		if err := writeRunSummary(*runSummaryOut, start, len(*files), usage); err != nil {
+			fatalf("Could not write run summary '%s': %s", *runSummaryOut, err)
+		}
+	}
+
+	if code := exitCode(); code != exitOK {
+		shutdown()
+		os.Exit(code)
+	}
+}
 
-		// Cancellation code
-		f.CancellationCode = values["CANCELLATION_CODE"]
+// readFile enriches the flights in infilename, or only those of chunk when it isn't
+// nil, writes them to outfilename (or its partitions) and returns the number of rows
+// each output file should now hold. When resuming, the rows before the checkpoint cp
+// are skipped.
+func readFile(infilename string, chunk *inputChunk, outfilename string, rejectsname string, cp *inputCheckpoint) map[string]int {
+	window := newRowWindow(rowsInFlight())
+
+	// Create CSV reader
+	var infile io.ReadCloser
+	var err error
+	if chunk != nil {
+		infile, err = chunk.open(infilename)
+	} else {
+		infile, err = openInput(infilename)
+	}
+	if err != nil {
+		fail("Cannot open '%s': %s", infilename, err)
+		return nil
+	}
+	defer infile.Close()
+
+	// Standard input is filled by another process already
+	var in io.Reader = infile
+	if *readAheadSize > 0 && infilename != stdin {
+		ra := readAhead(infile, *readAheadSize)
+		defer ra.Close()
+		in = ra
+	}
+
+	label, size := filepath.Base(infilename), inputSize(infilename)
+	if chunk != nil {
+		label, size = fmt.Sprintf("%s (chunk %d)", label, chunk.index+1), chunk.end-chunk.start
+	}
+	prog := newProgress(label, size)
+	defer prog.finish()
+	r := newReader(prog.reader(in), infilename)
 
-		if !f.Cancelled {
-			// Actual Departure time
-			if values["DEP_TIME"] == "2400" {
-				values["DEP_TIME"] = "2359"
+	// Read header row, copied out of the reader's reused slice
+	header, err := r.Read()
+	if err != nil {
+		fail("Cannot read header of '%s': %s", infilename, err)
+		return nil
+	}
+	header = append([]string(nil), header...)
+
+	// Rows written before the run was interrupted, read before the printer starts
+	// updating the checkpoint
+	resumeAt := 0
+	if cp != nil {
+		resumeAt = cp.Rows
+	}
+
+	// Rows which produce no output are written to the rejects file
+	rej := newRejects(rejectsname, header, resumeAt > 0)
+	defer rej.close()
+
+	// The parsers read columns by the names of the legacy exports, at positions
+	// resolved once from the header
+	header, err = mapHeader(header)
+	if err != nil {
+		fail("Cannot read '%s': %s", infilename, err)
+		return nil
+	}
+	cols := parse.NewIndex(header)
+
+	// Each stage closes its output once its input is closed and all its goroutines
+	// have returned: the reader closes its own at the end of the input, then the
+	// parse stage, the prefetcher and the enrich stage close theirs in turn, and the
+	// writer returns once it has closed the output files. Rows the stages reject are
+	// written to the rejects file, and the errors which end the run cancel it.
+	// Canceling the run stops the reader, and the stages drop the rows still in flight.
+	sub := newSubset()
+	read := pipeline.Source(runCtx, "read", 0, func(ctx context.Context, emit func(*inputRow)) error {
+		n := 0
+		for ctx.Err() == nil {
+			row, err := r.Read()
+			if err == io.EOF {
+				return nil
+			}
+
+			// Rows which can't be read are malformed, but any other error ends the input early
+			if perr, ok := err.(*csv.ParseError); ok {
+				var rowErr error = perr
+				if chunk != nil {
+					rowErr = chunk.locate(perr)
+				}
+				skippedRows.warnf("Skipping malformed row of '%s': %s", infilename, rowErr)
+				malformedRow(infilename, rowErr)
+				atomic.AddInt64(&rowsRead, 1)
+				if row != nil {
+					rej.malformed(n, append([]string(nil), row...), rowErr)
+				}
+				continue
 			}
-			f.ActualDep, err = time.Parse("15042006-01-02", values["DEP_TIME"]+values["FL_DATE"])
-			f.ActualDep = f.ActualDep.In(location)
 			if err != nil {
-				skip()
+				return fmt.Errorf("Cannot read '%s': %s", infilename, err)
+			}
+
+			keep, more := sub.next()
+			if !more {
+				return nil
+			}
+			if !keep {
 				continue
 			}
 
-			// Delay (in minutes)
-			if values["WEATHER_DELAY"] != "" {
-				delay, err := strconv.ParseFloat(values["DEP_DELAY"], 64)
-				if err != nil {
-					skip()
-					continue
-				}
-				if delay < 0 {
-					delay = 0
-				}
-				f.Delay = int(delay)
-			} else {
-				f.Delay = 0
+			// Rows written before the run was interrupted
+			if n < resumeAt {
+				n++
+				continue
+			}
+
+			// Rows handed to the parsers must not share the reader's reused slice
+			if *reuseRecord {
+				row = append([]string(nil), row...)
 			}
 
-			// Flight diverted flag
-			// Cancellation status
-			if values["DIVERTED"] == "1.00" {
-				f.Diverted = true
-			} else {
-				f.Diverted = false
+			if !window.add(ctx) {
+				return nil
 			}
+			emit(&inputRow{seq: n, fields: row})
+			atomic.AddInt64(&rowsRead, 1)
+			prog.row()
+			n++
+		}
+
+		return nil
+	})
+	read.Handle(func(e pipeline.Error[struct{}]) {
+		fail("%s", e.Err)
+	})
+
+	parseWorkers := concurrencyLimit
+	if *deterministic && dedupeFlights != nil {
+		parseWorkers = 1
+	}
+	parse := pipeline.Start(runCtx, "parse", parseWorkers, 0, read.Out(), parser(infilename, cols, window, rej))
+	parse.Handle(func(e pipeline.Error[*inputRow]) {
+		skippedRows.warnf("Skipping line: %s because of error:%s", e.Item.fields, e.Err)
+		rej.add(e.Item, e.Err)
+		window.Done()
+	})
+	stages := []func() pipeline.Stats{read.Stats, parse.Stats}
+
+	// Parsed flights pass through the prefetcher when it is enabled, whose buffer
+	// holds the flights waiting for a worker
+	jobs := parse.Out()
+	if *lookahead > 0 {
+		prefetch := pipeline.Run(runCtx, "prefetch", *lookahead, jobs, prefetcher)
+		stages = append(stages, prefetch.Stats)
+		jobs = prefetch.Out()
+	}
+
+	// Enriched rows wait for the writer in a buffer of a batch, so the workers carry
+	// on while it passes rows on to the file writers. Flights without weather are
+	// rejected, and any other error fetching it ends the run.
+	enrich := pipeline.Start(runCtx, "enrich", concurrencyLimit, maxBatch, jobs, worker)
+	enrich.Handle(func(e pipeline.Error[*Flight]) {
+		if errors.Is(e.Err, weather.ErrNoData) {
+			rej.add(&inputRow{seq: e.Item.seq, fields: e.Item.input}, e.Err)
+		} else {
+			fail("Could not get weather for %s", e.Err)
+		}
+		window.Done()
+	})
+
+	counts := make(map[string]int)
+	write := pipeline.Run(runCtx, "write", 0, enrich.Out(), printer(&outfilename, window, cp, resumeAt, rej.skipped, counts))
+	write.Handle(func(e pipeline.Error[*record]) {
+		fail("%s", e.Err)
+	})
+	stages = append(stages, enrich.Stats, write.Stats)
+
+	// Wait for the output files to be closed and the rejected rows written
+	write.Wait()
+	read.Wait()
+	parse.Wait()
+	enrich.Wait()
+	for _, stats := range stages {
+		s := stats()
+		debugf("Stage %s of '%s': %d in, %d out, %d rejected, %s busy across %d goroutines",
+			s.Name, infilename, s.In, s.Out, s.Failed, s.Busy.Round(time.Millisecond), s.Workers)
+	}
+
+	return counts
+}
+
+// newReader creates a buffered reader for infile, of JSONL when its name ends in
+// .jsonl or .ndjson and otherwise of CSV, sizing the buffer from the width of its
+// rows unless -read-buffer is set. The delimiter of CSV is sniffed from the first
+// line unless -input-delimiter is set. Inputs are transcoded from -encoding.
+func newReader(infile io.Reader, name string) rowReader {
+	infile = decodeInput(infile)
+
+	size := *readBuffer
+	if size <= 0 {
+		size, infile = autoBufferSize(infile)
+	}
+	debugf("Reading '%s' with a %d KiB buffer", name, size>>10)
+
+	br := bufio.NewReaderSize(infile, size)
+	if isJSONL(name) {
+		return newJSONLReader(br)
+	}
+
+	r := csv.NewReader(br)
+	r.ReuseRecord = *reuseRecord
+	r.Comma = inputComma
+	if r.Comma == 0 {
+		sample, _ := br.Peek(minReadBuffer)
+		r.Comma = sniffDelimiter(sample)
+		if r.Comma != ',' {
+			infof("'%s' is delimited by %q", name, r.Comma)
 		}
+	}
+
+	return &headerReader{r: r, name: name}
+}
+
+// autoBufferSize picks a read buffer large enough for rowsPerReadBuffer rows of the
+// width of the input's header line, so wide exports are read in fewer, larger reads.
+// It returns a reader of the whole input, including the sample it read.
+func autoBufferSize(infile io.Reader) (int, io.Reader) {
+	sample := make([]byte, minReadBuffer)
+	n, _ := io.ReadFull(infile, sample)
+	sample = sample[:n]
 
-		jobs <- &f
+	width := n
+	if i := bytes.IndexByte(sample, '\n'); i >= 0 {
+		width = i + 1
 	}
+
+	size := width * rowsPerReadBuffer
+	if size < minReadBuffer {
+		size = minReadBuffer
+	} else if size > maxReadBuffer {
+		size = maxReadBuffer
+	}
+
+	return size, io.MultiReader(bytes.NewReader(sample), infile)
 }
 
-func worker(jobs chan *Flight, printc chan *[]string) {
-	for f := range jobs {
-		weatherOrigin, err := weather.Get(f.Origin, f.ScheduledDep)
+// parser returns the function of the parse stage of the input name, which emits the
+// flights of the rows kept by the filters and rejects those which fail to parse or
+// are dropped as duplicates
+func parser(name string, cols *parse.Index, rows *rowWindow, rej *rejects) pipeline.Func[*inputRow, *Flight] {
+	return func(ctx context.Context, r *inputRow, emit func(*Flight)) error {
+		parsers.Acquire()
+		f, err := parseFlight(r, cols)
+		parsers.Release()
 		if err != nil {
-			if err != nil {
-				log.Fatalf("Could not get weather for %s on %s: %s", f.Origin.IATA, f.ScheduledDep.String(), err)
+			malformedRow(name, err)
+			return err
+		}
+
+		// Flights left out by the filters aren't rejects
+		if runFilter != nil && !runFilter.keep(f) {
+			atomic.AddInt64(&rowsFiltered, 1)
+			rej.skipped.add(r.seq)
+			rows.Done()
+			return nil
+		}
+
+		// Flights in overlapping inputs
+		if dedupeFlights != nil && dedupeFlights.duplicate(f) {
+			if *dedupeMode == "drop" {
+				return errDuplicate
 			}
+			f.Duplicate = true
 		}
 
-		weatherDest, err := weather.Get(f.Destination, f.ScheduledDep)
-		if err != nil {
+		emit(f)
+
+		return nil
+	}
+}
+
+// parseOptions resolve codes and time zones from the -overrides and the bundled
+// datasets, remembering the lookups
+var parseOptions = parse.Options{Airline: lookupAirline, Airport: lookupAirport, Location: loadLocation}
+
+// parseFlight parses an input row, whose columns are at the positions cols
+func parseFlight(r *inputRow, cols *parse.Index) (*Flight, error) {
+	f, err := parseRow(r.fields, cols)
+	if err != nil {
+		return nil, err
+	}
+	f.seq, f.input = r.seq, r.fields
+
+	return f, nil
+}
+
+// parseRow parses a flight from the fields of an input row, reading each column at
+// its position in cols
+func parseRow(fields []string, cols *parse.Index) (*Flight, error) {
+	p, err := cols.Parse(fields, parseOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Flight{
+		Date:              p.Date,
+		Carrier:           p.Carrier,
+		Origin:            p.Origin,
+		Destination:       p.Destination,
+		ScheduledDep:      p.ScheduledDep,
+		ActualDep:         p.ActualDep,
+		Delay:             p.Delay,
+		Cancelled:         p.Cancelled,
+		CancellationCode:  p.CancellationCode,
+		Diverted:          p.Diverted,
+		ArrivalDelay:      p.ArrivalDelay,
+		TaxiOut:           p.TaxiOut,
+		TaxiIn:            p.TaxiIn,
+		WheelsOff:         p.WheelsOff,
+		AirTime:           p.AirTime,
+		Distance:          p.Distance,
+		CarrierDelay:      p.CarrierDelay,
+		WeatherDelay:      p.WeatherDelay,
+		NASDelay:          p.NASDelay,
+		SecurityDelay:     p.SecurityDelay,
+		LateAircraftDelay: p.LateAircraftDelay,
+		FlightNumber:      p.FlightNumber,
+		TailNumber:        p.TailNumber,
+	}
+
+	// Great-circle route, unknown when either airport's location is
+	if !isUnknown(f.Origin) && !isUnknown(f.Destination) {
+		f.RouteDistance, f.Bearing = greatCircle(f.Origin, f.Destination)
+	}
+
+	return f, nil
+}
+
+// worker is the function of the enrich stage, which emits the output row of a flight
+// with the weather at both ends. It rejects flights the provider has no weather for
+// with weather.ErrNoData, and other weather errors, which end the run, as they are.
+func worker(ctx context.Context, f *Flight, emit func(*record)) error {
+	start := time.Now()
+	err := enrichFlight(ctx, f)
+	if errors.Is(err, weather.ErrNoData) {
+		skippedRows.warnf("Skipping %s", err)
+		return weather.ErrNoData
+	}
+	if err != nil {
+		return err
+	}
+
+	metrics.Since("row_enrichment", start)
+	emit(&record{seq: f.seq, row: f.toSlice(), partition: partitionOf(f)})
+
+	return nil
+}
+
+// enrichFlight sets the weather at both ends of a flight. Errors name the flight
+// and the end whose weather couldn't be fetched.
+func enrichFlight(ctx context.Context, f *Flight) error {
+	weatherOrigin, srcOrigin, err := airportWeather(ctx, f.Origin, f.ScheduledDep)
+	if err != nil {
+		return fmt.Errorf("flight from %s on %s: %w", f.Origin.IATA, f.ScheduledDep.String(), err)
+	}
+
+	weatherDest, srcDest, err := airportWeather(ctx, f.Destination, f.ScheduledDep)
+	if err != nil {
+		return fmt.Errorf("flight to %s on %s: %w", f.Destination.IATA, f.ScheduledDep.String(), err)
+	}
+
+	// Parse origin fields
+	f.TempOrigin = weatherOrigin.Temperature
+	if weatherOrigin.PrecipIntensity == 0 {
+		f.PrecipTypeOrigin = "none"
+		f.PrecipIntensityOrigin = 0
+	} else {
+		f.PrecipTypeOrigin = weatherOrigin.PrecipType
+		f.PrecipIntensityOrigin = weatherOrigin.PrecipIntensity
+	}
+
+	// Parse destination fields
+	f.TempDest = weatherDest.Temperature
+	if weatherDest.PrecipIntensity == 0 {
+		f.PrecipTypeDest = "none"
+		f.PrecipIntensityDest = 0
+	} else {
+		f.PrecipTypeDest = weatherDest.PrecipType
+		f.PrecipIntensityDest = weatherDest.PrecipIntensity
+	}
+
+	// Provenance of the observations
+	f.WeatherProviderOrigin, f.WeatherCachedOrigin, f.WeatherTimeOrigin = srcOrigin.Provider, srcOrigin.Cached, srcOrigin.Time
+	f.WeatherProviderDest, f.WeatherCachedDest, f.WeatherTimeDest = srcDest.Provider, srcDest.Cached, srcDest.Time
+	f.StationDistOrigin = stationDistance(f.Origin)
+	f.StationDistDest = stationDistance(f.Destination)
+
+	// Airports of unknown location have no weather
+	if isUnknown(f.Origin) {
+		f.PrecipTypeOrigin = unknownName
+	}
+	if isUnknown(f.Destination) {
+		f.PrecipTypeDest = unknownName
+	}
+
+	return nil
+}
+
+// printer returns the function of the write stage, which passes rows on to the
+// writers of the output file, or the partition files beside it, and sets counts to
+// the number of rows each file should hold once the files are closed. When ctx is
+// canceled, rows still held for the input order are dropped and the checkpoint
+// records the rows written, so the run can be resumed. An output error cancels the
+// run at once, so the rows arriving after it are dropped, and is returned once the
+// files are closed.
+func printer(outname *string, rows *rowWindow, cp *inputCheckpoint, resumeAt int, skipped *skipSet, counts map[string]int) func(ctx context.Context, jobs <-chan *record, emit func(struct{})) error {
+	return func(ctx context.Context, jobs <-chan *record, emit func(struct{})) error {
+		// Create and open an output file
+		openFile := func(name string) (output.Writer, error) {
+			if name != *outname {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					return nil, err
+				}
+			}
+
+			// Anything written to the file after this is discarded on resuming
+			if cp != nil {
+				run.opened(cp, name)
+			}
+
+			w, err := output.Open(*format, name)
 			if err != nil {
-				log.Fatalf("Could not get weather for %s on %s: %s", f.Destination.IATA, f.ScheduledDep.String(), err)
+				return nil, fmt.Errorf("Cannot open '%s': %s", name, err)
 			}
+
+			// Writer header to file
+			if err := w.WriteHeader(header); err != nil {
+				w.Close()
+				return nil, fmt.Errorf("Cannot write header to '%s': %s", name, err)
+			}
+
+			return w, nil
 		}
 
-		// Parse origin fields
-		f.TempOrigin = weatherOrigin.Temperature
-		check(err)
-		if weatherOrigin.PrecipIntensity == 0 {
-			f.PrecipTypeOrigin = "none"
-			f.PrecipIntensityOrigin = 0
-		} else {
-			f.PrecipTypeOrigin = weatherOrigin.PrecipType
-			f.PrecipIntensityOrigin = weatherOrigin.PrecipIntensity
-			check(err)
+		// Each output file, or partition, has a writer of its own, started on first use.
+		// Rows already in a file being appended to are counted.
+		appending := (*appendOut || resumeAt > 0) && *database == ""
+		writers := make(map[string]*fileWriter)
+		writer := func(partition string) *fileWriter {
+			path := partitionPath(*outname, partition)
+			w, ok := writers[path]
+			if !ok {
+				w = startWriter(path, appending, openFile, rows)
+				writers[path] = w
+			}
+
+			return w
 		}
 
-		// Parse destination fields
-		f.TempDest = weatherDest.Temperature
-		if weatherDest.PrecipIntensity == 0 {
-			f.PrecipTypeDest = "none"
-			f.PrecipIntensityDest = 0
-		} else {
-			f.PrecipTypeDest = weatherDest.PrecipType
-			f.PrecipIntensityDest = weatherDest.PrecipIntensity
+		// Unpartitioned output is created even when there are no rows
+		if *partitionBy == "" {
+			writer("")
+		}
+
+		// Rows ready to write are passed to the writers of their files in batches
+		written := 0
+		send := func(ready []*record) {
+			written += len(ready)
+			if *partitionBy == "" {
+				if len(ready) > 0 {
+					writer("").batches <- writeBatch{rows: ready}
+				}
+				return
+			}
+
+			batches := make(map[*fileWriter][]*record)
+			for _, r := range ready {
+				w := writer(r.partition)
+				batches[w] = append(batches[w], r)
+			}
+			for w, b := range batches {
+				w.batches <- writeBatch{rows: b}
+			}
+		}
+
+		// The records already waiting are taken along with j
+		take := func(j *record) []*record {
+			batch := []*record{j}
+			for len(batch) < maxBatch {
+				select {
+				case j, ok := <-jobs:
+					if !ok {
+						jobs = nil
+						return batch
+					}
+					batch = append(batch, j)
+				default:
+					return batch
+				}
+			}
+
+			return batch
+		}
+
+		// The files of the writers, and whether the rows sent to them are written
+		files := make(map[string]*outputFile)
+		flushAll := func() bool {
+			ok := true
+			for path, w := range writers {
+				ok = w.sync() && ok
+				files[path] = w.file
+			}
+
+			return ok
+		}
+
+		// Pull Flight objects from chan and pass them on, restoring the input order if required
+		var ro *reorderer
+		if *ordered {
+			ro = newReorderer(skipped)
 		}
+		if cp != nil {
+			ro.next = resumeAt
+		}
+		failed := false
+		for jobs != nil {
+			select {
+			case j, ok := <-jobs:
+				if !ok {
+					jobs = nil
+					continue
+				}
+				batch := take(j)
+				if ro == nil {
+					send(batch)
+					break
+				}
+				var ready []*record
+				for _, r := range batch {
+					ready = append(ready, ro.add(r)...)
+				}
+				send(ready)
+			case <-skipped.added:
+				// Records held for a row which turned out to produce no output
+				send(ro.add(nil))
+			}
 
-		printc <- f.toSlice()
+			// Every row before the reorderer's next is written once the writers are flushed
+			if cp != nil && written >= checkpointRows && !failed {
+				failed = !flushAll()
+				if !failed {
+					run.update(cp, ro.next, false, files)
+				}
+				written = 0
+			}
+		}
+
+		// The rows held back wait for rows a canceled run dropped
+		stopped := ctx.Err() != nil
+		if ro != nil && !stopped {
+			send(ro.drain())
+		}
+
+		// The writers close their files once they have written the rows sent to them
+		for _, w := range writers {
+			close(w.batches)
+		}
+		var err error
+		for path, w := range writers {
+			<-w.done
+			if w.err != nil && err == nil {
+				err = w.err
+			}
+			failed = failed || w.err != nil
+			files[path] = w.file
+			for name, n := range w.counts {
+				counts[name] += n
+			}
+		}
+
+		// The rows after a failed write are resumed from the last checkpoint
+		if cp != nil && !failed {
+			run.update(cp, ro.next, !stopped, files)
+		}
+		return err
 	}
+}
 
-	close(printc)
+// rowPool holds output rows already written, for reuse by the next flights. The
+// writers don't keep the rows passed to them.
+var rowPool = sync.Pool{
+	New: func() interface{} {
+		return new([]interface{})
+	},
 }
 
-func printer(jobs chan *[]string, outname *string, wg *sync.WaitGroup) {
-	// Create and open outfile
-	outfile, err := os.Create(*outname)
-	if err != nil {
-		log.Fatalf("Cannot open '%s': %s\n", *outname, err.Error())
+// toSlice returns the values of the selected columns of f, in a row from rowPool
+func (f *Flight) toSlice() *[]interface{} {
+	ret := rowPool.Get().(*[]interface{})
+	if cap(*ret) < len(selected) {
+		*ret = make([]interface{}, len(selected))
+	}
+	*ret = (*ret)[:len(selected)]
+	for i, c := range selected {
+		(*ret)[i] = c.value(f)
+	}
+
+	return ret
+}
+
+// standardTime converts t to its location's standard time, ignoring daylight saving
+func standardTime(t time.Time) time.Time {
+	if !t.IsDST() {
+		return t
+	}
+
+	// Standard time is in effect in January or July depending on the hemisphere
+	for _, m := range []time.Month{time.January, time.July} {
+		s := time.Date(t.Year(), m, 1, 0, 0, 0, 0, t.Location())
+		if !s.IsDST() {
+			_, offset := s.Zone()
+			return t.In(time.FixedZone("LST", offset))
+		}
 	}
-	w := csv.NewWriter(outfile)
-	defer func() {
-		w.Flush()
-		outfile.Close()
-	}()
 
-	// Writer header to file
-	w.Write(header)
+	return t
+}
 
-	// Pull Flight objects from chan and print to file
-	for j := range jobs {
-		w.Write(*j)
-		wg.Done()
+// databaseFormat returns the output format writing to the database at dest
+func databaseFormat(dest string) (string, error) {
+	switch {
+	case strings.HasPrefix(dest, "postgres://"), strings.HasPrefix(dest, "postgresql://"):
+		return "postgres", nil
+	case strings.HasSuffix(dest, ".db"), strings.HasSuffix(dest, ".sqlite"), strings.HasSuffix(dest, ".sqlite3"):
+		return "sqlite", nil
 	}
+
+	return "", fmt.Errorf("Cannot tell the database type of '%s' (expected a postgres:// URL or a .db or .sqlite file)", dest)
 }
 
-func (f *Flight) toSlice() *[]string {
-	ret := make([]string, 19)
-
-	ret[0] = f.Date
-	ret[1] = fmt.Sprint(f.ScheduledDep.Year())
-	ret[2] = f.ScheduledDep.Month().String()
-	ret[3] = fmt.Sprint(f.ScheduledDep.Day())
-	ret[4] = f.Carrier.Name
-	ret[5] = f.Origin.IATA
-	ret[6] = f.Destination.IATA
-	ret[7] = fmt.Sprintf("%02d%02d", f.ScheduledDep.Hour(), f.ScheduledDep.Minute())
-	ret[8] = fmt.Sprintf("%02d%02d", f.ActualDep.Hour(), f.ActualDep.Minute())
-	ret[9] = fmt.Sprint(f.Delay)
-	ret[10] = strconv.FormatBool(f.Cancelled)
-	ret[11] = f.CancellationCode
-	ret[12] = strconv.FormatBool(f.Diverted)
-	ret[13] = strconv.FormatFloat(f.TempOrigin, 'f', -1, 64)
-	ret[14] = f.PrecipTypeOrigin
-	ret[15] = strconv.FormatFloat(f.PrecipIntensityOrigin, 'f', -1, 64)
-	ret[16] = strconv.FormatFloat(f.TempDest, 'f', -1, 64)
-	ret[17] = f.PrecipTypeDest
-	ret[18] = strconv.FormatFloat(f.PrecipIntensityDest, 'f', -1, 64)
-
-	return &ret
+// outputPaths cleans and joins output names by the separator rules of an OS
+type outputPaths struct {
+	clean func(name string) string
+	join  func(elem ...string) string
 }
 
-func parseArguments() (*[]string, *[]string, *string) {
+// paths builds output names by the rules of the OS flightsense runs on. Tests
+// replace it to check the rules of other OSes.
+var paths = outputPaths{clean: filepath.Clean, join: filepath.Join}
+
+// outputDir returns the output directory given by -outdir. Output names are joined to
+// it, so it may be given with or without a trailing separator.
+func outputDir(outdir string) string {
+	if outdir == "" {
+		return "."
+	}
+
+	return paths.clean(outdir)
+}
+
+// outputName returns the name of the output file in dir of the input named name,
+// relative to the input directory
+func outputName(dir string, name string) string {
+	out := paths.join(dir, inputBase(name)+"."+*format)
+	if *compress {
+		out += ".gz"
+	}
+
+	return out
+}
+
+// rejectsFile returns the name of the file in dir of the rows of the input named
+// name which were rejected, beside its output
+func rejectsFile(dir string, name string) string {
+	return paths.join(dir, inputBase(name)+".rejects.csv")
+}
+
+// inputFlags defines the flags naming the input files and output directory
+func inputFlags() (inname *string, infolder *string, outFolder *string, recursive *bool, include *string, exclude *string) {
+	inname = flag.String("in", "", "Optional: Input file name, an http(s) URL to stream, or '-' to read CSV from standard input (Cycles through directory if ommitted)")
+	flag.StringVar(inname, "i", "", "Shorthand for -in")
+	infolder = flag.String("indir", "", "Directory of source data files")
+	outFolder = flag.String("outdir", "", "Directory of destination data files")
+	recursive = flag.Bool("r", false, "Search subdirectories of -indir too, writing their outputs to the same layout under -outdir")
+	include = flag.String("include", "", "Optional: Comma separated glob patterns of the input files to process, e.g. '2017_*.csv'. Patterns containing a / match the path below -indir.")
+	exclude = flag.String("exclude", "", "Optional: Comma separated glob patterns of input files to skip, matched as for -include")
+
+	return
+}
+
+func parseArguments() (*[]string, *[]string, *string, *watchDir) {
 	var (
 		files     []string
 		filenames []string
 		outPath   string
 	)
 
-	// Parse command-line flags for input and output files
-	inname := flag.String("in", "", "Optional: Input file name (Cycles through directory if ommitted)")
-	infolder := flag.String("indir", "", "Directory of source data files")
-	outFolder := flag.String("outdir", "", "Directory of destination data files")
-	flag.Parse()
+	if err := applyConfig(flag.CommandLine, *configFile, true); err != nil {
+		fatalf("%s", err)
+	}
 
-	if *inname == "" && *infolder == "" {
-		log.Fatalf("Input arguments requrired!")
+	if *inName == "" && *inDir == "" {
+		fatalf("Input arguments requrired!")
 		os.Exit(1)
 	}
-
-	if strings.Contains(*inname, "/") && *infolder == "" {
-		s := strings.Split(*inname, "/")
-
-		// Set filename as inname
-		*inname = s[len(s)-1]
-
-		// Remove filename
-		s = s[:len(s)-1]
-		*infolder = strings.Join(s, "/")
-		log.Printf("*infolder is now '%s'", *infolder)
+	if *watch && (*inName != "" || *recursive) {
+		fatalf("-watch needs an -indir without -in, and cannot be used with -r")
 	}
 
-	if !strings.HasSuffix(*outFolder, "/") {
-		if *outFolder == "" {
-			outPath = "./"
-		} else {
-			outPath = *outFolder + "/"
-		}
+	// An input file given without a directory is looked for in its own directory
+	if *inName != stdin && !isURL(*inName) && *inDir == "" {
+		*inDir = filepath.Dir(*inName)
+		*inName = filepath.Base(*inName)
+		debugf("*infolder is now '%s'", *inDir)
 	}
 
-	// Read all csv files in indir, skipping subdirectories
-	filepath.Walk(*infolder, func(path string, f os.FileInfo, _ error) error {
-		if f.IsDir() && path != *infolder {
-			log.Printf("Skipping dir \"%s\"", f.Name())
-			// Skip subdirectories
-			return filepath.SkipDir
-		} else if *inname != "" {
-			if f.Name() == *inname {
-				files = append(files, path)
-				filenames = append(filenames, f.Name())
-			}
-		} else if filepath.Ext(path) == ".csv" {
-			files = append(files, path)
-			filenames = append(filenames, f.Name())
-		}
+	outPath = outputDir(*outDir)
 
-		return nil
-	})
+	// Standard input or a URL is the only input when given. Standard input is
+	// written to stdin.<format>, and a URL to the name at the end of its path.
+	if *inName == stdin {
+		files = []string{stdin}
+		filenames = []string{"stdin"}
+	} else if isURL(*inName) {
+		files = []string{*inName}
+		filenames = []string{urlName(*inName)}
+	} else {
+		inputs, err := findInputs(*inDir, *inName, *recursive, splitList(*include), splitList(*exclude))
+		if err != nil {
+			fatalf("%s", err)
+		}
+		if len(inputs) == 0 && !*watch {
+			fatalf("No input files found in '%s'", *inDir)
+		}
+		for _, in := range inputs {
+			files = append(files, filepath.Join(*inDir, in))
+			filenames = append(filenames, in)
+		}
+	}
 
 	// Check to ensure input files exist
 	for _, v := range files {
+		if v == stdin || isURL(v) {
+			continue
+		}
 		if _, err := os.Stat(v); err != nil {
 			if os.IsNotExist(err) {
-				log.Fatalf("Error 404 - File not found: \"%s\".\nHere's the error: %s", v, err)
+				fatalf("Error 404 - File not found: \"%s\".\nHere's the error: %s", v, err)
 			}
 		} else {
-			log.Printf("Found file \"%s\"", v)
+			debugf("Found file \"%s\"", v)
 		}
 	}
 
 	// Check if outdir exists
 	if _, err := os.Stat(outPath); err != nil {
 		if os.IsNotExist(err) {
-			os.Create(outPath)
-			log.Printf("Output directory not found, created '%s'", outPath)
+			err := os.MkdirAll(outPath, 0755)
+			check(err)
+			infof("Output directory not found, created '%s'", outPath)
 		} else {
-			log.Fatal(err)
+			fatalf("%s", err)
+		}
+	}
+
+	// New inputs are looked for in the input directory, which can't also hold the output
+	var watched *watchDir
+	if *watch {
+		in, _ := filepath.Abs(*inDir)
+		out, _ := filepath.Abs(outPath)
+		if in == out {
+			fatalf("-watch needs an -outdir other than -indir")
 		}
+		watched = &watchDir{path: *inDir, include: splitList(*include), exclude: splitList(*exclude)}
 	}
 
-	return &files, &filenames, &outPath
+	return &files, &filenames, &outPath, watched
 }
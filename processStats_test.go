@@ -0,0 +1,230 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leonm1/flightsense-go/parse"
+)
+
+// BenchmarkParseRow compares parsing rows by the column positions resolved from the
+// header with the map of column names each row was copied into before
+func BenchmarkParseRow(b *testing.B) {
+	rows, header := demoRows(b)
+	cols := parse.NewIndex(header)
+
+	b.Run("index", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := cols.Parse(rows[i%len(rows)].fields, parseOptions); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			r := rows[i%len(rows)]
+			values := make(map[string]string)
+			for j, h := range header {
+				values[h] = r.fields[j]
+			}
+			if _, err := parse.ParseRow(values, parseOptions); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// columnValue returns the value of the latest schema's column name for f
+func columnValue(t *testing.T, f *Flight, name string) interface{} {
+	t.Helper()
+
+	for _, c := range schemaColumns(latestSchema) {
+		if c.Name == name {
+			return c.value(f)
+		}
+	}
+	t.Fatalf("No column '%s'", name)
+
+	return nil
+}
+
+// Departures from JFK, in America/New_York, around the 2017 DST changes on March 12
+// and November 5
+func TestDepartureTimesAcrossDST(t *testing.T) {
+	tests := []struct {
+		name                            string
+		date                            string
+		scheduled, actual               string
+		delay                           string
+		wantScheduled                   string // Local time, RFC3339
+		wantActual                      string
+		wantScheduledUTC, wantActualUTC string
+	}{
+		{"skipped hour moves on by the hour", "2017-03-12", "0230", "0230", "0",
+			"2017-03-12T03:30:00-04:00", "2017-03-12T03:30:00-04:00", "2017-03-12T07:30:00Z", "2017-03-12T07:30:00Z"},
+		{"delay across the skipped hour", "2017-03-12", "0150", "0310", "20",
+			"2017-03-12T01:50:00-05:00", "2017-03-12T03:10:00-04:00", "2017-03-12T06:50:00Z", "2017-03-12T07:10:00Z"},
+		{"repeated hour is the first", "2017-11-05", "0130", "0130", "0",
+			"2017-11-05T01:30:00-04:00", "2017-11-05T01:30:00-04:00", "2017-11-05T05:30:00Z", "2017-11-05T05:30:00Z"},
+		{"2400 on the eve of spring forward", "2017-03-11", "2400", "2400", "0",
+			"2017-03-12T00:00:00-05:00", "2017-03-12T00:00:00-05:00", "2017-03-12T05:00:00Z", "2017-03-12T05:00:00Z"},
+		{"2400 on the eve of fall back", "2017-11-04", "2400", "2400", "0",
+			"2017-11-05T00:00:00-04:00", "2017-11-05T00:00:00-04:00", "2017-11-05T04:00:00Z", "2017-11-05T04:00:00Z"},
+		{"delayed past 2400 on the eve of spring forward", "2017-03-11", "2330", "0015", "45",
+			"2017-03-11T23:30:00-05:00", "2017-03-12T00:15:00-05:00", "2017-03-12T04:30:00Z", "2017-03-12T05:15:00Z"},
+	}
+
+	cols := parse.NewIndex(parse.Columns)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]string{
+				"FL_DATE": tt.date, "CARRIER": "DL", "ORIGIN": "JFK", "DEST": "ATL",
+				"CRS_DEP_TIME": tt.scheduled, "DEP_TIME": tt.actual, "DEP_DELAY": tt.delay,
+				"CANCELLED": "0", "DIVERTED": "0",
+			}
+			fields := make([]string, len(parse.Columns))
+			for i, c := range parse.Columns {
+				fields[i] = values[c]
+			}
+
+			f, err := parseRow(fields, cols)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := f.ScheduledDep.Format(time.RFC3339); got != tt.wantScheduled {
+				t.Errorf("ScheduledDep = %s, want %s", got, tt.wantScheduled)
+			}
+			if got := f.ActualDep.Format(time.RFC3339); got != tt.wantActual {
+				t.Errorf("ActualDep = %s, want %s", got, tt.wantActual)
+			}
+			if got := columnValue(t, f, "scheduledDepartureUTC").(time.Time).Format(time.RFC3339); got != tt.wantScheduledUTC {
+				t.Errorf("scheduledDepartureUTC = %s, want %s", got, tt.wantScheduledUTC)
+			}
+			if got := columnValue(t, f, "actualDepartureUTC").(time.Time).Format(time.RFC3339); got != tt.wantActualUTC {
+				t.Errorf("actualDepartureUTC = %s, want %s", got, tt.wantActualUTC)
+			}
+		})
+	}
+}
+
+// Cancelled flights have no actual departure, which typed outputs write as null
+func TestCancelledDepartureUTC(t *testing.T) {
+	values := map[string]string{
+		"FL_DATE": "2017-01-15", "CARRIER": "DL", "ORIGIN": "JFK", "DEST": "ATL",
+		"CRS_DEP_TIME": "0830", "CANCELLED": "1", "CANCELLATION_CODE": "B", "DIVERTED": "0",
+	}
+	fields := make([]string, len(parse.Columns))
+	for i, c := range parse.Columns {
+		fields[i] = values[c]
+	}
+
+	f, err := parseRow(fields, parse.NewIndex(parse.Columns))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := columnValue(t, f, "actualDepartureUTC"); got != nil {
+		t.Errorf("actualDepartureUTC = %v, want nil", got)
+	}
+	if got := columnValue(t, f, "scheduledDepartureUTC"); got == nil {
+		t.Error("scheduledDepartureUTC = nil")
+	}
+}
+
+// windowsClean cleans a drive path as filepath.Clean does on Windows, where both \
+// and / separate names
+func windowsClean(name string) string {
+	var vol string
+	if len(name) >= 2 && name[1] == ':' {
+		vol, name = name[:2], name[2:]
+	}
+	name = path.Clean(strings.ReplaceAll(name, `\`, "/"))
+
+	return vol + strings.ReplaceAll(name, "/", `\`)
+}
+
+// windowsJoin joins names as filepath.Join does on Windows
+func windowsJoin(elem ...string) string {
+	return windowsClean(strings.Join(elem, `\`))
+}
+
+// Output, rejects and checkpoint files are joined to -outdir however its separators
+// are written
+func TestOutputNames(t *testing.T) {
+	host := paths
+	defer func(f string, c bool) { *format, *compress, paths = f, c, host }(*format, *compress)
+	*format, *compress = "csv", false
+
+	type test struct {
+		name     string
+		outdir   string
+		input    string
+		wantDir  string
+		wantOut  string
+		wantRejs string
+	}
+
+	sep := string(filepath.Separator)
+	tests := []test{
+		{"no separator", "out", "2017_01.csv",
+			"out", filepath.Join("out", "2017_01.csv"), filepath.Join("out", "2017_01.rejects.csv")},
+		{"trailing separator", "out" + sep, "2017_01.csv",
+			"out", filepath.Join("out", "2017_01.csv"), filepath.Join("out", "2017_01.rejects.csv")},
+		{"nested output directory", filepath.Join("data", "out") + sep, "2017_01.csv.gz",
+			filepath.Join("data", "out"), filepath.Join("data", "out", "2017_01.csv"), filepath.Join("data", "out", "2017_01.rejects.csv")},
+		{"input in a subdirectory", "out", filepath.Join("2017", "2017_01.zip"),
+			"out", filepath.Join("out", "2017", "2017_01.csv"), filepath.Join("out", "2017", "2017_01.rejects.csv")},
+		{"working directory", "", "2017_01.csv",
+			".", "2017_01.csv", "2017_01.rejects.csv"},
+	}
+	windowsTests := []test{
+		{"backslashes", `C:\data\out\`, `2017\2017_01.csv`,
+			`C:\data\out`, `C:\data\out\2017\2017_01.csv`, `C:\data\out\2017\2017_01.rejects.csv`},
+		{"forward slashes", `C:/data/out/`, `2017_01.csv`,
+			`C:\data\out`, `C:\data\out\2017_01.csv`, `C:\data\out\2017_01.rejects.csv`},
+		{"mixed separators", `out/nested\`, `2017_01.csv`,
+			`out\nested`, `out\nested\2017_01.csv`, `out\nested\2017_01.rejects.csv`},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, windowsTests...)
+	}
+
+	run := func(t *testing.T, p outputPaths, tests []test) {
+		paths = p
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				dir := outputDir(tt.outdir)
+				if dir != tt.wantDir {
+					t.Errorf("outputDir(%q) = %q, want %q", tt.outdir, dir, tt.wantDir)
+				}
+				if got := outputName(dir, tt.input); got != tt.wantOut {
+					t.Errorf("outputName() = %q, want %q", got, tt.wantOut)
+				}
+				if got := rejectsFile(dir, tt.input); got != tt.wantRejs {
+					t.Errorf("rejectsFile() = %q, want %q", got, tt.wantRejs)
+				}
+				if got, want := checkpointFile(dir), p.join(tt.wantDir, checkpointName); got != want {
+					t.Errorf("checkpointFile() = %q, want %q", got, want)
+				}
+			})
+		}
+	}
+	t.Run("host", func(t *testing.T) { run(t, host, tests) })
+	t.Run("windows", func(t *testing.T) { run(t, outputPaths{clean: windowsClean, join: windowsJoin}, windowsTests) })
+
+	paths = host
+	*compress = true
+	if got, want := outputName("out", "2017_01.csv"), filepath.Join("out", "2017_01.csv.gz"); got != want {
+		t.Errorf("outputName() with -compress = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfiles starts the CPU profile of -cpuprofile and the execution trace of
+// -trace, returning a function which stops them and writes the heap profile of
+// -memprofile. The profiles are read with 'go tool pprof' and the trace with 'go
+// tool trace', whose goroutine analysis shows time spent waiting on the network as
+// well as running.
+func startProfiles() func() {
+	var stops []func()
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			fatalf("Cannot create CPU profile: %s", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fatalf("Cannot start CPU profile: %s", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			closeProfile(f)
+		})
+	}
+
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			fatalf("Cannot create trace: %s", err)
+		}
+		if err := trace.Start(f); err != nil {
+			fatalf("Cannot start trace: %s", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			closeProfile(f)
+		})
+	}
+
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+		if *memProfile != "" {
+			writeHeapProfile(*memProfile)
+		}
+	}
+}
+
+// writeHeapProfile writes the memory in use, and allocated over the run, to filename
+func writeHeapProfile(filename string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		warnf("Cannot create memory profile: %s", err)
+		return
+	}
+
+	// Collect garbage so the memory in use is up to date
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		warnf("Cannot write memory profile '%s': %s", filename, err)
+	}
+	closeProfile(f)
+}
+
+func closeProfile(f *os.File) {
+	if err := f.Close(); err != nil {
+		warnf("Cannot write '%s': %s", f.Name(), err)
+	}
+	debugf("Wrote '%s'", f.Name())
+}
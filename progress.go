@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonm1/flightsense-go/output"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// How often the progress line on the terminal is redrawn
+const progressRedraw = time.Second
+
+// progressShown is 1 while a progress line is drawn on the terminal, which log
+// lines written to the console clear first
+var progressShown int32
+
+// progress reports how far through an input a run is: rows read, rows per second,
+// the cache hit rate and, for uncompressed files, the estimated time remaining. It
+// is redrawn in place when the console is a terminal and logged every -progress.
+type progress struct {
+	name  string
+	size  int64
+	read  int64
+	rows  int64
+	start time.Time
+	hits  int64
+	miss  int64
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newProgress starts reporting the progress of an input of size bytes, or of
+// unknown size when it is 0
+func newProgress(name string, size int64) *progress {
+	p := &progress{name: name, size: size, start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	p.hits, p.miss = weather.CacheHits()
+
+	go p.run()
+	return p
+}
+
+// inputSize returns the size of an input when it is an uncompressed file, or else 0
+func inputSize(filename string) int64 {
+	lower := strings.ToLower(filename)
+	if isURL(filename) || filename == stdin || strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".zip") {
+		return 0
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// reader counts the bytes read from an input, from which the time remaining is estimated
+func (p *progress) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(&r.p.read, int64(n))
+	return n, err
+}
+
+// row counts a row read from the input
+func (p *progress) row() {
+	atomic.AddInt64(&p.rows, 1)
+}
+
+// run redraws and logs the progress until finish is called
+func (p *progress) run() {
+	defer close(p.done)
+
+	// Progress lines of inputs processed at once would overwrite each other
+	draw := isTerminal(consoleFile()) && *parallelFiles <= 1
+
+	redraw := time.NewTicker(progressRedraw)
+	defer redraw.Stop()
+	var logc <-chan time.Time
+	if *progressEvery > 0 {
+		t := time.NewTicker(*progressEvery)
+		defer t.Stop()
+		logc = t.C
+	}
+
+	for {
+		select {
+		case <-p.stop:
+			if draw {
+				atomic.StoreInt32(&progressShown, 0)
+				fmt.Fprint(consoleFile(), "\r\033[K")
+			}
+			return
+		case <-redraw.C:
+			if draw {
+				atomic.StoreInt32(&progressShown, 1)
+				fmt.Fprint(consoleFile(), "\r\033[K"+p.String())
+			}
+		case <-logc:
+			infof("%s", p.String())
+		}
+	}
+}
+
+// finish stops reporting and logs the input's final rate
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+
+	elapsed := time.Since(p.start)
+	infof("%s: %d rows in %s (%.0f rows/s)", p.name, atomic.LoadInt64(&p.rows),
+		elapsed.Round(time.Second), float64(atomic.LoadInt64(&p.rows))/elapsed.Seconds())
+}
+
+// String describes the progress of the input
+func (p *progress) String() string {
+	var (
+		rows    = atomic.LoadInt64(&p.rows)
+		read    = atomic.LoadInt64(&p.read)
+		elapsed = time.Since(p.start)
+		b       strings.Builder
+	)
+
+	fmt.Fprintf(&b, "%s: %d rows, %.0f rows/s", p.name, rows, float64(rows)/elapsed.Seconds())
+
+	hits, miss := weather.CacheHits()
+	hits, miss = hits-p.hits, miss-p.miss
+	if hits+miss > 0 {
+		fmt.Fprintf(&b, ", %.1f%% cache hits", 100*float64(hits)/float64(hits+miss))
+	}
+
+	if p.size > 0 && read > 0 {
+		frac := float64(read) / float64(p.size)
+		if frac > 1 {
+			frac = 1
+		}
+		eta := time.Duration(float64(elapsed) * (1 - frac) / frac)
+		fmt.Fprintf(&b, ", %.1f%%, ETA %s", 100*frac, eta.Round(time.Second))
+	}
+
+	return b.String()
+}
+
+// consoleFile is the file the console half of the log is written to
+func consoleFile() *os.File {
+	if *outFile == output.Stdout {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
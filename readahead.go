@@ -0,0 +1,104 @@
+package main
+
+import "io"
+
+// Size of each read made ahead of the CSV reader
+const readAheadChunk = 256 << 10
+
+// aheadReader reads its input in a goroutine, up to a number of chunks ahead of its
+// reader, so disk reads and decompression overlap with parsing and weather lookups
+type aheadReader struct {
+	chunks chan aheadChunk
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+
+	// Chunk being read, returned to free once read, and its unread part
+	buf []byte
+	cur []byte
+	err error
+}
+
+// aheadChunk is a chunk of the input, and the error which ended it if any
+type aheadChunk struct {
+	b   []byte
+	err error
+}
+
+// readAhead starts reading r in the background into about size bytes of chunks.
+// Close stops it.
+func readAhead(r io.Reader, size int) *aheadReader {
+	n := size / readAheadChunk
+	if n < 1 {
+		n = 1
+	}
+
+	a := &aheadReader{
+		chunks: make(chan aheadChunk, n),
+		free:   make(chan []byte, n),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		a.free <- make([]byte, readAheadChunk)
+	}
+	go a.fill(r)
+
+	return a
+}
+
+// fill reads r into free chunks until it ends or Close is called
+func (a *aheadReader) fill(r io.Reader) {
+	defer close(a.exited)
+
+	for {
+		var b []byte
+		select {
+		case b = <-a.free:
+		case <-a.done:
+			return
+		}
+
+		n, err := io.ReadFull(r, b)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		select {
+		case a.chunks <- aheadChunk{b[:n], err}:
+		case <-a.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *aheadReader) Read(p []byte) (int, error) {
+	for len(a.cur) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		if a.buf != nil {
+			a.free <- a.buf[:cap(a.buf)]
+		}
+
+		c := <-a.chunks
+		a.buf, a.cur, a.err = c.b, c.b, c.err
+	}
+
+	n := copy(p, a.cur)
+	a.cur = a.cur[n:]
+
+	return n, nil
+}
+
+// Close stops reading ahead, waiting for a read in progress so the input can be
+// closed after it. It doesn't close the input.
+func (a *aheadReader) Close() error {
+	close(a.done)
+	<-a.exited
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// rejects writes the input rows which produce no output to a CSV file, with the
+// reason each was rejected, so failures can be audited and reprocessed
+type rejects struct {
+	name      string
+	header    []string
+	appending bool
+
+	// Rows of the input which produce no output, rejected or not
+	skipped *skipSet
+
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+	n  int
+
+	// Rows held until close to be written in input order, in -deterministic runs
+	held []rejectedRow
+}
+
+// rejectedRow is a row held for the rejects file at its position in the input
+type rejectedRow struct {
+	pos    int
+	fields []string
+}
+
+// newRejects returns a rejects file at name for rows with the given header. The file
+// is only created once a row is rejected; an empty name disables it. When appending,
+// rows are added to an existing file.
+func newRejects(name string, header []string, appending bool) *rejects {
+	return &rejects{name: name, header: header, appending: appending, skipped: newSkipSet()}
+}
+
+// add records that an input row was rejected because of err
+func (r *rejects) add(row *inputRow, err error) {
+	r.skipped.add(row.seq)
+	r.count(err)
+	r.write(2*row.seq+1, row.fields, err)
+}
+
+// malformed records that a row which couldn't be read was rejected because of err.
+// next is the index the following row of the input will have.
+func (r *rejects) malformed(next int, fields []string, err error) {
+	r.count(err)
+	r.write(2*next, fields, err)
+}
+
+// count counts a rejected row
+func (r *rejects) count(err error) {
+	// Dropped duplicates are left out on purpose, like filtered flights
+	if err == errDuplicate {
+		atomic.AddInt64(&rowsFiltered, 1)
+	} else {
+		atomic.AddInt64(&rowsRejected, 1)
+	}
+}
+
+// write writes a rejected row to the file with its reason. pos orders the rows held
+// by -deterministic runs: malformed rows sort before the row read after them.
+func (r *rejects) write(pos int, fields []string, err error) {
+	if r.name == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if r.appending {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(r.name, flags, 0644)
+		if err != nil {
+			warnf("Cannot create rejects file '%s': %s", r.name, err)
+			r.name = ""
+			return
+		}
+		r.f, r.w = f, csv.NewWriter(f)
+		if st, err := f.Stat(); err == nil && st.Size() == 0 {
+			r.w.Write(append(append([]string(nil), r.header...), "reason"))
+		}
+	}
+
+	reason := "unknown"
+	if err != nil {
+		reason = err.Error()
+	}
+	row := append(append([]string(nil), fields...), reason)
+	if *deterministic {
+		r.held = append(r.held, rejectedRow{pos: pos, fields: row})
+	} else {
+		r.w.Write(row)
+	}
+	r.n++
+}
+
+// close flushes and closes the rejects file, if any rows were rejected
+func (r *rejects) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return
+	}
+
+	sort.Slice(r.held, func(i, j int) bool { return r.held[i].pos < r.held[j].pos })
+	for _, row := range r.held {
+		r.w.Write(row.fields)
+	}
+
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		warnf("Error writing rejects file '%s': %s", r.name, err)
+	}
+	r.f.Close()
+	infof("Wrote %d rejected rows to '%s'", r.n, r.name)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Attempts to reconnect to a URL input after its stream fails, before giving up
+const urlRetries = 5
+
+// urlClient streams URL inputs. There is no overall timeout, as an input is read
+// only as fast as it is enriched.
+var urlClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// isURL reports whether an input is read over HTTP rather than from a file
+func isURL(name string) bool {
+	lower := strings.ToLower(name)
+
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// urlName returns the file name at the end of a URL's path, from which the names
+// of its output files are made
+func urlName(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+		return "download.csv"
+	}
+
+	return path.Base(u.Path)
+}
+
+// openURL streams an input from a URL, decompressing it when its path ends in .gz
+func openURL(rawurl string) (io.ReadCloser, error) {
+	name := strings.ToLower(urlName(rawurl))
+	if strings.HasSuffix(name, ".zip") {
+		return nil, fmt.Errorf("Zips cannot be streamed, download '%s' first", rawurl)
+	}
+
+	r := &urlReader{url: rawurl}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(name, ".gz") {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("Cannot decompress '%s': %s", rawurl, err)
+		}
+		return &closeBoth{z, r}, nil
+	}
+
+	return r, nil
+}
+
+// urlReader reads the body of a GET of a URL, requesting the rest of the body from
+// where it broke off when the stream fails
+type urlReader struct {
+	url    string
+	body   io.ReadCloser
+	offset int64
+	failed int
+}
+
+// connect requests the body from the current offset
+func (r *urlReader) connect() error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+
+	want := http.StatusOK
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		want = http.StatusPartialContent
+	}
+
+	resp, err := urlClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != want {
+		resp.Body.Close()
+		if r.offset > 0 && resp.StatusCode == http.StatusOK {
+			return fmt.Errorf("%s cannot resume a download", r.url)
+		}
+		return fmt.Errorf("%s returned %s", r.url, resp.Status)
+	}
+
+	r.body = resp.Body
+	return nil
+}
+
+// Read reads the body, reconnecting up to urlRetries times in a row when it fails
+func (r *urlReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.failed = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		r.body.Close()
+		for {
+			r.failed++
+			if r.failed > urlRetries {
+				return n, fmt.Errorf("Reading %s failed after %d retries: %s", r.url, urlRetries, err)
+			}
+			warnf("Reading %s failed at byte %d, retrying: %s", r.url, r.offset, err)
+			time.Sleep(time.Duration(r.failed) * time.Second)
+
+			if err = r.connect(); err == nil {
+				break
+			}
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the body
+func (r *urlReader) Close() error {
+	return r.body.Close()
+}
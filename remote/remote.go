@@ -0,0 +1,140 @@
+// Package remote copies files to and from S3 and Google Cloud Storage so caches
+// can be shared between stateless batch jobs
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ErrNotExist is returned by Download when the remote object does not exist
+var ErrNotExist = errors.New("Remote object does not exist")
+
+// IsURL reports whether s names an object in S3 (s3://) or Google Cloud Storage (gs://)
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "gs://")
+}
+
+// Download copies the object at rawurl to the local file filename
+func Download(rawurl string, filename string) error {
+	u, bucket, key, err := parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch u.Scheme {
+	case "s3":
+		sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+		if err != nil {
+			return err
+		}
+
+		_, err = s3manager.NewDownloader(sess).Download(f, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return ErrNotExist
+		}
+		return err
+	case "gs":
+		ctx := context.Background()
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		r, err := client.Bucket(bucket).Object(key).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			return ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		_, err = io.Copy(f, r)
+		return err
+	}
+
+	return fmt.Errorf("Unsupported remote '%s'", rawurl)
+}
+
+// Upload copies the local file filename to the object at rawurl
+func Upload(filename string, rawurl string) error {
+	u, bucket, key, err := parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch u.Scheme {
+	case "s3":
+		sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+		if err != nil {
+			return err
+		}
+
+		_, err = s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   f,
+		})
+		return err
+	case "gs":
+		ctx := context.Background()
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		w := client.Bucket(bucket).Object(key).NewWriter(ctx)
+		if _, err := io.Copy(w, f); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+
+	return fmt.Errorf("Unsupported remote '%s'", rawurl)
+}
+
+// parse splits a remote URL into its scheme, bucket and object key
+func parse(rawurl string) (*url.URL, string, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, "", "", fmt.Errorf("Remote '%s' must name a bucket and object", rawurl)
+	}
+
+	return u, u.Host, key, nil
+}
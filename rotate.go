@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// Rows written between checks of an output file's size
+const sizeCheckRows = 1000
+
+// outputFile is an open output file, or the current part of one when output is
+// rotated across several part files
+type outputFile struct {
+	name string
+	w    output.Writer
+	part int
+	rows int
+}
+
+// rotating reports whether output rolls over to new part files
+func rotating() bool {
+	return *maxRows > 0 || *maxSize > 0
+}
+
+// full reports whether the file has reached a rotation limit. The size is that
+// already written to disk, checked every sizeCheckRows rows, so a part can exceed
+// the limit by up to the writer's buffer.
+func (o *outputFile) full() bool {
+	if *maxRows > 0 && o.rows >= *maxRows {
+		return true
+	}
+	if *maxSize > 0 && o.rows > 0 && o.rows%sizeCheckRows == 0 {
+		if st, err := os.Stat(o.name); err == nil && st.Size() >= int64(*maxSize)<<20 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// partName returns the name of a part of the output file outname, which is
+// written to a directory named after outname: out/2019-01.csv.gz becomes
+// out/2019-01/part-0001.csv.gz
+func partName(outname string, part int) string {
+	gz := ""
+	if strings.HasSuffix(outname, ".gz") {
+		outname, gz = strings.TrimSuffix(outname, ".gz"), ".gz"
+	}
+	ext := filepath.Ext(outname)
+
+	return filepath.Join(strings.TrimSuffix(outname, ext), fmt.Sprintf("part-%04d%s%s", part, ext, gz))
+}
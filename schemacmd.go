@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// version of flightsense recorded in generated schemas, set when building a release
+// with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// Namespace of the Avro schema of the enriched records
+const avroNamespace = "com.github.leonm1.flightsense"
+
+// schemaCommand defines the flags of schema on fs and returns its function, which
+// prints the schema of the enriched records for non-Go consumers
+func schemaCommand(fs *flag.FlagSet) func(args []string) {
+	format := fs.String("format", "jsonschema", "Schema language: 'jsonschema' or 'avro'")
+	v := fs.Int("schema-version", legacySchema, "Output schema version: 1 for the legacy 19 columns, or 2 (FlightV2)")
+	dedupe := fs.String("dedupe", "", "Optional: the -dedupe mode of the run, 'flag' adding the duplicate column")
+
+	return func(args []string) {
+		if err := setSchemaVersion(*v); err != nil {
+			fatalf("%s", err)
+		}
+		if err := setupDedupe(*dedupe); err != nil {
+			fatalf("%s", err)
+		}
+
+		b, err := schema(*format)
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		fmt.Fprintln(os.Stdout, string(b))
+	}
+}
+
+// schema returns the schema of the selected output columns in the named language
+func schema(format string) ([]byte, error) {
+	switch format {
+	case "jsonschema":
+		return output.JSONSchema(schemaName(), version, header)
+	case "avro":
+		return output.AvroSchema(schemaName(), avroNamespace, version, header)
+	}
+
+	return nil, fmt.Errorf("Unknown schema format '%s'", format)
+}
+
+// schemaSidecar returns the name of the schema file written beside an output file
+func schemaSidecar(format string, name string) string {
+	base := strings.TrimSuffix(name, ".gz")
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	if format == "avro" {
+		return base + ".avsc"
+	}
+
+	return base + ".schema.json"
+}
+
+// writeSchemaSidecar writes the schema of the output file name beside it
+func writeSchemaSidecar(format string, name string) error {
+	b, err := schema(format)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(schemaSidecar(format, name), append(b, '\n'), 0644)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// apiKeySecret is where Docker and Kubernetes secrets holding the API key are mounted
+const apiKeySecret = "/run/secrets/dark_sky_api_key"
+
+// setupAPIKey gives the weather package the Dark Sky API key, read from the first of
+// filename, the DARK_SKY_API_KEY environment variable or .env file, and apiKeySecret
+// which has one
+func setupAPIKey(filename string) error {
+	if filename != "" {
+		key, err := readAPIKey(filename)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			return fmt.Errorf("API key file '%s' is empty", filename)
+		}
+
+		weather.SetAPIKey(key)
+		debugf("Read the API key from '%s'", filename)
+		return nil
+	}
+
+	// .env doesn't override the environment, and is optional as the key may be set elsewhere
+	if err := godotenv.Load(".env"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Cannot read .env: %s", err)
+	}
+	if key := strings.TrimSpace(os.Getenv("DARK_SKY_API_KEY")); key != "" {
+		weather.SetAPIKey(key)
+		debugf("Read the API key from DARK_SKY_API_KEY")
+		return nil
+	}
+
+	key, err := readAPIKey(apiKeySecret)
+	if err == nil && key != "" {
+		weather.SetAPIKey(key)
+		debugf("Read the API key from '%s'", apiKeySecret)
+		return nil
+	}
+
+	return fmt.Errorf("API key not found. Set DARK_SKY_API_KEY in the environment or .env, give -api-key-file, or mount it at %s", apiKeySecret)
+}
+
+// readAPIKey reads an API key file, ignoring surrounding whitespace such as the
+// trailing newline editors add
+func readAPIKey(filename string) (string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
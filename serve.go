@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonm1/flightsense-go/output"
+	"github.com/leonm1/flightsense-go/parse"
+	"github.com/leonm1/flightsense-go/weather"
+	darksky "github.com/mlbright/darksky/v2"
+)
+
+// Largest request body of flights to enrich
+const maxServeBody = 32 << 20
+
+// serveCommand defines the flags of serve on fs and returns its function, which
+// serves the weather at airports and the enrichment of flights over HTTP, with the
+// cache and weather providers set up as for processing:
+//
+//	GET  /weather?airport=JFK&time=2017-01-15T08:30:00-05:00
+//	POST /flights, a CSV export with its header, or JSON lines sent as application/x-ndjson
+//	GET  /healthz
+func serveCommand(fs *flag.FlagSet) func(args []string) {
+	addr := fs.String("addr", "localhost:8080", "Address to listen on")
+	fs.StringVar(sourceProfile, "source-profile", "auto", "Input column names, as for processing")
+	mapping := fs.String("source-mapping", "", "Optional: YAML file mapping the legacy input column names to the input's, as for processing")
+	fs.StringVar(overrides, "overrides", "", "Optional: CSV of airlines and airports missing from the bundled datasets, as for processing")
+	fs.BoolVar(keepUnknown, "keep-unknown", true, "Keep flights of unknown airlines and airports, as for processing")
+	fs.StringVar(endpoints, "endpoints", "", "Optional: Comma separated Dark Sky-compatible base URLs with optional weights, as for processing")
+	fs.StringVar(apiKeyFile, "api-key-file", "", "Optional: File holding the Dark Sky API key, as for processing")
+	fs.StringVar(stations, "stations", "", "Optional: CSV of airport,station,latitude,longitude mapping airports to preferred weather stations, as for processing")
+	fs.StringVar(lockPolicy, "lock", "fail", "When another run holds the cache: 'wait', 'fail' or 'readonly'")
+	fs.IntVar(maxRequests, "requests", 0, "Number of weather provider requests in flight at once, as for processing")
+	fs.IntVar(schemaVer, "schema-version", legacySchema, "Output schema version of the enriched flights, as for processing")
+	fs.StringVar(columnList, "columns", "", "Optional: Comma separated columns of the enriched flights, as for processing")
+	opts := cacheFlags(fs)
+	config := fs.String("config", "", "Optional: YAML config file, as for processing. Settings of flags serve doesn't have are ignored.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense serve [-addr localhost:8080] [flags]")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) {
+		err := applyConfig(fs, *config, false)
+		check(err)
+
+		err = setupAPIKey(*apiKeyFile)
+		check(err)
+		err = checkProfile(*sourceProfile)
+		check(err)
+		if *overrides != "" {
+			err = loadOverrides(*overrides)
+			check(err)
+		}
+		if *mapping != "" {
+			err = loadMapping(*mapping)
+			check(err)
+		}
+		if *endpoints != "" {
+			err = weather.SetEndpoints(*endpoints)
+			check(err)
+		}
+		if *stations != "" {
+			err = weather.LoadStations(*stations)
+			check(err)
+		}
+		err = setSchemaVersion(*schemaVer)
+		check(err)
+		err = setupDedupe("")
+		check(err)
+		err = selectColumns(*columnList)
+		check(err)
+
+		releaseLocks := acquireLocks(*lockPolicy, opts.path(), "")
+		closeCache := opts.load()
+		shutdown := onShutdown(closeCache, releaseLocks)
+		defer shutdown()
+
+		// Parsers and provider requests are tuned while serving
+		stopTuning := setupConcurrency()
+		defer stopTuning()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/weather", serveWeather)
+		mux.HandleFunc("/flights", serveFlights)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})
+
+		// A signal stops the server once the requests in progress are answered
+		srv := &http.Server{Addr: *addr, Handler: mux}
+		go func() {
+			<-runCtx.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+			defer cancel()
+			srv.Shutdown(ctx)
+		}()
+
+		infof("Serving on %s", *addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fatalf("%s", err)
+		}
+		if !interrupted() {
+			stopped(shutdown)
+		}
+		logUsage(weather.Usage())
+	}
+}
+
+// weatherResponse is the weather at an airport served by /weather
+type weatherResponse struct {
+	Airport  string             `json:"airport"`
+	Time     time.Time          `json:"time"`
+	Provider string             `json:"provider,omitempty"`
+	Cached   bool               `json:"cached"`
+	Observed *time.Time         `json:"observed,omitempty"`
+	Weather  *darksky.DataPoint `json:"weather"`
+}
+
+// serveWeather answers with the weather at the airport and time of the query
+func serveWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	a, err := lookupAirport(strings.ToUpper(q.Get("airport")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	t, err := time.Parse(time.RFC3339, q.Get("time"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot parse time: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	dp, src, err := airportWeather(r.Context(), a, t)
+	if err == weather.ErrNoData {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp := weatherResponse{Airport: a.IATA, Time: t, Provider: src.Provider, Cached: src.Cached, Weather: dp}
+	if !src.Time.IsZero() {
+		resp.Observed = &src.Time
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveFlights answers with the posted flights enriched, as JSON lines of the
+// selected columns in the order they were posted. Rows which cannot be parsed or
+// have no weather are left out and counted in the X-Rejected-Rows header.
+func serveFlights(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := "request.csv"
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		name = "request.jsonl"
+	}
+	in := newReader(http.MaxBytesReader(w, r.Body, maxServeBody), name)
+
+	h, err := in.Read()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot read header: %s", err), http.StatusBadRequest)
+		return
+	}
+	h, err = mapHeader(append([]string(nil), h...))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cols := parse.NewIndex(h)
+
+	var flights []*Flight
+	rejected := 0
+	for seq := 0; ; seq++ {
+		row, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			rejected++
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, err := parseFlight(&inputRow{seq: seq, fields: append([]string(nil), row...)}, cols)
+		if err != nil {
+			rejected++
+			continue
+		}
+		flights = append(flights, f)
+	}
+
+	// Flights are enriched concurrently, and their rows written in order
+	errs := make([]error, len(flights))
+	sem := make(chan struct{}, concurrencyLimit)
+	var wg sync.WaitGroup
+	for i, f := range flights {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, f *Flight) {
+			defer wg.Done()
+			errs[i] = enrichFlight(r.Context(), f)
+			<-sem
+		}(i, f)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if errors.Is(err, weather.ErrNoData) {
+			rejected++
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Could not get weather for %s", err), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Rejected-Rows", strconv.Itoa(rejected))
+	out := output.NewJSONLStream(w)
+	if err := out.WriteHeader(header); err != nil {
+		warnf("Cannot write flights: %s", err)
+		return
+	}
+	for i, f := range flights {
+		if errs[i] != nil {
+			continue
+		}
+		row := f.toSlice()
+		err := out.WriteRow(*row)
+		rowPool.Put(row)
+		if err != nil {
+			warnf("Cannot write flights: %s", err)
+			return
+		}
+	}
+	if err := out.Close(); err != nil {
+		warnf("Cannot write flights: %s", err)
+	}
+}
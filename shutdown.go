@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long an interrupted run has to stop before it is cleaned up and exited anyway
+const shutdownGrace = 30 * time.Second
+
+// onShutdown returns a function running cleanup once, in order. When the process is
+// interrupted or terminated, the run is canceled so the rows in flight are written
+// and it exits through cleanup. A second signal, or the run not stopping within
+// shutdownGrace, runs cleanup and exits at once, so the cache is still flushed and
+// closed cleanly rather than losing the weather fetched so far.
+func onShutdown(cleanup ...func()) func() {
+	var once sync.Once
+
+	run := func() {
+		once.Do(func() {
+			for _, f := range cleanup {
+				f()
+			}
+		})
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		infof("Received %s, stopping once the rows in flight are written", sig)
+		cancelRun(signalError{sig})
+
+		select {
+		case sig = <-sigc:
+			infof("Received %s again, flushing cache before exiting", sig)
+		case <-time.After(shutdownGrace):
+			infof("Still running %s after %s, flushing cache before exiting", sig, shutdownGrace)
+		}
+		run()
+		os.Exit(exitFatal)
+	}()
+
+	return run
+}
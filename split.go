@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Least size of each chunk of a split input, as each has its own pipeline and
+// output files
+const minSplitChunk = 1 << 20
+
+// inputChunk is a range of the lines of an input file, enriched by readFile apart
+// from the rest of the input. Chunks after the first are read after the header line.
+type inputChunk struct {
+	index  int
+	header []byte
+	start  int64
+	end    int64
+}
+
+// open reads the chunk of filename, preceded by its header line
+func (c *inputChunk) open(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := io.MultiReader(bytes.NewReader(c.header), io.NewSectionReader(f, c.start, c.end-c.start))
+
+	return &closeBoth{io.NopCloser(r), f}, nil
+}
+
+// locate returns a parse error of the chunk, whose lines are numbered from the
+// chunk's start as the lines before it aren't counted
+func (c *inputChunk) locate(err *csv.ParseError) error {
+	e := *err
+	if c.header != nil {
+		e.StartLine--
+		e.Line--
+	}
+
+	return fmt.Errorf("chunk %d from byte %d, %s", c.index+1, c.start, &e)
+}
+
+// splitInput returns the chunks of an input split by -split: up to that many ranges
+// of about the same size, starting at the beginnings of lines. Inputs which can't be
+// read from any offset, or are too small to split, have no chunks.
+func splitInput(filename string) []*inputChunk {
+	lower := strings.ToLower(filename)
+	if *splitChunks <= 1 || filename == stdin || isURL(filename) || !strings.HasSuffix(lower, ".csv") || !byteLines() {
+		return nil
+	}
+
+	chunks, err := splitFile(filename, *splitChunks)
+	if err != nil {
+		warnf("Cannot split '%s', reading it whole: %s", filename, err)
+		return nil
+	}
+
+	return chunks
+}
+
+// splitFile splits filename into up to n chunks at line boundaries
+func splitFile(filename string, n int) ([]*inputChunk, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if most := int(size / minSplitChunk); n > most {
+		n = most
+	}
+	if n < 2 {
+		return nil, nil
+	}
+
+	// Inputs without a header start every chunk with data
+	first, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, nil
+	}
+	var header []byte
+	if hasHeader(first) {
+		header = first
+	}
+
+	var chunks []*inputChunk
+	start := int64(0)
+	for i := 1; i <= n; i++ {
+		end := size
+		if i < n {
+			end, err = lineStart(f, size, size*int64(i)/int64(n))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Lines longer than a chunk leave nothing between two boundaries
+		if end <= start {
+			continue
+		}
+
+		c := &inputChunk{index: len(chunks), start: start, end: end}
+		if start > 0 {
+			c.header = header
+		}
+		chunks = append(chunks, c)
+		start = end
+	}
+
+	return chunks, nil
+}
+
+// lineStart returns the offset of the first line of f starting at or after off
+func lineStart(f *os.File, size int64, off int64) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, off-1, size-off+1))
+	skipped, err := r.ReadBytes('\n')
+	if err == io.EOF {
+		return size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return off - 1 + int64(len(skipped)), nil
+}
+
+// hasHeader reports whether the first line of a csv input is a header rather than
+// data, as newReader decides
+func hasHeader(line []byte) bool {
+	if *noHeader {
+		return false
+	}
+
+	r := csv.NewReader(decodeInput(bytes.NewReader(line)))
+	r.Comma = inputComma
+	if r.Comma == 0 {
+		r.Comma = sniffDelimiter(line)
+	}
+	row, err := r.Read()
+
+	return err != nil || !isDataRow(row)
+}
+
+// chunkName is the name of the part of the file name written by chunk i
+func chunkName(name string, i int) string {
+	return fmt.Sprintf("%s.chunk%03d", name, i+1)
+}
+
+// readChunks enriches the chunks of an input at once, each into output and rejects
+// files of its own, which are then joined in order into name and rejectsName. It
+// returns the rows written to name, like readFile.
+func readChunks(in string, chunks []*inputChunk, name string, rejectsName string) map[string]int {
+	infof("Splitting %s into %d chunks", in, len(chunks))
+
+	outs := make([]string, len(chunks))
+	rejs := make([]string, len(chunks))
+	counts := make([]map[string]int, len(chunks))
+	var wg sync.WaitGroup
+	for i, c := range chunks {
+		outs[i] = chunkName(name, i)
+		if rejectsName != "" {
+			rejs[i] = chunkName(rejectsName, i)
+		}
+
+		wg.Add(1)
+		go func(i int, c *inputChunk) {
+			defer wg.Done()
+			counts[i] = readFile(in, c, outs[i], rejs[i], nil)
+		}(i, c)
+	}
+	wg.Wait()
+
+	// The parts of a canceled run are incomplete
+	if canceled() {
+		for i := range chunks {
+			os.Remove(outs[i])
+			if rejs[i] != "" {
+				os.Remove(rejs[i])
+			}
+		}
+		return nil
+	}
+
+	rows := 0
+	for i := range chunks {
+		rows += counts[i][outs[i]]
+	}
+	if err := joinParts(name, outs, *format == "csv"); err != nil {
+		fail("Cannot join the chunks of '%s': %s", name, err)
+		return nil
+	}
+
+	// Chunks without rejected rows have no rejects file
+	if rejectsName != "" {
+		var written []string
+		for _, r := range rejs {
+			if _, err := os.Stat(r); err == nil {
+				written = append(written, r)
+			}
+		}
+		if err := joinParts(rejectsName, written, true); err != nil {
+			fail("Cannot join the chunks of '%s': %s", rejectsName, err)
+			return nil
+		}
+	}
+
+	return map[string]int{name: rows}
+}
+
+// joinParts concatenates the files parts into name in order, removing them. The
+// first line of each part after the first is left out when they have a header.
+func joinParts(name string, parts []string, header bool) error {
+	if len(parts) == 0 {
+		return nil
+	}
+	if err := os.Rename(parts[0], name); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+
+	for _, part := range parts[1:] {
+		if err := appendPart(w, part, header); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// appendPart writes the file part to w, without its header line if it has one, and
+// removes it
+func appendPart(w io.Writer, part string, header bool) error {
+	p, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	r := bufio.NewReaderSize(p, 1<<20)
+	if header {
+		if _, err := r.ReadBytes('\n'); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	return os.Remove(part)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// subset picks the rows of an input to process from -offset, -sample and -limit
+type subset struct {
+	offset int
+	left   int
+	p      float64
+	rng    *rand.Rand
+}
+
+// checkSubset checks the row subset flags
+func checkSubset() error {
+	if *offset < 0 || *limit < 0 {
+		return fmt.Errorf("-offset and -limit cannot be negative")
+	}
+	if *sample <= 0 || *sample > 1 {
+		return fmt.Errorf("-sample must be a fraction above 0 and at most 1, not %g", *sample)
+	}
+
+	return nil
+}
+
+// newSubset returns the row subset of an input file. Every file is sampled with
+// the same seed, so reruns process the same rows.
+func newSubset() *subset {
+	return &subset{offset: *offset, left: *limit, p: *sample, rng: rand.New(rand.NewSource(*sampleSeed))}
+}
+
+// next reports whether to process the next row of the input, and whether any
+// later row can be processed
+func (s *subset) next() (keep bool, more bool) {
+	if *limit > 0 && s.left == 0 {
+		return false, false
+	}
+
+	if s.offset > 0 {
+		s.offset--
+		return false, true
+	}
+	if s.p < 1 && s.rng.Float64() >= s.p {
+		return false, true
+	}
+
+	s.left--
+	return true, true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonm1/flightsense-go/metrics"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// Exit codes of a processing run. Fatal errors exit through fatalf with 1.
+const (
+	exitOK      = 0 // Every input row was written or filtered out
+	exitFatal   = 1 // The run failed
+	exitUsage   = 2 // The command line is invalid
+	exitPartial = 3 // The run finished but some rows were rejected or malformed
+)
+
+// Input rows of the run: read from the inputs, written to the outputs, rejected,
+// and left out by the filters or as duplicates
+var rowsRead, rowsWritten, rowsRejected, rowsFiltered int64
+
+// runSummary describes a finished run for orchestration tools
+type runSummary struct {
+	Status    string                  `json:"status"`
+	ExitCode  int                     `json:"exitCode"`
+	Started   time.Time               `json:"started"`
+	Finished  time.Time               `json:"finished"`
+	Duration  float64                 `json:"durationSeconds"`
+	Inputs    int                     `json:"inputs"`
+	RowsIn    int64                   `json:"rowsIn"`
+	RowsOut   int64                   `json:"rowsOut"`
+	Rejected  int64                   `json:"rejected"`
+	Filtered  int64                   `json:"filtered"`
+	Malformed int64                   `json:"malformed"`
+	APICalls  int                     `json:"apiCalls"`
+	Providers []weather.ProviderUsage `json:"providers"`
+}
+
+// exitCode returns the exit code of a run which finished without fatal errors
+func exitCode() int {
+	if atomic.LoadInt64(&rowsRejected) > 0 || atomic.LoadInt64(&malformed) > 0 {
+		return exitPartial
+	}
+
+	return exitOK
+}
+
+// writeRunSummary writes the summary of a run which started at start to filename
+func writeRunSummary(filename string, start time.Time, inputs int, usage []weather.ProviderUsage) error {
+	s := runSummary{
+		Status:    "success",
+		ExitCode:  exitCode(),
+		Started:   start.UTC(),
+		Finished:  time.Now().UTC(),
+		Duration:  time.Since(start).Seconds(),
+		Inputs:    inputs,
+		RowsIn:    atomic.LoadInt64(&rowsRead),
+		RowsOut:   atomic.LoadInt64(&rowsWritten),
+		Rejected:  atomic.LoadInt64(&rowsRejected),
+		Filtered:  atomic.LoadInt64(&rowsFiltered),
+		Malformed: atomic.LoadInt64(&malformed),
+		Providers: usage,
+	}
+	if s.ExitCode == exitPartial {
+		s.Status = "partial"
+	}
+	for _, u := range usage {
+		s.APICalls += u.Calls
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// logUsage prints the requests made to each weather provider during the run
+func logUsage(usage []weather.ProviderUsage) {
+	if len(usage) == 0 {
+		infof("No weather provider requests were made")
+		return
+	}
+
+	for _, u := range usage {
+		infof("Provider %s: %d requests, estimated cost $%.4f", u.Provider, u.Calls, u.Cost)
+	}
+}
+
+// logLatencies prints the latency percentiles of each instrumented stage
+func logLatencies() {
+	for _, name := range metrics.Names() {
+		s := metrics.Get(name).Summary()
+		infof("Latency %s: n=%d p50=%s p95=%s p99=%s max=%s", name, s.Count, s.P50, s.P95, s.P99, s.Max)
+	}
+}
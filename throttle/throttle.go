@@ -0,0 +1,96 @@
+// Package throttle bounds how many goroutines do a kind of work at once, to a limit
+// which can be tuned while the work runs
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter lets at most its limit of callers hold it at once
+type Limiter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	held    int
+	calls   int64
+	waited  int64
+	busy    time.Duration
+	changed time.Time
+}
+
+// New returns a Limiter of n holders
+func New(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+
+	l := &Limiter{limit: n, changed: time.Now()}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire blocks until fewer than the limit hold the Limiter, then holds it
+func (l *Limiter) Acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held >= l.limit {
+		l.waited++
+	}
+	for l.held >= l.limit {
+		l.cond.Wait()
+	}
+	l.account()
+	l.held++
+	l.calls++
+}
+
+// Release lets another caller hold the Limiter
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.account()
+	l.held--
+	l.cond.Signal()
+}
+
+// SetLimit changes the number of holders. Callers already holding the Limiter keep
+// it when the limit is lowered.
+func (l *Limiter) SetLimit(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = n
+	l.cond.Broadcast()
+}
+
+// Limit returns the number of holders
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
+
+// Stats returns the number of Acquire calls, how many of them had to wait, and the
+// total time the Limiter has been held summed over its holders, since it was created
+func (l *Limiter) Stats() (calls int64, waited int64, busy time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.account()
+	return l.calls, l.waited, l.busy
+}
+
+// account adds the time held since the last change in holders to busy
+func (l *Limiter) account() {
+	now := time.Now()
+	l.busy += time.Duration(l.held) * now.Sub(l.changed)
+	l.changed = now
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/leonm1/airports-go"
+	"github.com/leonm1/flightsense-go/parse"
+	"github.com/leonm1/flightsense-go/weather"
+)
+
+// Number of parse errors listed by validate
+const validateExamples = 5
+
+// validateCommand defines the flags of validate on fs and returns its function, which
+// checks that input files can be processed and estimates the weather provider calls
+// processing them would make, before a long run is started
+func validateCommand(fs *flag.FlagSet) func(args []string) {
+	sample := fs.Int("sample", 10000, "Number of rows of each file to parse (0 for all)")
+	fs.StringVar(sourceProfile, "source-profile", "auto", "Input column names, as for processing")
+	mapping := fs.String("source-mapping", "", "Optional: YAML file mapping the legacy input column names to the input's")
+	fs.StringVar(overrides, "overrides", "", "Optional: CSV of airlines and airports missing from the bundled datasets, as for processing")
+	fs.BoolVar(keepUnknown, "keep-unknown", true, "Keep flights of unknown airlines and airports, as for processing")
+	fs.StringVar(inEncoding, "encoding", "utf-8", "Character encoding of the inputs, as for processing")
+	opts := cacheFlags(fs)
+	config := fs.String("config", "", "Optional: YAML config file, as for processing. Settings of flags validate doesn't have are ignored.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flightsense validate [flags] file.csv...")
+		fs.PrintDefaults()
+	}
+
+	return func(args []string) {
+		err := applyConfig(fs, *config, false)
+		check(err)
+
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		err = checkProfile(*sourceProfile)
+		check(err)
+		err = setEncoding(*inEncoding)
+		check(err)
+		if *overrides != "" {
+			err = loadOverrides(*overrides)
+			check(err)
+		}
+		if *mapping != "" {
+			err = loadMapping(*mapping)
+			check(err)
+		}
+
+		// The cache is only read, to find the weather already fetched
+		opts.mode, opts.flush = "read-only", 0
+		release := opts.load()
+
+		ok := true
+		for _, in := range args {
+			if !validateInput(in, *sample) {
+				ok = false
+			}
+		}
+		release()
+
+		if !ok {
+			os.Exit(1)
+		}
+	}
+}
+
+// validateInput reports on the header, parse errors and uncached weather of an
+// input file, returning false if it cannot be processed
+func validateInput(filename string, sample int) bool {
+	fmt.Printf("%s:\n", filename)
+
+	f, err := openInput(filename)
+	if err != nil {
+		fmt.Printf("  cannot open: %s\n", err)
+		return false
+	}
+	defer f.Close()
+
+	r := newReader(f, filename)
+	h, err := r.Read()
+	if err != nil {
+		fmt.Printf("  cannot read header: %s\n", err)
+		return false
+	}
+	h = append([]string(nil), h...)
+
+	h, err = mapHeader(h)
+	if err != nil {
+		fmt.Printf("  %s\n", err)
+		return false
+	}
+	cols := parse.NewIndex(h)
+
+	var (
+		rows, parsed, failed int
+		examples             []string
+		needed               = make(map[string]bool)
+		calls                = make(map[string]bool)
+	)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); !ok && err != nil {
+			fmt.Printf("  cannot read: %s\n", err)
+			return false
+		}
+
+		rows++
+		if sample > 0 && parsed+failed >= sample {
+			continue
+		}
+		if err != nil {
+			failed++
+			if len(examples) < validateExamples {
+				examples = append(examples, err.Error())
+			}
+			continue
+		}
+
+		fl, err := parseFlight(&inputRow{seq: rows, fields: row}, cols)
+		if err != nil {
+			failed++
+			if len(examples) < validateExamples {
+				examples = append(examples, fmt.Sprintf("row %d: %s", rows, err))
+			}
+			continue
+		}
+		parsed++
+
+		// Each provider call caches every hour of a day at an airport
+		hour := fl.ScheduledDep.Round(time.Hour)
+		for _, a := range []airports.Airport{fl.Origin, fl.Destination} {
+			k := weather.Key(a.IATA, hour)
+			if needed[k] || isUnknown(a) {
+				continue
+			}
+			needed[k] = true
+
+			if !weather.Cached(a, hour) {
+				calls[a.IATA+"|"+hour.UTC().Format("2006-01-02")] = true
+			}
+		}
+	}
+
+	fmt.Printf("  header: ok (%d columns)\n", len(h))
+	fmt.Printf("  rows: %d, parsed %d, failed %d\n", rows, parsed, failed)
+	for _, e := range examples {
+		fmt.Printf("    %s\n", e)
+	}
+
+	// Scale the sample up to the whole file
+	estimate := len(calls)
+	if checked := parsed + failed; checked > 0 && checked < rows {
+		estimate = estimate * rows / checked
+		fmt.Printf("  weather: %d airport-hours needed in the sample, about %d provider calls for the file\n", len(needed), estimate)
+	} else {
+		fmt.Printf("  weather: %d airport-hours needed, about %d provider calls\n", len(needed), estimate)
+	}
+
+	if rows > 0 && parsed == 0 {
+		fmt.Println("  no rows could be parsed")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+// parseRequired returns the selected output columns named in a comma separated
+// list, checking that each is a known column
+func parseRequired(list string) ([]string, error) {
+	var cols []string
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if _, ok := findColumn(name); !ok {
+			return nil, fmt.Errorf("Unknown required column '%s'", name)
+		}
+
+		// Columns left out of the output can't be checked
+		for _, c := range header {
+			if c.Name == name {
+				cols = append(cols, name)
+			}
+		}
+	}
+
+	return cols, nil
+}
+
+// countRows returns the number of rows in an existing output file, or 0 if it
+// doesn't exist yet
+func countRows(filename string, format string) int {
+	if _, err := os.Stat(filename); err != nil {
+		return 0
+	}
+
+	n := 0
+	_, err := scanOutput(filename, format, func(map[string]string) { n++ })
+	if err != nil {
+		fatalf("Cannot read '%s': %s", filename, err)
+	}
+
+	return n
+}
+
+// verifyOutput re-reads a written output file and checks that its header matches
+// the output columns, that it holds the expected number of rows and that none of
+// the required columns are empty
+func verifyOutput(filename string, format string, rows int, required []string) error {
+	var problems []string
+
+	n := 0
+	empty := make(map[string]int)
+	cols, err := scanOutput(filename, format, func(row map[string]string) {
+		n++
+		for _, c := range required {
+			if row[c] == "" {
+				empty[c]++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	want := make([]string, len(header))
+	for i, c := range header {
+		want[i] = c.Name
+	}
+	if strings.Join(cols, ",") != strings.Join(want, ",") {
+		problems = append(problems, fmt.Sprintf("header is %v, expected %v", cols, want))
+	}
+
+	if n != rows {
+		problems = append(problems, fmt.Sprintf("found %d rows, wrote %d", n, rows))
+	}
+
+	for _, c := range required {
+		if empty[c] > 0 {
+			problems = append(problems, fmt.Sprintf("required column '%s' is empty in %d rows", c, empty[c]))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// scanOutput calls row with the values of each row of an output file, keyed by
+// column name, and returns the file's column names
+func scanOutput(filename string, format string, row func(values map[string]string)) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r = z
+	}
+
+	switch format {
+	case "csv":
+		return scanCSV(r, row)
+	case "jsonl":
+		return scanJSONL(r, row)
+	}
+
+	return nil, fmt.Errorf("Cannot verify %s output", format)
+}
+
+func scanCSV(f io.Reader, row func(values map[string]string)) ([]string, error) {
+	r := output.NewCSVReader(f)
+
+	cols, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read header: %s", err)
+	}
+
+	for rec, err := r.Read(); err == nil; rec, err = r.Read() {
+		values := make(map[string]string, len(cols))
+		for i, c := range cols {
+			values[c] = rec[i]
+		}
+		row(values)
+	}
+
+	return cols, nil
+}
+
+// scanJSONL takes the column names from the keys of the first object, in order
+func scanJSONL(f io.Reader, row func(values map[string]string)) ([]string, error) {
+	var cols []string
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if line == 1 {
+			keys, err := jsonKeys(scanner.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("Line 1: %s", err)
+			}
+			cols = keys
+		}
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &obj); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+
+		values := make(map[string]string, len(obj))
+		for k, v := range obj {
+			if v != nil {
+				values[k] = fmt.Sprint(v)
+			}
+		}
+		row(values)
+	}
+
+	return cols, scanner.Err()
+}
+
+// jsonKeys returns the keys of a JSON object in the order they appear
+func jsonKeys(b []byte) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("Expected a JSON object")
+	}
+
+	var keys []string
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+
+		var skip json.RawMessage
+		if err := d.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
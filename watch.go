@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Time a new input must go unmodified before it is processed, so files still being
+// copied into the directory aren't read part written
+const watchSettle = 2 * time.Second
+
+// doneDir is the directory below the watched directory which processed inputs are moved to
+const doneDir = "done"
+
+// watchDir is the input directory watched by -watch, with the patterns new inputs must match
+type watchDir struct {
+	path    string
+	include []string
+	exclude []string
+}
+
+// watch processes the input files which appear in the directory, one at a time,
+// until ctx is canceled. Each input is moved to done/ once processed.
+func (d *watchDir) watch(ctx context.Context, process func(filename string, rel string)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := w.Add(d.path); err != nil {
+		return err
+	}
+	infof("Watching '%s' for new inputs", d.path)
+
+	// Inputs by the time they last changed
+	pending := make(map[string]time.Time)
+	tick := time.NewTicker(watchSettle / 2)
+	defer tick.Stop()
+
+	for {
+		select {
+		case ev := <-w.Events:
+			if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			rel := filepath.Base(ev.Name)
+			if isInput(rel) && (len(d.include) == 0 || matchAny(d.include, rel)) && !matchAny(d.exclude, rel) {
+				pending[ev.Name] = time.Now()
+			}
+
+		case err := <-w.Errors:
+			warnf("Error watching '%s': %s", d.path, err)
+
+		case <-ctx.Done():
+			return nil
+
+		case now := <-tick.C:
+			var ready []string
+			for name, changed := range pending {
+				if now.Sub(changed) >= watchSettle {
+					ready = append(ready, name)
+					delete(pending, name)
+				}
+			}
+			sort.Strings(ready)
+
+			for _, name := range ready {
+				// Inputs removed again before settling
+				if _, err := os.Stat(name); err != nil {
+					continue
+				}
+
+				// Inputs of a canceled run are left to process again
+				process(name, filepath.Base(name))
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err := d.done(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// done moves a processed input to done/ in the watched directory
+func (d *watchDir) done(filename string) error {
+	dir := filepath.Join(d.path, doneDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(filename, filepath.Join(dir, filepath.Base(filename)))
+}
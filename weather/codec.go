@@ -0,0 +1,66 @@
+package weather
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/leonm1/flightsense-go/cache"
+)
+
+func init() {
+	cachemap.SetCodec(gobCodec{})
+}
+
+// gobCodec stores observations as base64-encoded gob followed by |provider, decoding
+// them once when the cache is loaded instead of on every hit
+type gobCodec struct{}
+
+func (gobCodec) Encode(v interface{}) (string, error) {
+	o, ok := v.(*observation)
+	if !ok {
+		return "", fmt.Errorf("Cannot cache a %T", v)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&o.DataPoint); err != nil {
+		return "", err
+	}
+
+	s := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if o.Provider != "" {
+		s += "|" + o.Provider
+	}
+
+	return s, nil
+}
+
+func (gobCodec) Decode(s string) (interface{}, error) {
+	var o observation
+
+	// Older caches stored observations as JSON
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &o.DataPoint); err != nil {
+			return nil, err
+		}
+		return &o, nil
+	}
+
+	// Observations cached before providers were recorded have none
+	if i := strings.LastIndexByte(s, '|'); i >= 0 {
+		s, o.Provider = s[:i], s[i+1:]
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&o.DataPoint); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
@@ -0,0 +1,259 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonm1/flightsense-go/throttle"
+	darksky "github.com/mlbright/darksky/v2"
+)
+
+// endpoint is a base URL serving the Dark Sky forecast API, such as a team's caching proxy
+type endpoint struct {
+	base    string
+	weight  int
+	healthy int32
+}
+
+var (
+	endpointsMu sync.RWMutex
+	endpoints   = []*endpoint{{base: darkSkyURL, weight: 1, healthy: 1}}
+
+	client = &http.Client{Timeout: 60 * time.Second}
+
+	// requests bounds the provider requests in flight
+	requests = throttle.New(8)
+
+	// apiKey is sent in the path of every request, set by SetAPIKey
+	apiKey string
+
+	// pinned sends every request to the first endpoint, set by PinEndpoint
+	pinned bool
+)
+
+// Requests returns the limiter of provider requests in flight, whose limit the caller
+// may tune
+func Requests() *throttle.Limiter {
+	return requests
+}
+
+// SetAPIKey sets the Dark Sky API key weather is requested with
+func SetAPIKey(key string) {
+	apiKey = key
+}
+
+// redact replaces the API key in an error with REDACTED. Errors of failed requests
+// include their URL, which holds the key.
+func redact(err error) error {
+	if err == nil || apiKey == "" || !strings.Contains(err.Error(), apiKey) {
+		return err
+	}
+
+	return errors.New(strings.ReplaceAll(err.Error(), apiKey, "REDACTED"))
+}
+
+// SetEndpoints replaces the Dark Sky-compatible endpoints weather is requested from.
+// spec is a comma separated list of base URLs, each optionally followed by =weight;
+// requests are spread across healthy endpoints in proportion to their weights.
+func SetEndpoints(spec string) error {
+	var eps []*endpoint
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		e := &endpoint{base: item, weight: 1, healthy: 1}
+		if i := strings.LastIndex(item, "="); i > 0 {
+			w, err := strconv.Atoi(item[i+1:])
+			if err != nil || w < 1 {
+				return fmt.Errorf("Invalid weight for endpoint '%s'", item)
+			}
+			e.base, e.weight = item[:i], w
+		}
+
+		if _, err := url.Parse(e.base); err != nil {
+			return fmt.Errorf("Invalid endpoint '%s': %s", e.base, err)
+		}
+		if !strings.HasSuffix(e.base, "/") {
+			e.base += "/"
+		}
+		eps = append(eps, e)
+	}
+
+	if len(eps) == 0 {
+		return fmt.Errorf("No endpoints in '%s'", spec)
+	}
+
+	endpointsMu.Lock()
+	endpoints = eps
+	endpointsMu.Unlock()
+
+	return nil
+}
+
+// PinEndpoint sends every request to the first configured endpoint, without a
+// weighted choice or failing over to the others, so which provider served a run
+// doesn't depend on timing
+func PinEndpoint() {
+	pinned = true
+}
+
+// StartHealthChecks probes unhealthy endpoints every interval and returns them to
+// rotation once they respond again
+func StartHealthChecks(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			endpointsMu.RLock()
+			eps := endpoints
+			endpointsMu.RUnlock()
+
+			for _, e := range eps {
+				if atomic.LoadInt32(&e.healthy) == 0 && e.probe() {
+					slog.Info("Weather endpoint is healthy again", "endpoint", e.host())
+					atomic.StoreInt32(&e.healthy, 1)
+				}
+			}
+		}
+	}()
+}
+
+// fetch requests the forecast for a location and time from the configured endpoints,
+// failing over to the next endpoint when one errors. It returns the provider name
+// which served the request for usage accounting. Endpoints stay in rotation when
+// ctx is canceled, as the request was abandoned rather than failed.
+func fetch(ctx context.Context, lat string, lon string, station string, t int64) (*darksky.Forecast, string, error) {
+	var lastErr error
+
+	requests.Acquire()
+	defer requests.Release()
+
+	for _, e := range order() {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+
+		f, err := e.get(ctx, lat, lon, station, t)
+		if err == nil {
+			return f, e.provider(), nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+
+		lastErr = err
+		if atomic.CompareAndSwapInt32(&e.healthy, 1, 0) {
+			slog.Warn("Weather endpoint failed, taking it out of rotation", "endpoint", e.host(), "err", err)
+		}
+	}
+
+	return nil, "", lastErr
+}
+
+// order returns the endpoints to try: a weighted random choice among the healthy
+// endpoints first, then the other healthy endpoints, then the unhealthy ones. Only
+// the first configured endpoint is tried when pinned.
+func order() []*endpoint {
+	endpointsMu.RLock()
+	defer endpointsMu.RUnlock()
+
+	if pinned {
+		return endpoints[:1]
+	}
+
+	var healthy, unhealthy []*endpoint
+	total := 0
+	for _, e := range endpoints {
+		if atomic.LoadInt32(&e.healthy) == 1 {
+			healthy = append(healthy, e)
+			total += e.weight
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+
+	if total > 0 {
+		n := rand.Intn(total)
+		for i, e := range healthy {
+			if n < e.weight {
+				healthy[0], healthy[i] = healthy[i], healthy[0]
+				break
+			}
+			n -= e.weight
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// get requests a forecast from the endpoint. A station is passed as the station
+// query parameter to endpoints which serve a station's observations; Dark Sky
+// ignores it and answers for the coordinates.
+func (e *endpoint) get(ctx context.Context, lat string, lon string, station string, t int64) (*darksky.Forecast, error) {
+	u := fmt.Sprintf("%s%s/%s,%s,%d?units=%s&lang=%s", e.base, apiKey, lat, lon, t, darksky.US, darksky.English)
+	if station != "" {
+		u += "&station=" + url.QueryEscape(station)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, redact(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redact(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", e.host(), resp.Status)
+	}
+
+	var f darksky.Forecast
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// probe reports whether the endpoint answers requests without a server error
+func (e *endpoint) probe() bool {
+	resp, err := client.Get(e.base)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < 500
+}
+
+// provider names the endpoint in usage accounting
+func (e *endpoint) provider() string {
+	if e.base == darkSkyURL {
+		return DarkSky
+	}
+
+	return e.host()
+}
+
+func (e *endpoint) host() string {
+	u, err := url.Parse(e.base)
+	if err != nil {
+		return e.base
+	}
+
+	return u.Host
+}
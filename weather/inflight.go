@@ -0,0 +1,85 @@
+package weather
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// requestsInFlight collapses concurrent provider requests for the same cache key
+var requestsInFlight = flightGroup{calls: make(map[string]*flight)}
+
+// flightGroup runs one call at a time per key, sharing its result with the callers
+// which ask for the key while it runs, as golang.org/x/sync/singleflight does
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a call in progress, whose result is set once done is closed
+type flight struct {
+	done chan struct{}
+	o    *observation
+	src  Source
+	err  error
+
+	// Callers still waiting for the result, and the cancellation of the call's
+	// context once none are
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do calls fn for key, or waits for the call for key already in flight and returns
+// its result, reporting that it was shared. The call runs on a context of its own,
+// so a caller whose ctx is canceled returns ctx's error without failing the others.
+// The call is only canceled once every caller waiting for it has returned.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (*observation, Source, error)) (*observation, Source, bool, error) {
+	g.mu.Lock()
+	f, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = f
+		go g.call(callCtx, key, f, fn)
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.o, f.src, shared, f.err
+	case <-ctx.Done():
+	}
+
+	// Callers asking for the key after the call is canceled start another
+	g.mu.Lock()
+	f.waiters--
+	if f.waiters == 0 {
+		f.cancel()
+		if g.calls[key] == f {
+			delete(g.calls, key)
+		}
+	}
+	g.mu.Unlock()
+
+	return nil, Source{}, shared, ctx.Err()
+}
+
+// call runs fn for key and releases the callers waiting for f, even when fn panics
+func (g *flightGroup) call(ctx context.Context, key string, f *flight, fn func(ctx context.Context) (*observation, Source, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.o, f.src, f.err = nil, Source{}, fmt.Errorf("Weather request for '%s' panicked: %v", key, r)
+		}
+		f.cancel()
+
+		g.mu.Lock()
+		if g.calls[key] == f {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.o, f.src, f.err = fn(ctx)
+}
@@ -0,0 +1,121 @@
+package weather
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForWaiters waits until n callers are waiting for the call for key
+func waitForWaiters(t *testing.T, g *flightGroup, key string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		f, ok := g.calls[key]
+		waiting := ok && f.waiters == n
+		g.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d callers of '%s'", n, key)
+}
+
+// A caller which started the shared request and then gives up doesn't fail the
+// callers still waiting for it
+func TestFlightGroupLeaderCanceled(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flight)}
+	release := make(chan struct{})
+	want := &observation{Provider: "api.darksky.net"}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, _, _, err := g.do(leaderCtx, "JFK@1484438400", func(ctx context.Context) (*observation, Source, error) {
+			select {
+			case <-release:
+				return want, Source{Provider: want.Provider}, nil
+			case <-ctx.Done():
+				return nil, Source{}, ctx.Err()
+			}
+		})
+		leader <- err
+	}()
+	waitForWaiters(t, g, "JFK@1484438400", 1)
+
+	follower := make(chan *observation)
+	go func() {
+		o, _, shared, err := g.do(context.Background(), "JFK@1484438400", func(context.Context) (*observation, Source, error) {
+			t.Error("Follower started a second request")
+			return nil, Source{}, nil
+		})
+		if err != nil || !shared {
+			t.Errorf("Follower got shared %v, error %v", shared, err)
+		}
+		follower <- o
+	}()
+	waitForWaiters(t, g, "JFK@1484438400", 2)
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("Canceled leader got error %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	if o := <-follower; o != want {
+		t.Errorf("Follower got %v, want %v", o, want)
+	}
+}
+
+// The shared request is canceled once every caller has given up
+func TestFlightGroupAllCanceled(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flight)}
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan struct{})
+
+	go g.do(ctx, "JFK@1484438400", func(ctx context.Context) (*observation, Source, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, Source{}, ctx.Err()
+	})
+	waitForWaiters(t, g, "JFK@1484438400", 1)
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shared request wasn't canceled")
+	}
+}
+
+// A panicking request fails its callers instead of leaving them waiting
+func TestFlightGroupPanic(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flight)}
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := g.do(context.Background(), "JFK@1484438400", func(context.Context) (*observation, Source, error) {
+			panic("provider")
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Panicking request returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Caller of a panicking request is still waiting")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.calls) != 0 {
+		t.Errorf("%d calls left in flight", len(g.calls))
+	}
+}
@@ -0,0 +1,46 @@
+package weather
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoData is returned when the provider has no weather for an airport and hour
+var ErrNoData = errors.New("Provider has no weather data")
+
+var (
+	// How long a failed lookup is remembered before the provider is asked again
+	negativeTTL = 10 * time.Minute
+
+	// Expiry times of failed lookups, by cache key
+	misses sync.Map
+)
+
+// SetNegativeTTL sets how long lookups the provider had no data for are remembered,
+// so repeated misses for the same airport and hour don't refetch. 0 disables it.
+func SetNegativeTTL(ttl time.Duration) {
+	negativeTTL = ttl
+}
+
+// knownMiss reports whether the provider recently had no data for key
+func knownMiss(key string) bool {
+	v, ok := misses.Load(key)
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(v.(time.Time)) {
+		misses.Delete(key)
+		return false
+	}
+
+	return true
+}
+
+// recordMiss remembers that the provider had no data for key
+func recordMiss(key string) {
+	if negativeTTL > 0 {
+		misses.Store(key, time.Now().Add(negativeTTL))
+	}
+}
@@ -0,0 +1,90 @@
+package weather
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Station is a weather station preferred over an airport's own coordinates
+type Station struct {
+	ID        string
+	Latitude  float64
+	Longitude float64
+}
+
+var (
+	stationsMu sync.RWMutex
+	stations   = make(map[string]Station)
+)
+
+// LoadStations reads a CSV mapping airports to preferred weather stations with the
+// columns airport,station,latitude,longitude. Observations for a mapped airport are
+// requested at its station's location and with its station ID, which endpoints
+// supporting station queries use; Dark Sky only accepts coordinates.
+func LoadStations(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 4
+	r.TrimLeadingSpace = true
+
+	loaded := make(map[string]Station)
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip the optional header
+		if line == 1 && strings.EqualFold(rec[0], "airport") {
+			continue
+		}
+
+		// Station IDs are part of cache keys
+		if rec[1] == "" || strings.ContainsAny(rec[1], "_@+ \t") {
+			return fmt.Errorf("%s:%d: invalid station '%s'", filename, line, rec[1])
+		}
+
+		lat, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid latitude '%s'", filename, line, rec[2])
+		}
+		lon, err := strconv.ParseFloat(rec[3], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid longitude '%s'", filename, line, rec[3])
+		}
+
+		loaded[strings.ToUpper(rec[0])] = Station{ID: rec[1], Latitude: lat, Longitude: lon}
+	}
+
+	stationsMu.Lock()
+	defer stationsMu.Unlock()
+	for iata, s := range loaded {
+		stations[iata] = s
+	}
+	slog.Info("Loaded weather station mappings", "stations", len(loaded), "file", filename)
+
+	return nil
+}
+
+// StationFor returns the weather station mapped to an airport, if any
+func StationFor(iata string) (Station, bool) {
+	stationsMu.RLock()
+	defer stationsMu.RUnlock()
+
+	s, ok := stations[iata]
+	return s, ok
+}
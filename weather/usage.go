@@ -0,0 +1,55 @@
+package weather
+
+import (
+	"sort"
+	"sync"
+)
+
+// DarkSky is the provider name of the Dark Sky API
+const DarkSky = "darksky"
+
+var (
+	usageMu sync.Mutex
+	calls   = make(map[string]int)
+
+	// Estimated price in USD of a single request to each provider
+	prices = map[string]float64{
+		DarkSky: 0.0001,
+	}
+)
+
+// ProviderUsage holds the number of requests made to a provider and their estimated cost
+type ProviderUsage struct {
+	Provider string
+	Calls    int
+	Cost     float64
+}
+
+// SetPrice sets the estimated price of a single request to provider
+func SetPrice(provider string, price float64) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	prices[provider] = price
+}
+
+// Usage returns the requests made to each provider so far, sorted by provider name
+func Usage() []ProviderUsage {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	ret := make([]ProviderUsage, 0, len(calls))
+	for p, n := range calls {
+		ret = append(ret, ProviderUsage{Provider: p, Calls: n, Cost: float64(n) * prices[p]})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Provider < ret[j].Provider })
+
+	return ret
+}
+
+func countCall(provider string) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	calls[provider]++
+}
@@ -3,74 +3,337 @@
 package weather
 
 import (
+	"context"
 	"crypto/sha1"
-	"encoding/json"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/leonm1/airports-go"
 	"github.com/leonm1/flightsense-go/cache"
+	"github.com/leonm1/flightsense-go/metrics"
 
 	darksky "github.com/mlbright/darksky/v2"
 )
 
 const darkSkyURL string = "https://api.darksky.net/forecast/"
 
+// Observations read from the cache and requested from providers by Get
+var cacheHits, cacheMisses int64
+
+// CacheHits returns the number of observations read from the cache and requested
+// from providers so far
+func CacheHits() (hits int64, misses int64) {
+	return atomic.LoadInt64(&cacheHits), atomic.LoadInt64(&cacheMisses)
+}
+
+// Source records where an observation came from, for auditing data quality
+type Source struct {
+	// Provider which served the observation. Observations cached before providers
+	// were recorded have none.
+	Provider string
+
+	// Cached is true when the observation was read from the cache
+	Cached bool
+
+	// Time of the observation, which is zero if the provider didn't give one
+	Time time.Time
+}
+
+// observation is a cached observation and the provider which served it
+type observation struct {
+	darksky.DataPoint
+	Provider string
+}
+
+// source returns the provenance of an observation
+func (o *observation) source(cached bool) Source {
+	s := Source{Provider: o.Provider, Cached: cached}
+	if o.Time != 0 {
+		s.Time = time.Unix(o.Time, 0).UTC()
+	}
+
+	return s
+}
+
 // Get fetches the weather data (either from cache or darksky) and returns a map[string]interface{} of the json values
-func Get(a airports.Airport, t time.Time) (*(darksky.DataPoint), error) {
+func Get(ctx context.Context, a airports.Airport, t time.Time) (*(darksky.DataPoint), error) {
+	d, _, err := GetSource(ctx, a, t)
+	return d, err
+}
+
+// GetSource fetches the weather data like Get, and returns where it came from. A
+// provider request fails with ctx's error once ctx is canceled.
+func GetSource(ctx context.Context, a airports.Airport, t time.Time) (*darksky.DataPoint, Source, error) {
 	var (
 		rndTime = t.Round(time.Hour)
-		hash    = fmt.Sprintf("%x", sha1.Sum([]byte(a.IATA+fmt.Sprint(rndTime.Unix()))))
+		hash    = Key(a.IATA, rndTime)
 	)
 
 	// In case of cache hit
-	if res, err := cachemap.Get(hash); err == nil {
-		ret, err := unmarshalCache(res)
-		if err != nil {
-			log.Fatal(err)
+	if o, err := lookup(hash); err == nil {
+		atomic.AddInt64(&cacheHits, 1)
+		return &o.DataPoint, o.source(true), nil
+	}
+
+	// Entries written before keys were readable are moved to the new key on first use.
+	// They were observed at the airport, so they don't stand in for a mapped station's.
+	if _, mapped := StationFor(a.IATA); !mapped {
+		if o, err := lookup(legacyKey(a.IATA, rndTime.Unix())); err == nil {
+			cachemap.Set(hash, o)
+			atomic.AddInt64(&cacheHits, 1)
+			return &o.DataPoint, o.source(true), nil
 		}
-		return ret, nil
 	}
 
-	log.Printf("Weather data does not exist in cache: %s", hash)
+	// The provider had no data for this hour a moment ago
+	if knownMiss(hash) {
+		return nil, Source{}, ErrNoData
+	}
+
+	// Rows needing the same hour at once share a single provider request, whose
+	// observation reaches the others from memory like a cache hit
+	o, src, shared, err := requestsInFlight.do(ctx, hash, func(ctx context.Context) (*observation, Source, error) {
+		return request(ctx, a, rndTime, hash)
+	})
+	if err != nil {
+		return nil, Source{}, err
+	}
+	if shared {
+		atomic.AddInt64(&cacheHits, 1)
+	}
+
+	return &o.DataPoint, src, nil
+}
+
+// request requests the weather for an airport at an hour from the providers and
+// caches it, unless a request which just finished cached it already
+func request(ctx context.Context, a airports.Airport, rndTime time.Time, hash string) (*observation, Source, error) {
+	if o, err := lookup(hash); err == nil {
+		atomic.AddInt64(&cacheHits, 1)
+		return o, o.source(true), nil
+	}
+
+	// Cold caches miss for most rows, so only a running count is logged at info
+	misses := atomic.AddInt64(&cacheMisses, 1)
+	slog.Debug("Weather data does not exist in cache", "key", hash)
+	if metrics.Milestone(misses) {
+		slog.Info("Weather cache misses so far", "misses", misses)
+	}
+
+	// Prefer a mapped weather station to the airport's location
+	lat, lon, station := fmt.Sprint(a.Latitude), fmt.Sprint(a.Longitude), ""
+	if st, ok := StationFor(a.IATA); ok {
+		lat, lon, station = fmt.Sprint(st.Latitude), fmt.Sprint(st.Longitude), st.ID
+	}
 
 	// Form request and get data from darksky
-	f, err := darksky.Get(os.Getenv("DARK_SKY_API_KEY"), fmt.Sprint(a.Latitude), fmt.Sprint(a.Longitude), fmt.Sprint(rndTime.Unix()), darksky.US, darksky.English)
+	start := time.Now()
+	f, provider, err := fetch(ctx, lat, lon, station, rndTime.Unix())
 	if err != nil {
-		log.Print(f)
-		log.Fatalf("Error fetching weather data from darksky: %s", err)
+		return nil, Source{}, err
 	}
+	countCall(provider)
+	metrics.Since("provider_call", start)
 
-	err = cache(a.IATA, f.Hourly.Data)
+	// The observation is still used when it couldn't be cached, but is fetched again
+	// by the next run
+	if err := cache(a.IATA, provider, f.Hourly.Data); err != nil {
+		slog.Warn("Could not cache weather data", "airport", a.IATA, "err", err)
+	}
+
+	// An empty observation means the provider has nothing for this hour, unless the
+	// hourly block covers it
+	dp := f.Currently
+	if dp.Time == 0 {
+		h := hourAt(f.Hourly.Data, rndTime.Unix())
+		if h == nil {
+			recordMiss(hash)
+			return nil, Source{}, ErrNoData
+		}
+		dp = *h
+	}
 
-	return &f.Currently, nil
+	o := &observation{DataPoint: dp, Provider: provider}
+	return o, o.source(false), nil
 }
 
-func cache(iata string, f []darksky.DataPoint) error {
-	var err error
+// hourAt returns the observation in data for the hour starting at unix, or nil if
+// there is none
+func hourAt(data []darksky.DataPoint, unix int64) *darksky.DataPoint {
+	for i := range data {
+		if data[i].Time == unix {
+			return &data[i]
+		}
+	}
+
+	return nil
+}
 
-	for _, v := range f {
-		hash := fmt.Sprintf("%x", sha1.Sum([]byte(iata+fmt.Sprint(v.Time))))
+// Cached reports whether the weather for an airport at the hour nearest t is cached,
+// or known to be unavailable
+func Cached(a airports.Airport, t time.Time) bool {
+	rndTime := t.Round(time.Hour)
+	hash := Key(a.IATA, rndTime)
+
+	if _, err := cachemap.Get(hash); err == nil {
+		return true
+	}
+	if _, mapped := StationFor(a.IATA); !mapped {
+		if _, err := cachemap.Get(legacyKey(a.IATA, rndTime.Unix())); err == nil {
+			return true
+		}
+	}
+
+	return knownMiss(hash)
+}
+
+// cache caches the hourly observations of an airport served by provider, returning
+// the first error of those which could not be cached
+func cache(iata string, provider string, f []darksky.DataPoint) error {
+	var err error
+	failed := 0
 
-		data, err := json.Marshal(v)
-		if err != nil {
-			log.Printf("Error caching data: %s", err)
+	for i := range f {
+		if e := cachemap.Set(key(iata, f[i].Time), &observation{DataPoint: f[i], Provider: provider}); e != nil {
+			if err == nil {
+				err = e
+			}
+			failed++
 		}
+	}
+	if err != nil {
+		return fmt.Errorf("%d of %d hours: %w", failed, len(f), err)
+	}
 
-		cachemap.Set(hash, string(data))
+	return nil
+}
+
+// Lookup returns the cached observation stored under key
+func Lookup(key string) (*darksky.DataPoint, error) {
+	o, err := lookup(key)
+	if err != nil {
+		return nil, err
 	}
 
-	return err
+	return &o.DataPoint, nil
 }
 
-func unmarshalCache(s string) (*(darksky.DataPoint), error) {
-	var d darksky.DataPoint
-	if err := json.NewDecoder(strings.NewReader(s)).Decode(&d); err != nil {
+func lookup(key string) (*observation, error) {
+	defer metrics.Since("cache_get", time.Now())
+
+	v, err := cachemap.Get(key)
+	if err != nil {
 		return nil, err
 	}
 
-	return &d, nil
+	o, ok := v.(*observation)
+	if !ok {
+		return nil, fmt.Errorf("Cached value for '%s' is a %T, not an observation", key, v)
+	}
+
+	return o, nil
+}
+
+// Store caches an observation under key, without the provider which served it
+func Store(key string, d *darksky.DataPoint) error {
+	return cachemap.Set(key, &observation{DataPoint: *d})
+}
+
+// Key returns the cache key of the weather observation for an airport at the hour nearest t.
+// The key of an airport mapped to a weather station names the station, so changing
+// the mapping doesn't serve observations of the airport's location.
+func Key(iata string, t time.Time) string {
+	return key(iata, t.Round(time.Hour).Unix())
+}
+
+func key(iata string, unix int64) string {
+	if st, ok := StationFor(iata); ok {
+		return fmt.Sprintf("%s+%s@%d", iata, st.ID, unix)
+	}
+
+	return airportKey(iata, unix)
+}
+
+// airportKey returns the cache key of the weather observation at an airport's location
+func airportKey(iata string, unix int64) string {
+	return fmt.Sprintf("%s@%d", iata, unix)
+}
+
+// legacyKey returns the hashed cache key used before keys were readable
+func legacyKey(iata string, unix int64) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(iata+fmt.Sprint(unix))))
+}
+
+// ParseKey returns the airport and hour a cache key refers to, whether observed at
+// the airport or at a mapped station. ok is false for legacy hashed keys, which
+// cannot be reversed.
+func ParseKey(k string) (iata string, t time.Time, ok bool) {
+	i := strings.LastIndex(k, "@")
+	if i < 0 {
+		return "", t, false
+	}
+
+	unix, err := strconv.ParseInt(k[i+1:], 10, 64)
+	if err != nil {
+		return "", t, false
+	}
+
+	iata, _, _ = strings.Cut(k[:i], "+")
+	return iata, time.Unix(unix, 0), true
+}
+
+// ShardByAirport names the cache shard of a key after its airport
+func ShardByAirport(k string) string {
+	iata, _, ok := ParseKey(k)
+	if !ok {
+		return "legacy"
+	}
+
+	return iata
+}
+
+// ShardByMonth names the cache shard of a key after its UTC year and month
+func ShardByMonth(k string) string {
+	_, t, ok := ParseKey(k)
+	if !ok {
+		return "legacy"
+	}
+
+	return t.UTC().Format("2006-01")
+}
+
+// Invalidate marks every cached hour for an airport between from and to (inclusive) as invalid,
+// causing the weather to be refetched on next use. The hours of an airport mapped to a
+// weather station are invalidated under both its station's and its own keys. It returns
+// the number of cached hours invalidated.
+func Invalidate(iata string, from time.Time, to time.Time) (int, error) {
+	_, mapped := StationFor(iata)
+	n := 0
+
+	for t := from.Round(time.Hour); !t.After(to); t = t.Add(time.Hour) {
+		keys := []string{Key(iata, t), legacyKey(iata, t.Unix())}
+		if mapped {
+			keys = append(keys, airportKey(iata, t.Unix()))
+		}
+
+		cached := false
+		for _, k := range keys {
+			if _, err := cachemap.Get(k); err != nil {
+				continue
+			}
+			if err := cachemap.Invalidate(k); err != nil {
+				return n, err
+			}
+			cached = true
+		}
+		if cached {
+			n++
+		}
+	}
+
+	return n, nil
 }
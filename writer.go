@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonm1/flightsense-go/output"
+)
+
+const (
+	// Batches of rows queued for each output file's writer, beyond which the printer
+	// waits for it, and the workers for the printer in turn
+	writerQueue = 64
+
+	// Most rows the printer takes from the workers at once, passing them on to the
+	// writers in a batch
+	maxBatch = 512
+)
+
+// writeBatch is rows for a fileWriter, in order, or when flushed is set, a request
+// to flush the rows sent before it, answered with whether writing them failed
+type writeBatch struct {
+	rows    []*record
+	flushed chan bool
+}
+
+// fileWriter writes the rows of an output file, or its successive parts when output
+// is rotated, in a goroutine of its own. The printer restores the input order while
+// earlier rows are encoded, and the partitions of an input are written at once. Csv
+// and jsonl files are flushed every -flush-interval, so their rows can be read while
+// the run continues.
+type fileWriter struct {
+	path      string
+	appending bool
+	open      func(name string) (output.Writer, error)
+	window    *rowWindow
+
+	batches chan writeBatch
+	done    chan struct{}
+
+	// Owned by the goroutine, and read by the printer once a flush is answered or
+	// done is closed
+	file   *outputFile
+	counts map[string]int
+	err    error
+}
+
+// startWriter opens the output file at path with open and starts writing the rows
+// sent to it, counting each as done in window once written. Rows already in the file
+// are counted first when appending.
+func startWriter(path string, appending bool, open func(name string) (output.Writer, error), window *rowWindow) *fileWriter {
+	w := &fileWriter{
+		path:      path,
+		appending: appending,
+		open:      open,
+		window:    window,
+		batches:   make(chan writeBatch, writerQueue),
+		done:      make(chan struct{}),
+		counts:    make(map[string]int),
+	}
+	go w.run()
+
+	return w
+}
+
+func (w *fileWriter) run() {
+	defer close(w.done)
+
+	if err := w.next(); err != nil {
+		w.fail(err)
+	}
+
+	// Flushes of batched formats write a row group or transaction, so only streamed
+	// formats are flushed as they go. Parts rotated by size are flushed as they
+	// fill, so the same rows end up in each part.
+	var tick <-chan time.Time
+	if *flushInterval > 0 && (*format == "csv" || *format == "jsonl") && *maxSize == 0 {
+		t := time.NewTicker(*flushInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case b, ok := <-w.batches:
+			if !ok {
+				w.close()
+				return
+			}
+			if b.flushed != nil {
+				w.flush()
+				b.flushed <- w.err != nil
+				continue
+			}
+			for _, r := range b.rows {
+				w.write(r)
+			}
+		case <-tick:
+			w.flush()
+		}
+	}
+}
+
+// next opens the output file, or its next part once the current one is full
+func (w *fileWriter) next() error {
+	if w.file == nil {
+		w.file = &outputFile{name: w.path}
+		if rotating() {
+			w.file.part, w.file.name = 1, partName(w.path, 1)
+		}
+	} else {
+		err := w.file.w.Close()
+		w.file.w = nil
+		if err != nil {
+			return fmt.Errorf("Error closing '%s': %s", w.file.name, err)
+		}
+		w.file.part++
+		w.file.name, w.file.rows = partName(w.path, w.file.part), 0
+	}
+
+	if w.appending {
+		w.counts[w.file.name] = countRows(w.file.name, *format)
+	}
+	ow, err := w.open(w.file.name)
+	if err != nil {
+		return err
+	}
+	w.file.w = ow
+
+	return nil
+}
+
+// write writes a row, dropping it once writing has failed
+func (w *fileWriter) write(r *record) {
+	defer w.window.Done()
+	defer rowPool.Put(r.row)
+	if w.err != nil {
+		return
+	}
+
+	if rotating() && w.file.full() {
+		if err := w.next(); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+	if err := w.file.w.WriteRow(*r.row); err != nil {
+		w.fail(fmt.Errorf("Error writing to '%s': %s", w.file.name, err))
+		return
+	}
+	w.file.rows++
+	w.counts[w.file.name]++
+	atomic.AddInt64(&rowsWritten, 1)
+}
+
+func (w *fileWriter) flush() {
+	if w.err != nil {
+		return
+	}
+	if err := w.file.w.Flush(); err != nil {
+		w.fail(fmt.Errorf("Error writing to '%s': %s", w.file.name, err))
+	}
+}
+
+func (w *fileWriter) close() {
+	if w.file == nil || w.file.w == nil {
+		return
+	}
+	if err := w.file.w.Close(); err != nil {
+		w.fail(fmt.Errorf("Error closing '%s': %s", w.file.name, err))
+	}
+}
+
+// fail cancels the run at once, as the rows sent to the writer can no longer be
+// written, and keeps the first error for the write stage to report
+func (w *fileWriter) fail(err error) {
+	fail("%s", err)
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// sync waits for the rows sent to the writer to be written and flushed, reporting
+// whether they were
+func (w *fileWriter) sync() bool {
+	flushed := make(chan bool)
+	w.batches <- writeBatch{flushed: flushed}
+
+	return !<-flushed
+}